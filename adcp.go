@@ -0,0 +1,397 @@
+///
+/// RoweTech (RTI) ADCP binary ensemble decoder.
+///
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Number of 0x80 bytes at the start of an ensemble.
+	adcpHeaderIDSize = 16
+
+	// Size of the ensemble header.  The 0x80 bytes, the ensemble
+	// number, its inverse, the payload size and its inverse.
+	adcpHeaderSize = adcpHeaderIDSize + 16
+
+	// Size of the checksum after the payload.
+	adcpChecksumSize = 4
+
+	// Largest payload accepted.  A larger size is taken
+	// as a false header.
+	adcpMaxPayloadSize = 1024 * 1024
+
+	// Size of a data set header.  The value type, number of elements,
+	// element multiplier, imaginary, name length and the name.
+	adcpDataSetHeaderSize = 5*4 + 8
+
+	// Value given by the ADCP for a bad velocity.
+	adcpBadVelocity = 88.888
+)
+
+// Data set value types.
+const (
+	adcpValueFloat = 10
+	adcpValueInt   = 20
+	adcpValueByte  = 50
+)
+
+// adcpHeaderID is the start of an ensemble.
+var adcpHeaderID = bytes.Repeat([]byte{0x80}, adcpHeaderIDSize)
+
+// adcpDecoder finds the binary ensembles in the data read
+// from a RoweTech ADCP.  An ensemble can be split across
+// many reads.  The checksum of each ensemble is checked
+// and the data sets are decoded.
+type adcpDecoder struct {
+	buf            []byte // Data not decoded yet
+	checksumErrors int    // Number of ensembles with a bad checksum
+}
+
+// ADCPChecksumError is the event data for
+// an ensemble with a bad checksum.
+type ADCPChecksumError struct {
+	EnsembleNumber int32 // Ensemble number from the header
+	Count          int   // Number of bad checksums on the port
+}
+
+// ADCPEnsemble is the event data for a decoded ensemble.
+// The profile data is indexed by [bin][beam].
+type ADCPEnsemble struct {
+	EnsembleNumber     int32
+	Time               time.Time
+	SerialNumber       string
+	Firmware           string
+	Subsystem          string
+	NumBins            int32
+	NumBeams           int32
+	DesiredPingCount   int32
+	ActualPingCount    int32
+	Status             int32
+	Ancillary          *ADCPAncillary
+	BeamVelocity       [][]float32
+	InstrumentVelocity [][]float32
+	EarthVelocity      [][]float32
+	Amplitude          [][]float32
+	Correlation        [][]float32
+	GoodBeam           [][]float32
+	GoodEarth          [][]float32
+	BottomTrack        *ADCPBottomTrack
+	DataSets           []string // Names of all the data sets in the ensemble
+}
+
+// ADCPAncillary is the ancillary data of an ensemble.
+type ADCPAncillary struct {
+	FirstBinRange   float32 // Range to the first bin in meters
+	BinSize         float32 // Bin size in meters
+	FirstPingTime   float32 // Seconds
+	LastPingTime    float32 // Seconds
+	Heading         float32 // Degrees
+	Pitch           float32 // Degrees
+	Roll            float32 // Degrees
+	WaterTemp       float32 // Degrees C
+	SystemTemp      float32 // Degrees C
+	Salinity        float32 // PPT
+	Pressure        float32 // Pascal
+	TransducerDepth float32 // Meters
+	SpeedOfSound    float32 // m/s
+}
+
+// ADCPBottomTrack is the bottom track data of an ensemble.
+// The arrays are indexed by beam.
+type ADCPBottomTrack struct {
+	FirstPingTime      float32
+	LastPingTime       float32
+	Heading            float32
+	Pitch              float32
+	Roll               float32
+	WaterTemp          float32
+	SystemTemp         float32
+	Salinity           float32
+	Pressure           float32
+	TransducerDepth    float32
+	SpeedOfSound       float32
+	Status             float32
+	NumBeams           float32
+	ActualPingCount    float32
+	Range              []float32
+	SNR                []float32
+	Amplitude          []float32
+	Correlation        []float32
+	BeamVelocity       []float32
+	BeamGood           []float32
+	InstrumentVelocity []float32
+	InstrumentGood     []float32
+	EarthVelocity      []float32
+	EarthGood          []float32
+}
+
+// adcpDataSet is a data set in the ensemble payload.
+type adcpDataSet struct {
+	valueType  int32
+	elements   int // Number of elements, eg. bins
+	multiplier int // Element multiplier, eg. beams
+	name       string
+	data       []byte
+}
+
+// decode will add the data and return an event for each
+// complete ensemble found.
+func (ad *adcpDecoder) decode(p []byte) []*PortEvent {
+	ad.buf = append(ad.buf, p...)
+
+	var events []*PortEvent
+	for {
+		// Find the start of an ensemble
+		i := bytes.Index(ad.buf, adcpHeaderID)
+		if i < 0 {
+			// Keep the end, it could be the start of a header
+			if len(ad.buf) > adcpHeaderIDSize {
+				ad.buf = append(ad.buf[:0], ad.buf[len(ad.buf)-adcpHeaderIDSize:]...)
+			}
+			return events
+		}
+		ad.buf = ad.buf[i:]
+
+		if len(ad.buf) < adcpHeaderSize {
+			return events
+		}
+
+		// Check the header.  The number and size are followed by their inverse.
+		ensNum := int32(binary.LittleEndian.Uint32(ad.buf[16:]))
+		ensNumInv := int32(binary.LittleEndian.Uint32(ad.buf[20:]))
+		size := int32(binary.LittleEndian.Uint32(ad.buf[24:]))
+		sizeInv := int32(binary.LittleEndian.Uint32(ad.buf[28:]))
+		if ensNum != ^ensNumInv || size != ^sizeInv || size <= 0 || size > adcpMaxPayloadSize {
+			// False header, look for the next one
+			ad.buf = ad.buf[1:]
+			continue
+		}
+
+		total := adcpHeaderSize + int(size) + adcpChecksumSize
+		if len(ad.buf) < total {
+			return events
+		}
+
+		payload := ad.buf[adcpHeaderSize : adcpHeaderSize+int(size)]
+		checksum := binary.LittleEndian.Uint32(ad.buf[adcpHeaderSize+int(size):])
+
+		if uint32(adcpChecksum(payload)) != checksum {
+			ad.checksumErrors++
+			events = append(events, &PortEvent{
+				Cmd:  "ADCPError",
+				Type: "Checksum",
+				Data: ADCPChecksumError{EnsembleNumber: ensNum, Count: ad.checksumErrors},
+			})
+
+			// The header may be false, look for the next one
+			ad.buf = ad.buf[1:]
+			continue
+		}
+
+		events = append(events, &PortEvent{Cmd: "ADCP", Type: "Ensemble", Data: decodeEnsemble(payload)})
+		ad.buf = ad.buf[total:]
+	}
+}
+
+// adcpChecksum will calculate the CRC-16 CCITT of the payload
+// the same way the ADCP does.
+func adcpChecksum(p []byte) uint16 {
+	var crc uint16
+	for _, b := range p {
+		crc = uint16(byte(crc>>8)) | (crc << 8)
+		crc ^= uint16(b)
+		crc ^= uint16(byte(crc&0xFF) >> 4)
+		crc ^= (crc << 8) << 4
+		crc ^= ((crc & 0xFF) << 4) << 1
+	}
+	return crc
+}
+
+// adcpDataSets will split the payload into the data sets.
+// A data set with no elements, or that does not fit in the
+// payload, ends the list.
+func adcpDataSets(payload []byte) []adcpDataSet {
+	var sets []adcpDataSet
+	for len(payload) >= adcpDataSetHeaderSize {
+		ds := adcpDataSet{
+			valueType:  int32(binary.LittleEndian.Uint32(payload[0:])),
+			elements:   int(int32(binary.LittleEndian.Uint32(payload[4:]))),
+			multiplier: int(int32(binary.LittleEndian.Uint32(payload[8:]))),
+			name:       strings.TrimRight(string(payload[20:28]), "\x00"),
+		}
+		if ds.elements <= 0 || ds.multiplier <= 0 {
+			break
+		}
+
+		valueSize := 4
+		if ds.valueType == adcpValueByte {
+			valueSize = 1
+		}
+
+		// Check each count on its own first so the size cannot overflow
+		left := (len(payload) - adcpDataSetHeaderSize) / valueSize
+		if ds.elements > left || ds.multiplier > left || ds.elements*ds.multiplier > left {
+			break
+		}
+		size := ds.elements * ds.multiplier * valueSize
+
+		ds.data = payload[adcpDataSetHeaderSize : adcpDataSetHeaderSize+size]
+		sets = append(sets, ds)
+		payload = payload[adcpDataSetHeaderSize+size:]
+	}
+	return sets
+}
+
+// float will get the float value at the index.
+// Values that are not a number are given as a bad velocity
+// so they can be sent as JSON.
+func (ds *adcpDataSet) float(i int) float32 {
+	if (i+1)*4 > len(ds.data) {
+		return 0
+	}
+	v := math.Float32frombits(binary.LittleEndian.Uint32(ds.data[i*4:]))
+	if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+		return adcpBadVelocity
+	}
+	return v
+}
+
+// int will get the int value at the index.
+func (ds *adcpDataSet) int(i int) int32 {
+	if (i+1)*4 > len(ds.data) {
+		return 0
+	}
+	return int32(binary.LittleEndian.Uint32(ds.data[i*4:]))
+}
+
+// profile will get the profile data as [bin][beam].
+// The ADCP sends all the bins of a beam before the next beam.
+// It returns nil if the data set is too short for the profile.
+func (ds *adcpDataSet) profile() [][]float32 {
+	if ds.elements <= 0 || ds.multiplier <= 0 || ds.elements > len(ds.data)/4/ds.multiplier {
+		return nil
+	}
+	bins := make([][]float32, ds.elements)
+	for bin := range bins {
+		bins[bin] = make([]float32, ds.multiplier)
+		for beam := 0; beam < ds.multiplier; beam++ {
+			bins[bin][beam] = ds.float(beam*ds.elements + bin)
+		}
+	}
+	return bins
+}
+
+// floats will get count float values starting at the index.
+// No values are given if they are not all in the data set.
+func (ds *adcpDataSet) floats(start int, count int) []float32 {
+	if start < 0 || count < 0 || count > len(ds.data)/4-start {
+		count = 0
+	}
+	values := make([]float32, count)
+	for i := range values {
+		values[i] = ds.float(start + i)
+	}
+	return values
+}
+
+// decodeEnsemble will decode the data sets in the ensemble payload.
+func decodeEnsemble(payload []byte) ADCPEnsemble {
+	var ens ADCPEnsemble
+
+	for _, ds := range adcpDataSets(payload) {
+		ens.DataSets = append(ens.DataSets, ds.name)
+
+		switch ds.name {
+		case "E000001":
+			ens.BeamVelocity = ds.profile()
+		case "E000002":
+			ens.InstrumentVelocity = ds.profile()
+		case "E000003":
+			ens.EarthVelocity = ds.profile()
+		case "E000004":
+			ens.Amplitude = ds.profile()
+		case "E000005":
+			ens.Correlation = ds.profile()
+		case "E000006":
+			ens.GoodBeam = ds.profile()
+		case "E000007":
+			ens.GoodEarth = ds.profile()
+
+		case "E000008":
+			ens.EnsembleNumber = ds.int(0)
+			ens.NumBins = ds.int(1)
+			ens.NumBeams = ds.int(2)
+			ens.DesiredPingCount = ds.int(3)
+			ens.ActualPingCount = ds.int(4)
+			ens.Status = ds.int(5)
+			ens.Time = time.Date(int(ds.int(6)), time.Month(ds.int(7)), int(ds.int(8)),
+				int(ds.int(9)), int(ds.int(10)), int(ds.int(11)), int(ds.int(12))*10*int(time.Millisecond), time.UTC)
+			if len(ds.data) >= 23*4 {
+				ens.SerialNumber = strings.TrimRight(string(ds.data[13*4:21*4]), "\x00")
+				fw := ds.data[21*4:]
+				ens.Firmware = strconv.Itoa(int(fw[2])) + "." + strconv.Itoa(int(fw[1])) + "." + strconv.Itoa(int(fw[0]))
+				ens.Subsystem = string(fw[3])
+			}
+
+		case "E000009":
+			ens.Ancillary = &ADCPAncillary{
+				FirstBinRange:   ds.float(0),
+				BinSize:         ds.float(1),
+				FirstPingTime:   ds.float(2),
+				LastPingTime:    ds.float(3),
+				Heading:         ds.float(4),
+				Pitch:           ds.float(5),
+				Roll:            ds.float(6),
+				WaterTemp:       ds.float(7),
+				SystemTemp:      ds.float(8),
+				Salinity:        ds.float(9),
+				Pressure:        ds.float(10),
+				TransducerDepth: ds.float(11),
+				SpeedOfSound:    ds.float(12),
+			}
+
+		case "E000010":
+			bt := &ADCPBottomTrack{
+				FirstPingTime:   ds.float(0),
+				LastPingTime:    ds.float(1),
+				Heading:         ds.float(2),
+				Pitch:           ds.float(3),
+				Roll:            ds.float(4),
+				WaterTemp:       ds.float(5),
+				SystemTemp:      ds.float(6),
+				Salinity:        ds.float(7),
+				Pressure:        ds.float(8),
+				TransducerDepth: ds.float(9),
+				SpeedOfSound:    ds.float(10),
+				Status:          ds.float(11),
+				NumBeams:        ds.float(12),
+				ActualPingCount: ds.float(13),
+			}
+
+			// The beam arrays follow the fixed values.  A number
+			// of beams that cannot fit in the data set gives none.
+			beams := 0
+			if bt.NumBeams > 0 && bt.NumBeams <= float32(len(ds.data)/4) {
+				beams = int(bt.NumBeams)
+			}
+			arrays := []*[]float32{
+				&bt.Range, &bt.SNR, &bt.Amplitude, &bt.Correlation, &bt.BeamVelocity,
+				&bt.BeamGood, &bt.InstrumentVelocity, &bt.InstrumentGood, &bt.EarthVelocity, &bt.EarthGood,
+			}
+			for i, a := range arrays {
+				*a = ds.floats(14+i*beams, beams)
+			}
+			ens.BottomTrack = bt
+		}
+	}
+
+	return ens
+}
@@ -0,0 +1,199 @@
+///
+/// Tests of the RoweTech ADCP ensemble decoder.
+///
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// adcpSet will build a data set with the values.
+// The values are float32, int32 or bytes.
+func adcpSet(name string, valueType int32, elements int32, multiplier int32, values interface{}) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, []int32{valueType, elements, multiplier, 0, 8})
+	n := make([]byte, 8)
+	copy(n, name)
+	buf.Write(n)
+	binary.Write(&buf, binary.LittleEndian, values)
+	return buf.Bytes()
+}
+
+// adcpEnsemble will build an ensemble with the header,
+// payload and checksum.
+func adcpEnsemble(num int32, payload []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(adcpHeaderID)
+	size := int32(len(payload))
+	binary.Write(&buf, binary.LittleEndian, []int32{num, ^num, size, ^size})
+	buf.Write(payload)
+	binary.Write(&buf, binary.LittleEndian, uint32(adcpChecksum(payload)))
+	return buf.Bytes()
+}
+
+// adcpEnsembleSet will build the ensemble data set.  It has
+// 13 values, the serial number, the firmware version and
+// subsystem, and the subsystem configuration.
+func adcpEnsembleSet(num int32, bins int32, beams int32) []byte {
+	values := []int32{num, bins, beams, 10, 9, 0, 2024, 3, 15, 12, 30, 45, 50}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, values)
+	buf.WriteString("01300000000000000000000000000001"[:32])
+	buf.Write([]byte{0x11, 0x00, 0x00, '3'})
+	buf.Write([]byte{0x01, 0x00, 0x00, 0x00})
+	return adcpSet("E000008", adcpValueInt, int32(buf.Len()/4), 1, buf.Bytes())
+}
+
+// TestADCPChecksum will check the CRC-16 CCITT against the known values.
+func TestADCPChecksum(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want uint16
+	}{
+		{[]byte("123456789"), 0x31C3},
+		{[]byte{}, 0x0000},
+		{[]byte{0x00}, 0x0000},
+		{[]byte("A"), 0x58E5},
+	}
+	for _, tt := range tests {
+		if got := adcpChecksum(tt.data); got != tt.want {
+			t.Errorf("adcpChecksum(%q) = 0x%04x, want 0x%04x", tt.data, got, tt.want)
+		}
+	}
+}
+
+// TestADCPDecode will check the ensemble data, the profiles
+// indexed by [bin][beam] and the ancillary data are decoded.
+func TestADCPDecode(t *testing.T) {
+	// 3 bins and 2 beams.  All the bins of beam 0, then beam 1.
+	vel := []float32{1, 2, 3, 4, 5, float32(math.NaN())}
+	anc := make([]float32, 13)
+	for i := range anc {
+		anc[i] = float32(i) + 0.5
+	}
+	payload := join(
+		adcpEnsembleSet(42, 3, 2),
+		adcpSet("E000001", adcpValueFloat, 3, 2, vel),
+		adcpSet("E000009", adcpValueFloat, 13, 1, anc),
+	)
+
+	events := (&adcpDecoder{}).decode(adcpEnsemble(42, payload))
+	if len(events) != 1 || events[0].Cmd != "ADCP" {
+		t.Fatalf("got %d events, want 1 ADCP event", len(events))
+	}
+	ens := events[0].Data.(ADCPEnsemble)
+
+	if ens.EnsembleNumber != 42 || ens.NumBins != 3 || ens.NumBeams != 2 || ens.DesiredPingCount != 10 || ens.ActualPingCount != 9 {
+		t.Errorf("ensemble is %+v", ens)
+	}
+	if want := time.Date(2024, 3, 15, 12, 30, 45, 500*int(time.Millisecond), time.UTC); !ens.Time.Equal(want) {
+		t.Errorf("time is %v, want %v", ens.Time, want)
+	}
+	if ens.SerialNumber != "01300000000000000000000000000001" || ens.Firmware != "0.0.17" || ens.Subsystem != "3" {
+		t.Errorf("serial %q firmware %q subsystem %q", ens.SerialNumber, ens.Firmware, ens.Subsystem)
+	}
+
+	wantVel := [][]float32{{1, 4}, {2, 5}, {3, adcpBadVelocity}}
+	if !reflect.DeepEqual(ens.BeamVelocity, wantVel) {
+		t.Errorf("beam velocity is %v, want %v", ens.BeamVelocity, wantVel)
+	}
+	if ens.Ancillary == nil || ens.Ancillary.FirstBinRange != 0.5 || ens.Ancillary.SpeedOfSound != 12.5 {
+		t.Errorf("ancillary is %+v", ens.Ancillary)
+	}
+	if want := []string{"E000008", "E000001", "E000009"}; !reflect.DeepEqual(ens.DataSets, want) {
+		t.Errorf("data sets are %v, want %v", ens.DataSets, want)
+	}
+}
+
+// TestADCPSplit will check an ensemble split across reads,
+// after noise and a false header, is decoded once.
+func TestADCPSplit(t *testing.T) {
+	ens := adcpEnsemble(7, adcpEnsembleSet(7, 1, 1))
+	stream := join([]byte("noise"), adcpHeaderID, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}, ens, ens[:10])
+
+	ad := &adcpDecoder{}
+	var events []*PortEvent
+	for i := 0; i < len(stream); i += 7 {
+		end := i + 7
+		if end > len(stream) {
+			end = len(stream)
+		}
+		events = append(events, ad.decode(stream[i:end])...)
+	}
+	if len(events) != 1 || events[0].Cmd != "ADCP" {
+		t.Fatalf("got %d events, want 1 ADCP event", len(events))
+	}
+	if num := events[0].Data.(ADCPEnsemble).EnsembleNumber; num != 7 {
+		t.Errorf("ensemble number is %d, want 7", num)
+	}
+
+	// The rest of the next ensemble is still decoded
+	events = ad.decode(ens[10:])
+	if len(events) != 1 || events[0].Cmd != "ADCP" {
+		t.Errorf("got %d events for the rest of the ensemble, want 1", len(events))
+	}
+}
+
+// TestADCPBadChecksum will check a bad checksum is counted
+// and the next ensemble is still decoded.
+func TestADCPBadChecksum(t *testing.T) {
+	bad := adcpEnsemble(1, adcpEnsembleSet(1, 1, 1))
+	bad[len(bad)-1] ^= 0xFF
+	good := adcpEnsemble(2, adcpEnsembleSet(2, 1, 1))
+
+	events := (&adcpDecoder{}).decode(join(bad, good))
+	if len(events) != 2 || events[0].Cmd != "ADCPError" || events[1].Cmd != "ADCP" {
+		t.Fatalf("got %d events, want an ADCPError then an ADCP event", len(events))
+	}
+	if e := events[0].Data.(ADCPChecksumError); e.EnsembleNumber != 1 || e.Count != 1 {
+		t.Errorf("checksum error is %+v", e)
+	}
+}
+
+// TestADCPDataSets will check data sets that do not fit in
+// the payload, or have no elements, end the list.
+func TestADCPDataSets(t *testing.T) {
+	good := adcpSet("E000001", adcpValueFloat, 2, 2, []float32{1, 2, 3, 4})
+	tests := []struct {
+		name    string
+		payload []byte
+		want    []string
+	}{
+		{"one set", good, []string{"E000001"}},
+		{"short header", join(good, make([]byte, adcpDataSetHeaderSize-1)), []string{"E000001"}},
+		{"past the end", join(good, adcpSet("E000002", adcpValueFloat, 2, 2, []float32{1, 2, 3})), []string{"E000001"}},
+		{"no elements", join(adcpSet("E000002", adcpValueFloat, 0, 4, []float32{}), good), nil},
+		{"negative multiplier", adcpSet("E000002", adcpValueFloat, 1, -1, []float32{1}), nil},
+		{"overflow", adcpSet("E000002", adcpValueFloat, 0x40000000, 0x40000000, []float32{1}), nil},
+		{"bytes", adcpSet("E000008", adcpValueByte, 3, 1, []byte{1, 2, 3}), []string{"E000008"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var names []string
+			for _, ds := range adcpDataSets(tt.payload) {
+				names = append(names, ds.name)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("data sets are %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+// TestADCPProfileShort will check a profile that does not
+// fit in its data set is not decoded.
+func TestADCPProfileShort(t *testing.T) {
+	ds := adcpDataSet{elements: 3, multiplier: 2, data: make([]byte, 5*4)}
+	if p := ds.profile(); p != nil {
+		t.Errorf("profile is %v, want nil", p)
+	}
+	if v := ds.floats(4, 2); len(v) != 0 {
+		t.Errorf("floats past the end are %v, want none", v)
+	}
+}
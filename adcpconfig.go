@@ -0,0 +1,351 @@
+///
+/// RoweTech ADCP configuration.  Reads the CSHOW
+/// output and applies an edited configuration.
+///
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Default time to wait for the whole CSHOW response.
+	defaultADCPTimeout = 5000 * time.Millisecond
+
+	// Time without data that ends a response when no prompt is given.
+	adcpResponseIdle = 500 * time.Millisecond
+
+	// Time to wait for another session on the port to finish.
+	adcpBusyWait = 5 * time.Second
+)
+
+// Actions of an ADCP config request.
+const (
+	adcpConfigGet = "get"
+	adcpConfigSet = "set"
+)
+
+// adcpSettingName matches a setting line in the CSHOW output,
+// eg. CWPBL[0] 0.40  The index is the subsystem configuration.
+var adcpSettingName = regexp.MustCompile(`^C[A-Z0-9]+(\[\d+\])?$`)
+
+// ADCPSetting is a setting of the ADCP.  The command to
+// apply it is the name followed by the value.
+type ADCPSetting struct {
+	Name  string // Command name, eg. CWPBL[0]
+	Value string // Value as shown by CSHOW, eg. 0.40
+}
+
+// ADCPConfig is the configuration of the ADCP
+// parsed from the CSHOW output.
+type ADCPConfig struct {
+	Info     map[string]string // Lines given as Name: Value, eg. the serial number
+	Settings []ADCPSetting     // Settings in the order shown
+}
+
+// ADCPConfigRequest is a request from a client to get
+// or set the configuration of the ADCP.
+type ADCPConfigRequest struct {
+	ID      string      // Given by the client and returned in the response
+	Port    string      // Serial port the ADCP is on, i.e. COM6
+	Action  string      // get or set
+	Config  *ADCPConfig // Settings to apply for set.  Only the changed settings are sent.
+	Save    bool        // Send CSAVE after the settings are applied
+	Prompt  string      // Text that ends a response.  Empty to wait for the port to be idle.
+	Timeout int         // Time to wait for a response in milliseconds.  0 for the default.
+}
+
+// ADCPCommandResult is a command sent to apply the
+// configuration and the response from the ADCP.
+type ADCPCommandResult struct {
+	Command  string
+	Response string
+}
+
+// ADCPSettingDiff is a setting that does not have the
+// wanted value after the configuration was applied.
+type ADCPSettingDiff struct {
+	Name string
+	Want string // Value in the request
+	Got  string // Value shown by CSHOW.  Empty if the setting is missing.
+}
+
+// ADCPConfigResponse is the response to an ADCP config request.
+type ADCPConfigResponse struct {
+	Cmd      string // ADCPConfig
+	ID       string // ID given in the request
+	Port     string
+	Action   string
+	Config   *ADCPConfig         // Configuration read from the ADCP
+	Commands []ADCPCommandResult // Commands sent to apply the configuration
+	Diff     []ADCPSettingDiff   // Settings not applied.  Empty if all the settings were verified.
+	Error    string              // Error if the request failed
+	Ts       time.Time
+}
+
+// parseCSHOW will parse the CSHOW output into the configuration.
+// Lines that are not a setting or Name: Value are ignored.
+func parseCSHOW(output string) *ADCPConfig {
+	config := &ADCPConfig{Info: map[string]string{}}
+
+	scanner := bufio.NewScanner(strings.NewReader(strings.Replace(output, "\r", "\n", -1)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 2)
+		if adcpSettingName.MatchString(fields[0]) {
+			// The echo of the command has no value
+			if len(fields) < 2 || strings.EqualFold(fields[0], "CSHOW") {
+				continue
+			}
+			config.Settings = append(config.Settings, ADCPSetting{Name: fields[0], Value: strings.TrimSpace(fields[1])})
+			continue
+		}
+
+		if i := strings.Index(line, ":"); i > 0 {
+			config.Info[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+		}
+	}
+
+	return config
+}
+
+// get will get the value of the setting.
+func (config *ADCPConfig) get(name string) (string, bool) {
+	for _, s := range config.Settings {
+		if strings.EqualFold(s.Name, name) {
+			return s.Value, true
+		}
+	}
+	return "", false
+}
+
+// commands will get the commands needed to change the
+// current configuration into this one.  All the settings
+// are given if current is nil.
+func (config *ADCPConfig) commands(current *ADCPConfig) []string {
+	var cmds []string
+	for _, s := range config.Settings {
+		if current != nil {
+			if value, isFound := current.get(s.Name); isFound && sameADCPValue(value, s.Value) {
+				continue
+			}
+		}
+		cmds = append(cmds, s.Name+" "+s.Value)
+	}
+	return cmds
+}
+
+// diff will get the settings of this configuration that
+// do not have the same value in the other configuration.
+func (config *ADCPConfig) diff(other *ADCPConfig) []ADCPSettingDiff {
+	var diff []ADCPSettingDiff
+	for _, s := range config.Settings {
+		value, _ := other.get(s.Name)
+		if !sameADCPValue(value, s.Value) {
+			diff = append(diff, ADCPSettingDiff{Name: s.Name, Want: s.Value, Got: value})
+		}
+	}
+	return diff
+}
+
+// sameADCPValue will check if two setting values are the same.
+// The values are split on commas and spaces and numbers are
+// compared by value, so 35 is the same as 35.00
+func sameADCPValue(a string, b string) bool {
+	split := func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }
+	fa := strings.FieldsFunc(a, split)
+	fb := strings.FieldsFunc(b, split)
+	if len(fa) != len(fb) {
+		return false
+	}
+
+	for i := range fa {
+		if strings.EqualFold(fa[i], fb[i]) {
+			continue
+		}
+		na, errA := strconv.ParseFloat(fa[i], 64)
+		nb, errB := strconv.ParseFloat(fb[i], 64)
+		if errA != nil || errB != nil || na != nb {
+			return false
+		}
+	}
+	return true
+}
+
+// runADCPConfig will run the request on the ADCP.
+func runADCPConfig(req ADCPConfigRequest) ADCPConfigResponse {
+	resp := ADCPConfigResponse{
+		Cmd:    "ADCPConfig",
+		ID:     req.ID,
+		Port:   req.Port,
+		Action: req.Action,
+	}
+
+	err := req.run(&resp)
+	if err != nil {
+		log.Println("ADCP config request failed. " + err.Error())
+		resp.Error = err.Error()
+	}
+	resp.Ts = time.Now()
+	return resp
+}
+
+// run will get or set the configuration and fill in the response.
+func (req *ADCPConfigRequest) run(resp *ADCPConfigResponse) error {
+	action := strings.ToLower(req.Action)
+	if action != adcpConfigGet && action != adcpConfigSet {
+		return errors.New("Unknown ADCP config action " + req.Action)
+	}
+	if action == adcpConfigSet && (req.Config == nil || len(req.Config.Settings) == 0) {
+		return errors.New("No settings given to set")
+	}
+
+	spio, isFound := findPortByName(req.Port)
+	if !isFound {
+		return errors.New("Could not find the serial port " + req.Port)
+	}
+
+	ps, err := spio.openSession("adcp", adcpBusyWait)
+	if err != nil {
+		return err
+	}
+	defer ps.close()
+
+	current, err := req.cshow(ps)
+	if err != nil {
+		return err
+	}
+	resp.Config = current
+
+	if action == adcpConfigGet {
+		return nil
+	}
+
+	// Send only the settings that changed
+	cmds := req.Config.commands(current)
+	if req.Save && len(cmds) > 0 {
+		cmds = append(cmds, "CSAVE")
+	}
+	for _, cmd := range cmds {
+		response, err := req.command(ps, cmd)
+		resp.Commands = append(resp.Commands, ADCPCommandResult{Command: cmd, Response: response})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Verify the settings were applied
+	applied, err := req.cshow(ps)
+	if err != nil {
+		return err
+	}
+	resp.Config = applied
+	resp.Diff = req.Config.diff(applied)
+	if len(resp.Diff) > 0 {
+		return errors.New(strconv.Itoa(len(resp.Diff)) + " settings were not applied")
+	}
+
+	return nil
+}
+
+// cshow will send CSHOW and parse the configuration.
+func (req *ADCPConfigRequest) cshow(ps *portSession) (*ADCPConfig, error) {
+	output, err := req.command(ps, "CSHOW")
+	if err != nil {
+		return nil, err
+	}
+
+	config := parseCSHOW(output)
+	if len(config.Settings) == 0 {
+		return nil, errors.New("No settings found in the CSHOW response")
+	}
+	return config, nil
+}
+
+// command will send the command to the ADCP and read the
+// response until the prompt, or until the port is idle
+// if there is no prompt.
+func (req *ADCPConfigRequest) command(ps *portSession, cmd string) (string, error) {
+	timeout := defaultADCPTimeout
+	if req.Timeout > 0 {
+		timeout = time.Duration(req.Timeout) * time.Millisecond
+	}
+
+	ps.discard()
+	if err := ps.write([]byte(cmd + "\r")); err != nil {
+		return "", err
+	}
+
+	if req.Prompt == "" {
+		// The response ends when the port is idle.  A command
+		// with no response is checked when the settings are verified.
+		data, err := ps.readUntil(func([]byte) int { return -1 }, timeout, adcpResponseIdle)
+		if err == errIdle {
+			err = nil
+		}
+		return string(data), err
+	}
+
+	prompt := []byte(req.Prompt)
+	data, err := ps.readUntil(func(p []byte) int {
+		if i := bytes.Index(p, prompt); i >= 0 {
+			return i + len(prompt)
+		}
+		return -1
+	}, timeout, 0)
+	return string(data), err
+}
+
+// adcpConfigCmd will run the ADCP config request given as JSON
+// and send the response to the client that sent the command.
+// Cmd: ADCPCONFIG {"Port":"COM6","Action":"get"}
+func adcpConfigCmd(c *websocketConn, cmd string) {
+	var req ADCPConfigRequest
+
+	// Get the JSON after the command
+	cmds := strings.SplitN(strings.TrimSpace(cmd), " ", 2)
+	if len(cmds) != 2 {
+		replyTo(c, ADCPConfigResponse{Cmd: "ADCPConfig", Error: "Could not parse adcpconfig command: " + cmd})
+		return
+	}
+	if err := json.Unmarshal([]byte(cmds[1]), &req); err != nil {
+		replyTo(c, ADCPConfigResponse{Cmd: "ADCPConfig", Error: "Bad adcpconfig request. " + err.Error()})
+		return
+	}
+
+	// Do not block the echo hub while waiting for the ADCP
+	go func() {
+		replyTo(c, runADCPConfig(req))
+	}()
+}
+
+// adcpConfigHandler runs the ADCP config request given
+// as JSON in the body of a POST request.
+func adcpConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	var req ADCPConfigRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad adcpconfig request. "+err.Error(), 400)
+		return
+	}
+
+	writeJSON(w, runADCPConfig(req))
+}
@@ -0,0 +1,204 @@
+///
+/// Backpressure policies for websocket clients
+/// that cannot keep up with the serial port data.
+///
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// Close the websocket when its send buffer is full.
+	policyDisconnect = "disconnect"
+
+	// Drop the oldest message in the send buffer to make room.
+	policyDropOldest = "drop-oldest"
+
+	// Combine the messages in the send buffer into a single frame.
+	policyCoalesce = "coalesce"
+
+	// Maximum size of a coalesced frame.  The oldest
+	// messages that will not fit are dropped.
+	maxCoalesceSize = 1024 * 1024
+)
+
+// Start and end of a coalesced frame.
+var (
+	batchStart = []byte("{\"Cmd\":\"Batch\",\"Msgs\":[")
+	batchEnd   = []byte("]}")
+)
+
+// DroppedMessage is sent to a websocket client
+// when messages to the client were dropped.
+type DroppedMessage struct {
+	Cmd   string // Dropped
+	Count uint64 // Messages dropped since the last Dropped message
+	Total uint64 // Messages dropped since the client connected
+}
+
+// isPolicy will check if the backpressure policy is known.
+func isPolicy(policy string) bool {
+	return policy == policyDisconnect || policy == policyDropOldest || policy == policyCoalesce
+}
+
+// setPolicy will set the backpressure policy of the client.
+// Cmd: POLICY [disconnect|drop-oldest|coalesce]
+func (wsConn *websocketConn) setPolicy(cmd string) {
+	cmds := strings.Fields(cmd)
+	if len(cmds) != 2 {
+		log.Println("Could not parse policy command: " + cmd)
+		return
+	}
+
+	policy := strings.ToLower(cmds[1])
+	if !isPolicy(policy) {
+		log.Println("Unknown backpressure policy: " + policy)
+		return
+	}
+
+	log.Println("Client " + wsConn.identity() + " backpressure policy " + policy)
+	wsConn.policy = policy
+}
+
+// drop will count the messages dropped for the client.
+// The client is told about them by the writer.
+func (wsConn *websocketConn) drop(count uint64) {
+	atomic.AddUint64(&wsConn.dropped, count)
+	atomic.AddUint64(&wsConn.droppedPending, count)
+}
+
+// droppedMessage will get the message to tell the client
+// about dropped messages.  It returns nil if no messages
+// were dropped since the last call.
+func (wsConn *websocketConn) droppedMessage() []byte {
+	count := atomic.SwapUint64(&wsConn.droppedPending, 0)
+	if count == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(DroppedMessage{Cmd: "Dropped", Count: count, Total: atomic.LoadUint64(&wsConn.dropped)})
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return b
+}
+
+// deliver will put the message in the send buffer of the client.
+// If the send buffer is full, the backpressure policy of the
+// client is used.  It returns false if the client must be disconnected.
+// This must only be called from the echo hub.
+func (wsConn *websocketConn) deliver(m []byte) bool {
+	select {
+	case wsConn.send <- m:
+		return true
+	default:
+	}
+
+	switch wsConn.policy {
+	case policyDropOldest:
+		// Remove the oldest message to make room.  The writer
+		// may have made room already, so the receive can fail.
+		select {
+		case <-wsConn.send:
+			wsConn.drop(1)
+		default:
+		}
+
+	case policyCoalesce:
+		// Combine all the queued messages into one frame.
+		// A frame coalesced before is replaced by its messages.
+		var msgs [][]byte
+		for isEmpty := false; !isEmpty; {
+			select {
+			case queued := <-wsConn.send:
+				if wsConn.isCoalesced(queued) {
+					msgs = append(msgs, wsConn.coalesced...)
+				} else {
+					msgs = append(msgs, toJSON(queued))
+				}
+			default:
+				isEmpty = true
+			}
+		}
+		msgs = append(msgs, toJSON(m))
+
+		// Keep the newest messages that fit in the frame
+		start := coalesceStart(msgs)
+		if start > 0 {
+			log.Println("Coalesced frame too large for " + wsConn.identity() + ", dropping the oldest " + strconv.Itoa(start) + " messages")
+			wsConn.drop(uint64(start))
+		}
+		wsConn.coalesced = msgs[start:]
+		m = coalesce(wsConn.coalesced)
+		wsConn.coalescedFrame = m
+
+	default:
+		return false
+	}
+
+	select {
+	case wsConn.send <- m:
+	default:
+		wsConn.drop(1)
+	}
+	return true
+}
+
+// isCoalesced will check if the message is the frame last
+// coalesced for the client.  Its messages are kept, so it does
+// not need to be parsed to add more messages to it.
+// This must only be called from the echo hub.
+func (wsConn *websocketConn) isCoalesced(m []byte) bool {
+	return len(m) > 0 && len(wsConn.coalescedFrame) > 0 && &m[0] == &wsConn.coalescedFrame[0]
+}
+
+// toJSON will get the message as JSON.  A message that is
+// not JSON is given as a JSON string.
+func toJSON(m []byte) []byte {
+	if json.Valid(m) {
+		return m
+	}
+	s, _ := json.Marshal(string(m))
+	return s
+}
+
+// coalesceStart will get the index of the oldest message that
+// fits in a frame of maxCoalesceSize with all the newer ones.
+// The newest message is always kept.
+func coalesceStart(msgs [][]byte) int {
+	size := len(batchStart) + len(batchEnd)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		size += len(msgs[i]) + 1
+		if size > maxCoalesceSize && i < len(msgs)-1 {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// coalesce will combine the JSON messages into a single Batch frame.
+func coalesce(msgs [][]byte) []byte {
+	size := len(batchStart) + len(batchEnd)
+	for _, m := range msgs {
+		size += len(m) + 1
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	buf.Write(batchStart)
+	for i, m := range msgs {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(m)
+	}
+	buf.Write(batchEnd)
+	return buf.Bytes()
+}
@@ -0,0 +1,84 @@
+///
+/// Batch the data read from a serial port
+/// into fewer websocket messages.
+///
+
+package main
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// readBatcher collects the data read from a serial port
+// and publishes it as a single message when the batch is
+// full or the max latency has passed since the first data
+// in the batch was read.  This keeps a fast port from
+// flooding the websockets with tiny messages.
+type readBatcher struct {
+	spio       *serialPortIO // Serial port the data is published on
+	maxSize    int           // Publish when the batch has this many bytes
+	maxLatency time.Duration // Publish when the oldest data in the batch is this old
+
+	mu    sync.Mutex   // Protects the batch, the reader and the timer both flush
+	buf   bytes.Buffer // Data in the batch.  The buffer is reused for each batch.
+	timer *time.Timer  // Flushes the batch after the max latency.  Nil if not running.
+}
+
+// newReadBatcher will create the batcher for the serial port.
+// If the max size or latency is 0, each read is published
+// right away.
+func newReadBatcher(spio *serialPortIO, maxSize int, maxLatency time.Duration) *readBatcher {
+	rb := &readBatcher{
+		spio:       spio,
+		maxSize:    maxSize,
+		maxLatency: maxLatency,
+	}
+	rb.buf.Grow(maxSize)
+	return rb
+}
+
+// write will add the data read from the serial port to the batch.
+// The data is copied, so the read buffer can be reused.
+func (rb *readBatcher) write(p []byte) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.buf.Write(p)
+
+	// Publish right away if batching is off or the batch is full
+	if rb.maxSize <= 0 || rb.maxLatency <= 0 || rb.buf.Len() >= rb.maxSize {
+		rb.flushLocked()
+		return
+	}
+
+	// Start the timer on the first data in the batch
+	if rb.timer == nil {
+		rb.timer = time.AfterFunc(rb.maxLatency, rb.flush)
+	}
+}
+
+// flush will publish the data in the batch.
+func (rb *readBatcher) flush() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.flushLocked()
+}
+
+// flushLocked will publish the data in the batch.
+// The lock must be held.
+func (rb *readBatcher) flushLocked() {
+	if rb.timer != nil {
+		rb.timer.Stop()
+		rb.timer = nil
+	}
+
+	if rb.buf.Len() == 0 {
+		return
+	}
+
+	// The data is copied when published so the buffer can be reused
+	rb.spio.publishData(rb.buf.Bytes())
+	rb.buf.Reset()
+}
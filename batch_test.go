@@ -0,0 +1,111 @@
+///
+/// Benchmarks of the batching of the data read
+/// from a simulated serial port.
+///
+
+package main
+
+import (
+	"io"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// simulatedPort is a serial port that returns the same
+// data on each read, a chunk at a time, until the total
+// number of bytes has been read.
+type simulatedPort struct {
+	chunk []byte // Data returned by each read
+	left  int    // Bytes left to read
+}
+
+// newSimulatedPort will create a port returning the
+// total number of bytes in reads of the chunk size.
+func newSimulatedPort(chunkSize int, total int) *simulatedPort {
+	chunk := make([]byte, chunkSize)
+	for i := range chunk {
+		chunk[i] = byte('0' + i%10)
+	}
+	return &simulatedPort{chunk: chunk, left: total}
+}
+
+// Read will copy the next chunk into p.
+func (sp *simulatedPort) Read(p []byte) (int, error) {
+	if sp.left <= 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, sp.chunk)
+	if n > sp.left {
+		n = sp.left
+	}
+	sp.left -= n
+	return n, nil
+}
+
+// newBenchPort will create the serial port the batcher publishes
+// on, and drain the broadcast so the publish does not block.
+func newBenchPort(b *testing.B) *serialPortIO {
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-echo.wsBroadcast:
+			case <-done:
+				return
+			}
+		}
+	}()
+	b.Cleanup(func() { close(done) })
+
+	return &serialPortIO{
+		portConf: &SerialConfig{Name: "bench", Baud: 115200},
+		history:  newHistoryBuffer(*historyBytes, *historyLines),
+	}
+}
+
+// readAll will read the simulated port into the batcher,
+// the way the serial port reader does.
+func readAll(r io.Reader, rb *readBatcher, buf []byte) {
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			rb.write(buf[:n])
+		}
+		if err != nil {
+			break
+		}
+	}
+	rb.flush()
+}
+
+// benchmarkBatcher will read 1 MiB from the simulated port
+// in reads of each size, with the batch size and latency.
+func benchmarkBatcher(b *testing.B, maxSize int, maxLatency time.Duration) {
+	const total = 1 << 20
+	for _, chunkSize := range []int{1, 16, 256, readBufferSize} {
+		b.Run("read-"+strconv.Itoa(chunkSize), func(b *testing.B) {
+			spio := newBenchPort(b)
+			buf := make([]byte, readBufferSize)
+			b.SetBytes(total)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rb := newReadBatcher(spio, maxSize, maxLatency)
+				readAll(newSimulatedPort(chunkSize, total), rb, buf)
+			}
+		})
+	}
+}
+
+// BenchmarkReadBatcher will measure the throughput and
+// allocations with the default batch size and latency.
+func BenchmarkReadBatcher(b *testing.B) {
+	benchmarkBatcher(b, 4096, 10*time.Millisecond)
+}
+
+// BenchmarkReadBatcherOff will measure the throughput and
+// allocations when each read is published right away.
+func BenchmarkReadBatcherOff(b *testing.B) {
+	benchmarkBatcher(b, 0, 0)
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+///
+/// Baud rates supported by the serial ports on macOS and BSD.
+///
+
+package main
+
+// supportedBaudRates are the POSIX termios baud rates.
+var supportedBaudRates = []int{
+	50, 75, 110, 134, 150, 200, 300, 600, 1200, 1800, 2400, 4800, 9600,
+	19200, 38400, 57600, 115200, 230400,
+}
@@ -0,0 +1,12 @@
+///
+/// Baud rates supported by the serial ports on Windows.
+///
+
+package main
+
+// supportedBaudRates are the CBR_ baud rates, and the higher
+// rates accepted by most USB serial drivers.
+var supportedBaudRates = []int{
+	110, 300, 600, 1200, 2400, 4800, 9600, 14400, 19200, 38400, 57600,
+	115200, 128000, 230400, 256000, 460800, 921600,
+}
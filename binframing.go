@@ -0,0 +1,299 @@
+///
+/// Binary framing of serial port data.
+/// SLIP, COBS and length-prefixed packets.
+///
+
+package main
+
+import (
+	"errors"
+	"strconv"
+)
+
+const (
+	// SLIP packets (RFC 1055).
+	framingSLIP = "slip"
+
+	// COBS packets, each ending with a zero byte.
+	framingCOBS = "cobs"
+
+	// Packets with a 1 byte length prefix.
+	framingLen8 = "len8"
+
+	// Packets with a 2 byte big endian length prefix.
+	framingLen16 = "len16"
+
+	// Packets with a 2 byte little endian length prefix.
+	framingLen16LE = "len16le"
+)
+
+// SLIP special characters.
+const (
+	slipEnd    = 0xC0 // End of packet
+	slipEsc    = 0xDB // Escape
+	slipEscEnd = 0xDC // Escaped END
+	slipEscEsc = 0xDD // Escaped ESC
+)
+
+// frameEncoder wraps data written to a
+// serial port into a frame.
+type frameEncoder interface {
+	encode(p []byte) ([]byte, error)
+}
+
+// slipFramer decodes and encodes SLIP packets.
+type slipFramer struct {
+	buf       []byte // Partial packet
+	isEscaped bool   // Last byte was ESC
+	err       error  // Error found in the partial packet
+}
+
+// feed will add the data and return the complete packets.
+// Packets with a bad escape are reported as errors.
+func (sf *slipFramer) feed(p []byte) ([][]byte, []error) {
+	var packets [][]byte
+	var errs []error
+
+	for _, b := range p {
+		if sf.isEscaped {
+			sf.isEscaped = false
+			switch b {
+			case slipEscEnd:
+				sf.buf = append(sf.buf, slipEnd)
+				continue
+			case slipEscEsc:
+				sf.buf = append(sf.buf, slipEsc)
+				continue
+			case slipEnd:
+				// Fall through to end the packet
+			default:
+				if sf.err == nil {
+					sf.err = errors.New("SLIP bad escape 0x" + strconv.FormatInt(int64(b), 16))
+				}
+				continue
+			}
+		}
+
+		switch b {
+		case slipEnd:
+			// Empty packets are used to flush line noise
+			if sf.err != nil {
+				errs = append(errs, sf.err)
+			} else if len(sf.buf) > 0 {
+				packets = append(packets, sf.buf)
+			}
+			sf.buf = nil
+			sf.err = nil
+		case slipEsc:
+			sf.isEscaped = true
+		default:
+			sf.buf = append(sf.buf, b)
+		}
+	}
+
+	return packets, errs
+}
+
+// flush will drop the partial packet and report it.
+func (sf *slipFramer) flush() ([]byte, error) {
+	isPartial := len(sf.buf) > 0 || sf.isEscaped || sf.err != nil
+	sf.buf = nil
+	sf.isEscaped = false
+	sf.err = nil
+
+	if isPartial {
+		return nil, errors.New("SLIP incomplete packet")
+	}
+	return nil, nil
+}
+
+// encode will wrap the data in a SLIP packet.
+func (sf *slipFramer) encode(p []byte) ([]byte, error) {
+	frame := make([]byte, 0, len(p)+2)
+	frame = append(frame, slipEnd)
+	for _, b := range p {
+		switch b {
+		case slipEnd:
+			frame = append(frame, slipEsc, slipEscEnd)
+		case slipEsc:
+			frame = append(frame, slipEsc, slipEscEsc)
+		default:
+			frame = append(frame, b)
+		}
+	}
+	return append(frame, slipEnd), nil
+}
+
+// cobsFramer decodes and encodes COBS packets.
+// Each packet ends with a zero byte.
+type cobsFramer struct {
+	buf []byte // Partial encoded packet
+}
+
+// feed will add the data and return the complete packets.
+// Packets that cannot be decoded are reported as errors.
+func (cf *cobsFramer) feed(p []byte) ([][]byte, []error) {
+	var packets [][]byte
+	var errs []error
+
+	for _, b := range p {
+		if b != 0 {
+			cf.buf = append(cf.buf, b)
+			continue
+		}
+
+		// Ignore empty packets
+		if len(cf.buf) > 0 {
+			packet, err := cobsDecode(cf.buf)
+			if err != nil {
+				errs = append(errs, err)
+			} else {
+				packets = append(packets, packet)
+			}
+		}
+		cf.buf = nil
+	}
+
+	return packets, errs
+}
+
+// flush will drop the partial packet and report it.
+func (cf *cobsFramer) flush() ([]byte, error) {
+	if len(cf.buf) == 0 {
+		return nil, nil
+	}
+	cf.buf = nil
+	return nil, errors.New("COBS incomplete packet")
+}
+
+// encode will wrap the data in a COBS packet.
+func (cf *cobsFramer) encode(p []byte) ([]byte, error) {
+	frame := make([]byte, 1, len(p)+len(p)/254+2)
+	codeIdx := 0
+	code := byte(1)
+
+	for _, b := range p {
+		// A full block of 254 bytes has no zero after it.
+		// The next block is only started if there is more data.
+		if code == 0xFF {
+			frame[codeIdx] = code
+			codeIdx = len(frame)
+			frame = append(frame, 0)
+			code = 1
+		}
+
+		if b == 0 {
+			frame[codeIdx] = code
+			codeIdx = len(frame)
+			frame = append(frame, 0)
+			code = 1
+			continue
+		}
+
+		frame = append(frame, b)
+		code++
+	}
+	frame[codeIdx] = code
+
+	return append(frame, 0), nil
+}
+
+// cobsDecode will decode a COBS packet without the
+// zero byte at the end.
+func cobsDecode(p []byte) ([]byte, error) {
+	packet := make([]byte, 0, len(p))
+
+	for i := 0; i < len(p); {
+		code := int(p[i])
+		if i+code > len(p) {
+			return nil, errors.New("COBS code 0x" + strconv.FormatInt(int64(code), 16) + " past the end of the packet")
+		}
+
+		packet = append(packet, p[i+1:i+code]...)
+		i += code
+
+		// A zero is between blocks unless the block is full
+		if code < 0xFF && i < len(p) {
+			packet = append(packet, 0)
+		}
+	}
+
+	return packet, nil
+}
+
+// lengthFramer decodes and encodes packets
+// with a 1 or 2 byte length prefix.
+type lengthFramer struct {
+	size        int    // Size of the length prefix, 1 or 2
+	isBigEndian bool   // Byte order of a 2 byte length prefix
+	buf         []byte // Partial packet
+}
+
+// feed will add the data and return the complete packets.
+func (lf *lengthFramer) feed(p []byte) ([][]byte, []error) {
+	lf.buf = append(lf.buf, p...)
+
+	var packets [][]byte
+	for len(lf.buf) >= lf.size {
+		n := lf.length()
+		if len(lf.buf) < lf.size+n {
+			break
+		}
+
+		packet := make([]byte, n)
+		copy(packet, lf.buf[lf.size:lf.size+n])
+		packets = append(packets, packet)
+		lf.buf = lf.buf[lf.size+n:]
+	}
+
+	if len(lf.buf) == 0 {
+		lf.buf = nil
+	}
+	return packets, nil
+}
+
+// length will get the packet length from the prefix.
+func (lf *lengthFramer) length() int {
+	if lf.size == 1 {
+		return int(lf.buf[0])
+	}
+	if lf.isBigEndian {
+		return int(lf.buf[0])<<8 | int(lf.buf[1])
+	}
+	return int(lf.buf[1])<<8 | int(lf.buf[0])
+}
+
+// flush will drop the partial packet and report it.
+// This lets the framer find the next packet after
+// a byte was lost.
+func (lf *lengthFramer) flush() ([]byte, error) {
+	if len(lf.buf) == 0 {
+		return nil, nil
+	}
+	n := len(lf.buf)
+	lf.buf = nil
+	return nil, errors.New("Incomplete length-prefixed packet, dropped " + strconv.Itoa(n) + " bytes")
+}
+
+// encode will add the length prefix to the data.
+// Data too long for the prefix is refused.
+func (lf *lengthFramer) encode(p []byte) ([]byte, error) {
+	max := 0xFF
+	if lf.size == 2 {
+		max = 0xFFFF
+	}
+	if len(p) > max {
+		return nil, errors.New("Packet of " + strconv.Itoa(len(p)) + " bytes is larger than the max of " + strconv.Itoa(max))
+	}
+
+	frame := make([]byte, 0, lf.size+len(p))
+	switch {
+	case lf.size == 1:
+		frame = append(frame, byte(len(p)))
+	case lf.isBigEndian:
+		frame = append(frame, byte(len(p)>>8), byte(len(p)))
+	default:
+		frame = append(frame, byte(len(p)), byte(len(p)>>8))
+	}
+	return append(frame, p...), nil
+}
@@ -0,0 +1,219 @@
+///
+/// Tests of the SLIP, COBS and length-prefixed framing.
+///
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// seq will get the bytes from first to last.
+func seq(first int, last int) []byte {
+	p := make([]byte, 0, last-first+1)
+	for b := first; b <= last; b++ {
+		p = append(p, byte(b))
+	}
+	return p
+}
+
+// join will join the byte slices.
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// feedAll will feed each chunk to the framer and
+// return all the records and errors.
+func feedAll(pf portFramer, chunks ...[]byte) ([][]byte, []error) {
+	var records [][]byte
+	var errs []error
+	for _, chunk := range chunks {
+		r, e := pf.feed(chunk)
+		records = append(records, r...)
+		errs = append(errs, e...)
+	}
+	return records, errs
+}
+
+// checkRecords will check the records are the ones wanted.
+func checkRecords(t *testing.T, got [][]byte, want [][]byte) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d records % x, want %d % x", len(got), got, len(want), want)
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("record %d is % x, want % x", i, got[i], want[i])
+		}
+	}
+}
+
+// TestSLIPEncode will check the END and ESC bytes are escaped.
+func TestSLIPEncode(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want []byte
+	}{
+		{[]byte{}, []byte{0xC0, 0xC0}},
+		{[]byte{0x01, 0x02}, []byte{0xC0, 0x01, 0x02, 0xC0}},
+		{[]byte{0xC0}, []byte{0xC0, 0xDB, 0xDC, 0xC0}},
+		{[]byte{0xDB}, []byte{0xC0, 0xDB, 0xDD, 0xC0}},
+		{[]byte{0x01, 0xC0, 0xDB, 0x02}, []byte{0xC0, 0x01, 0xDB, 0xDC, 0xDB, 0xDD, 0x02, 0xC0}},
+		{[]byte{0xDB, 0xDC}, []byte{0xC0, 0xDB, 0xDD, 0xDC, 0xC0}},
+	}
+	for _, tt := range tests {
+		got, err := (&slipFramer{}).encode(tt.data)
+		if err != nil || !bytes.Equal(got, tt.want) {
+			t.Errorf("encode(% x) = % x, %v, want % x", tt.data, got, err, tt.want)
+		}
+	}
+}
+
+// TestSLIPFeed will check the packets are decoded when
+// split across reads, and bad packets are reported.
+func TestSLIPFeed(t *testing.T) {
+	tests := []struct {
+		name    string
+		chunks  [][]byte
+		want    [][]byte
+		errs    int
+		partial bool
+	}{
+		{"one packet", [][]byte{{0xC0, 0x01, 0x02, 0xC0}}, [][]byte{{0x01, 0x02}}, 0, false},
+		{"no leading END", [][]byte{{0x01, 0x02, 0xC0}}, [][]byte{{0x01, 0x02}}, 0, false},
+		{"escapes", [][]byte{{0xC0, 0xDB, 0xDC, 0xDB, 0xDD, 0xC0}}, [][]byte{{0xC0, 0xDB}}, 0, false},
+		{"escape split across reads", [][]byte{{0xC0, 0x01, 0xDB}, {0xDC, 0x02, 0xC0}}, [][]byte{{0x01, 0xC0, 0x02}}, 0, false},
+		{"empty packets skipped", [][]byte{{0xC0, 0xC0, 0xC0, 0x05, 0xC0, 0xC0}}, [][]byte{{0x05}}, 0, false},
+		{"two packets", [][]byte{{0x01, 0xC0, 0x02, 0xC0}}, [][]byte{{0x01}, {0x02}}, 0, false},
+		{"bad escape", [][]byte{{0xC0, 0x01, 0xDB, 0x03, 0x04, 0xC0, 0x05, 0xC0}}, [][]byte{{0x05}}, 1, false},
+		{"ESC then END", [][]byte{{0x01, 0xDB, 0xC0, 0x02, 0xC0}}, [][]byte{{0x01}, {0x02}}, 0, false},
+		{"partial", [][]byte{{0xC0, 0x01, 0x02}}, nil, 0, true},
+		{"partial escape", [][]byte{{0xC0, 0xDB}}, nil, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sf := &slipFramer{}
+			got, errs := feedAll(sf, tt.chunks...)
+			checkRecords(t, got, tt.want)
+			if len(errs) != tt.errs {
+				t.Errorf("got %d errors %v, want %d", len(errs), errs, tt.errs)
+			}
+			if _, err := sf.flush(); (err != nil) != tt.partial {
+				t.Errorf("flush error %v, want partial %v", err, tt.partial)
+			}
+		})
+	}
+}
+
+// TestCOBS will check the encoding against the known
+// vectors and that they decode back to the data.
+func TestCOBS(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want []byte
+	}{
+		{"empty", []byte{}, []byte{0x01, 0x00}},
+		{"zero", []byte{0x00}, []byte{0x01, 0x01, 0x00}},
+		{"two zeros", []byte{0x00, 0x00}, []byte{0x01, 0x01, 0x01, 0x00}},
+		{"zero between", []byte{0x00, 0x11, 0x00}, []byte{0x01, 0x02, 0x11, 0x01, 0x00}},
+		{"zero inside", []byte{0x11, 0x22, 0x00, 0x33}, []byte{0x03, 0x11, 0x22, 0x02, 0x33, 0x00}},
+		{"no zero", []byte{0x11, 0x22, 0x33, 0x44}, []byte{0x05, 0x11, 0x22, 0x33, 0x44, 0x00}},
+		{"trailing zeros", []byte{0x11, 0x00, 0x00, 0x00}, []byte{0x02, 0x11, 0x01, 0x01, 0x01, 0x00}},
+		{"254 bytes", seq(0x01, 0xFE), join([]byte{0xFF}, seq(0x01, 0xFE), []byte{0x00})},
+		{"zero then 254 bytes", join([]byte{0x00}, seq(0x01, 0xFE)), join([]byte{0x01, 0xFF}, seq(0x01, 0xFE), []byte{0x00})},
+		{"255 bytes", seq(0x01, 0xFF), join([]byte{0xFF}, seq(0x01, 0xFE), []byte{0x02, 0xFF, 0x00})},
+		{"254 bytes then zero", join(seq(0x02, 0xFF), []byte{0x00}), join([]byte{0xFF}, seq(0x02, 0xFF), []byte{0x01, 0x01, 0x00})},
+		{"253 bytes then zero", join(seq(0x03, 0xFF), []byte{0x00, 0x01}), join([]byte{0xFE}, seq(0x03, 0xFF), []byte{0x02, 0x01, 0x00})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := (&cobsFramer{}).encode(tt.data)
+			if err != nil || !bytes.Equal(got, tt.want) {
+				t.Fatalf("encode = % x, %v, want % x", got, err, tt.want)
+			}
+
+			// Decode it split across two reads
+			packets, errs := feedAll(&cobsFramer{}, tt.want[:len(tt.want)/2], tt.want[len(tt.want)/2:])
+			if len(errs) != 0 {
+				t.Fatalf("decode errors %v", errs)
+			}
+			checkRecords(t, packets, [][]byte{tt.data})
+		})
+	}
+}
+
+// TestCOBSBadPacket will check a code past the end of
+// the packet is an error, and the next packet is decoded.
+func TestCOBSBadPacket(t *testing.T) {
+	cf := &cobsFramer{}
+	packets, errs := cf.feed([]byte{0x05, 0x11, 0x22, 0x00, 0x02, 0x33, 0x00})
+	checkRecords(t, packets, [][]byte{{0x33}})
+	if len(errs) != 1 {
+		t.Errorf("got %d errors, want 1", len(errs))
+	}
+
+	cf.feed([]byte{0x03, 0x11})
+	if _, err := cf.flush(); err == nil {
+		t.Error("flush of a partial packet gave no error")
+	}
+}
+
+// TestLengthFramer will check the 1 and 2 byte length prefixes
+// in both byte orders, split across reads.
+func TestLengthFramer(t *testing.T) {
+	long := bytes.Repeat([]byte{0x5A}, 0x0102)
+	tests := []struct {
+		name        string
+		size        int
+		isBigEndian bool
+		data        []byte
+		frame       []byte
+	}{
+		{"len8", 1, false, []byte{0x01, 0x02, 0x03}, []byte{0x03, 0x01, 0x02, 0x03}},
+		{"len8 empty", 1, false, []byte{}, []byte{0x00}},
+		{"len16", 2, true, long, join([]byte{0x01, 0x02}, long)},
+		{"len16le", 2, false, long, join([]byte{0x02, 0x01}, long)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lf := &lengthFramer{size: tt.size, isBigEndian: tt.isBigEndian}
+			frame, err := lf.encode(tt.data)
+			if err != nil || !bytes.Equal(frame, tt.frame) {
+				t.Fatalf("encode = % x, %v, want % x", frame, err, tt.frame)
+			}
+
+			// Two packets, split inside the prefix of the second
+			stream := join(tt.frame, tt.frame)
+			cut := len(tt.frame) + 1
+			packets, _ := feedAll(lf, stream[:cut], stream[cut:])
+			checkRecords(t, packets, [][]byte{tt.data, tt.data})
+			if _, err := lf.flush(); err != nil {
+				t.Errorf("flush = %v, want no partial packet", err)
+			}
+		})
+	}
+}
+
+// TestLengthFramerErrors will check data too long for the prefix
+// is refused and a partial packet is dropped by the flush.
+func TestLengthFramerErrors(t *testing.T) {
+	if _, err := (&lengthFramer{size: 1}).encode(make([]byte, 256)); err == nil {
+		t.Error("256 bytes with a 1 byte prefix gave no error")
+	}
+	if _, err := (&lengthFramer{size: 2, isBigEndian: true}).encode(make([]byte, 0x10000)); err == nil {
+		t.Error("65536 bytes with a 2 byte prefix gave no error")
+	}
+
+	lf := &lengthFramer{size: 1}
+	packets, _ := lf.feed([]byte{0x05, 0x01, 0x02})
+	checkRecords(t, packets, nil)
+	if _, err := lf.flush(); err == nil {
+		t.Error("flush of a partial packet gave no error")
+	}
+
+	// The framer starts again after the flush
+	packets, _ = lf.feed([]byte{0x01, 0x07})
+	checkRecords(t, packets, [][]byte{{0x07}})
+}
@@ -0,0 +1,128 @@
+///
+/// Decoders that turn the data read from a
+/// serial port into structured events.
+///
+
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// Publish the events and the data read.
+	decoderOn = "on"
+
+	// Publish only the events, not the data read.
+	decoderOnly = "only"
+
+	// Remove the decoder.
+	decoderOff = "off"
+)
+
+// eventDecoder decodes the data read from a
+// serial port into structured events.
+type eventDecoder interface {
+	// decode will add the data read from the port
+	// and return the events found.
+	decode(p []byte) []*PortEvent
+}
+
+// newDecoders are the decoders that can be added to a
+// serial port by name.
+var newDecoders = map[string]func() eventDecoder{
+	"nmea": func() eventDecoder { return &nmeaDecoder{} },
+	"adcp": func() eventDecoder { return &adcpDecoder{} },
+}
+
+// PortEvent is a structured event decoded from
+// the data read from a serial port.
+type PortEvent struct {
+	Cmd       string      // Kind of event, eg. NMEA
+	P         string      // the port, i.e. com22
+	Type      string      // Type of the event, eg. GGA
+	Data      interface{} // Decoded data
+	Unchecked bool        // The data had no checksum, so it could not be checked
+	Epoch     uint64      // Epoch of the port, set each time it is opened
+	Seq       uint64      // Sequence number of the message on the port in the epoch
+	Ts        time.Time   // Time the event was decoded
+}
+
+// stamp will set the epoch, sequence number and time of the event.
+func (m *PortEvent) stamp(epoch uint64, seq uint64, ts time.Time) {
+	m.Epoch = epoch
+	m.Seq = seq
+	m.Ts = ts
+}
+
+// runDecoders will give the data read from the serial port
+// to the decoders and publish the events.  It returns true if
+// the data read must not be published.
+// The events are published after the decoder lock is released.
+// The publish waits for the echo hub, which takes the lock to
+// set a decoder.
+// This must only be called from the port reader.
+func (spio *serialPortIO) runDecoders(p []byte) bool {
+	spio.decoderMu.Lock()
+	var events []*PortEvent
+	for _, d := range spio.decoders {
+		events = append(events, d.decode(p)...)
+	}
+	isDecodeOnly := len(spio.decoders) > 0 && spio.isDecodeOnly
+	spio.decoderMu.Unlock()
+
+	for _, event := range events {
+		event.P = spio.portConf.Name
+		if err := spio.publish(event, ""); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return isDecodeOnly
+}
+
+// setDecoder will add or remove a decoder on the serial port.
+// With ONLY, the events are published but the data read is not.
+// Cmd: DECODER COM6 [NMEA|ADCP] [ON|OFF|ONLY]
+func setDecoder(cmd string) {
+	cmds := strings.Fields(cmd)
+	if len(cmds) != 4 {
+		log.Println("Could not parse decoder command: " + cmd)
+		return
+	}
+
+	// Get the port name
+	portname := cmds[1]
+	spio, isFound := findPortByName(portname)
+	if !isFound {
+		log.Println("Could not find the serial port " + portname + " to set the decoder.")
+		return
+	}
+
+	name := strings.ToLower(cmds[2])
+	newDecoder, isFound := newDecoders[name]
+	if !isFound {
+		log.Println("Unknown decoder: " + name)
+		return
+	}
+
+	spio.decoderMu.Lock()
+	defer spio.decoderMu.Unlock()
+
+	switch strings.ToLower(cmds[3]) {
+	case decoderOn, decoderOnly:
+		if _, isSet := spio.decoders[name]; !isSet {
+			spio.decoders[name] = newDecoder()
+		}
+		spio.isDecodeOnly = strings.ToLower(cmds[3]) == decoderOnly
+	case decoderOff:
+		delete(spio.decoders, name)
+	default:
+		log.Println("Unknown decoder mode: " + cmds[3])
+		return
+	}
+
+	log.Println("Decoder " + name + " " + cmds[3] + " on " + spio.portConf.Name)
+}
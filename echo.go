@@ -1,9 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // echoHub Connections and broadcast to
@@ -13,9 +15,25 @@ import (
 type echoHub struct {
 	websocketConn   map[*websocketConn]bool // Registered connections.
 	wsBroadcast     chan []byte             // Websocket broadcast.  This is messages from serial port to websocket.
-	serialBroadcast chan []byte             // Serial port broadcast.  This is messages from websocket to serial port.
+	serialBroadcast chan wsCommand          // Serial port broadcast.  This is messages from websocket to serial port.
 	register        chan *websocketConn     // Register requests from the connections.
 	unregister      chan *websocketConn     // Unregister requests from connections.
+	reply           chan wsReply            // Responses to send to a single connection.
+	closeAll        chan closeRequest       // Requests to close all the connections.
+}
+
+// closeRequest asks the echo hub to close all
+// the websockets when the server shuts down.
+type closeRequest struct {
+	reason string                // Sent to the clients in the close frame
+	closed chan []*websocketConn // The websockets that were closed
+}
+
+// wsReply is a response to a command to send
+// to the websocket that sent the command.
+type wsReply struct {
+	c *websocketConn // Websocket that sent the command
+	d []byte         // Response
 }
 
 // echo initializes the values.
@@ -24,9 +42,11 @@ type echoHub struct {
 // buffer from the websockets.
 var echo = echoHub{
 	wsBroadcast:     make(chan []byte, 1000),       // Broadcast data to the websocket
-	serialBroadcast: make(chan []byte, 1000),       // Broadcast data to the serial port
+	serialBroadcast: make(chan wsCommand, 1000),    // Broadcast data to the serial port
 	register:        make(chan *websocketConn),     // Register a websocket connections
 	unregister:      make(chan *websocketConn),     // Unregister a websocket connection
+	reply:           make(chan wsReply, 1000),      // Responses to a websocket connection
+	closeAll:        make(chan closeRequest),       // Close all the websocket connections
 	websocketConn:   make(map[*websocketConn]bool), // Websocket connection map
 }
 
@@ -63,15 +83,26 @@ func (echo *echoHub) run() {
 			echo.websocketConn[c] = true
 			// send supported commands
 			c.send <- []byte("{\"Version\" : \"" + version + "\"} ")
-			c.send <- []byte("{\"Commands\" : [\"list\", \"open [portName] [baud]\", \"send [portName] [cmd]\",  \"close [portName]\", \"baudrates\", \"restart\", \"exit\", \"hostname\", \"version\"]} ")
+			c.send <- []byte("{\"Commands\" : [\"list\", \"open [portName] [baud]\", \"send [portName] [cmd]\", \"send:[none|cr|lf|crlf] [portName] [cmd]\", \"lineending [portName] [none|cr|lf|crlf]\", \"break [portName] [ms]\", \"onopen [portName] [script|json|off]\", \"onopen list\",  \"close [portName]\", \"framing [portName] [raw|line|fixed|slip|cobs|len8|len16|len16le] [delim|size] [timeout]\", \"decoder [portName] [nmea|adcp] [on|off|only]\", \"transaction [json]\", \"modbus [json]\", \"transfer begin [json]\", \"transfer chunk [id] [base64]\", \"transfer [end|cancel] [id]\", \"receive [json]\", \"script [upload|run] [json]\", \"script stop [id]\", \"script list\", \"test run [json]\", \"test stop [id]\", \"hooks [list|reload]\", \"adcpconfig [json]\", \"history [portName]\", \"resume [portName] [epoch] [seq]\", \"hello [name]\", \"clients\", \"policy [disconnect|drop-oldest|coalesce]\", \"baudrates\", \"restart\", \"exit\", \"hostname\", \"version\"]} ")
 
 			// Send the serial port list
 			serialPortList()
 
+			// Send the history of the open serial ports
+			for _, spio := range serialHub.openPorts() {
+				sendHistory(c, spio)
+			}
+
+			// Let everyone know the client joined
+			echo.broadcastClientEvent("Join", c)
+
 			log.Println("Registering websocket")
 
 		// Unregister websocket
 		case c := <-echo.unregister:
+			// Drop the chunks of the files the client was uploading
+			dropUploads(c)
+
 			if _, ok := echo.websocketConn[c]; ok {
 
 				log.Println("UnRegistering websocket")
@@ -80,51 +111,232 @@ func (echo *echoHub) run() {
 				close(c.send)
 				// Unregister the websocket from the map
 				delete(echo.websocketConn, c)
+
+				// Let everyone know the client left
+				echo.broadcastClientEvent("Leave", c)
 			}
 
 		// Data received from websocket
 		case m := <-echo.serialBroadcast:
-			log.Print("Got a serial broadcast " + string(m))
-			if len(m) > 0 {
+			log.Print("Got a serial broadcast " + string(m.d))
+			if len(m.d) > 0 {
 				// Check the command given
-				checkCmd(m)
+				checkCmd(m.c, m.d)
 			}
 
+		// Response to a command from a websocket
+		case r := <-echo.reply:
+			echo.sendTo(r.c, r.d)
+
 		// Data received from the serial port
 		case m := <-echo.wsBroadcast:
 			//log.Print("Got a websocket broadcast" + string(m))
+			echo.broadcast(m)
 
-			for c := range echo.websocketConn {
-				select {
-				case c.send <- m: // Send the data from broadcast to all websocket connections
-				default:
-					log.Print("Close websocket send")
-					close(c.send)
-					delete(echo.websocketConn, c)
-				}
-			}
+		// Close all the websockets
+		case req := <-echo.closeAll:
+			req.closed <- echo.closeConns(req.reason)
 
 		}
 		//log.Print("Echo Hub loop")
 	}
 }
 
+// broadcast will send the message to all the websocket connections.
+// If a websocket cannot keep up, its backpressure policy is used.
+// This must only be called from the echo hub.
+func (echo *echoHub) broadcast(m []byte) {
+	var dropped []*websocketConn
+	for c := range echo.websocketConn {
+		// Send the data from broadcast to all websocket connections
+		if !c.deliver(m) {
+			log.Print("Close websocket send")
+			close(c.send)
+			delete(echo.websocketConn, c)
+			dropped = append(dropped, c)
+		}
+	}
+
+	// Let everyone left know the slow clients were dropped
+	for _, c := range dropped {
+		echo.broadcastClientEvent("Leave", c)
+	}
+}
+
+// sendTo will send the message to a single websocket connection.
+// The message is dropped if the websocket is no longer registered.
+// This must only be called from the echo hub.
+func (echo *echoHub) sendTo(c *websocketConn, m []byte) {
+	if _, ok := echo.websocketConn[c]; !ok {
+		return
+	}
+
+	if !c.deliver(m) {
+		log.Print("Close websocket send")
+		close(c.send)
+		delete(echo.websocketConn, c)
+
+		// Let everyone know the slow client was dropped
+		echo.broadcastClientEvent("Leave", c)
+	}
+}
+
+// closeConns will send the messages waiting in the hub, then
+// close the send channel of all the websockets.  Each writer
+// sends what is left in its channel, then a close frame with
+// the reason.  This must only be called from the echo hub.
+func (echo *echoHub) closeConns(reason string) []*websocketConn {
+	for isPending := true; isPending; {
+		select {
+		case m := <-echo.wsBroadcast:
+			echo.broadcast(m)
+		case r := <-echo.reply:
+			echo.sendTo(r.c, r.d)
+		default:
+			isPending = false
+		}
+	}
+
+	closed := make([]*websocketConn, 0, len(echo.websocketConn))
+	for c := range echo.websocketConn {
+		c.closeReason = reason
+		close(c.send)
+		delete(echo.websocketConn, c)
+		closed = append(closed, c)
+	}
+	return closed
+}
+
+// closeClients will close all the websockets with the reason.
+// It waits until the deadline for the clients to be sent the
+// messages left, then closes the connections that are not done.
+func (echo *echoHub) closeClients(reason string, deadline time.Time) {
+	req := closeRequest{reason: reason, closed: make(chan []*websocketConn, 1)}
+	echo.closeAll <- req
+
+	for _, c := range <-req.closed {
+		select {
+		case <-c.writerDone:
+		case <-time.After(time.Until(deadline)):
+			log.Println("Websocket client " + c.remoteAddr + " did not finish in time")
+			c.ws.Close()
+		}
+	}
+}
+
+// replyTo will send the response as JSON to the websocket that
+// sent the command.  If the websocket is closed, the response is
+// dropped.  Many commands reply from the echo hub, which is the only
+// reader of the replies, so the response is also dropped if the
+// replies are full instead of waiting.
+func replyTo(c *websocketConn, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	select {
+	case echo.reply <- wsReply{c: c, d: b}:
+	default:
+		log.Println("Reply is full, response to " + c.identity() + " dropped")
+	}
+}
+
+// broadcastClientEvent will let all the websocket
+// connections know a client joined, left or changed its name.
+// This must only be called from the echo hub.
+func (echo *echoHub) broadcastClientEvent(cmd string, c *websocketConn) {
+	b, err := json.Marshal(ClientEvent{Cmd: cmd, Client: c.info()})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	echo.broadcast(b)
+}
+
+// clientList will send the presence list of
+// all the websocket connections to the client.
+func (echo *echoHub) clientList(c *websocketConn) {
+	list := ClientList{Clients: make([]ClientInfo, 0, len(echo.websocketConn))}
+	for conn := range echo.websocketConn {
+		list.Clients = append(list.Clients, conn.info())
+	}
+
+	b, err := json.Marshal(list)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	echo.sendTo(c, b)
+}
+
 // checkCmd will check which command was sent.
 // It will then run the command based off the command given.
-func checkCmd(cmd []byte) {
+// The websocket connection is the client that sent the command.
+func checkCmd(c *websocketConn, cmd []byte) {
 	log.Print("Inside checkCmd")
 	s := string(cmd[:])
 	log.Print(s)
 
 	sl := strings.ToLower(s)
 
-	if strings.HasPrefix(sl, "open") {
+	// Let the Lua hooks handle the command
+	if runCommandHooks(c.identity(), s) {
+		log.Print("Command handled by a Lua hook")
+		return
+	}
+
+	if strings.HasPrefix(sl, "baudrates") || strings.HasPrefix(sl, "hostname") || strings.HasPrefix(sl, "version") ||
+		strings.HasPrefix(sl, "restart") || strings.HasPrefix(sl, "exit") {
+		serverCmd(c, s)
+	} else if strings.HasPrefix(sl, "hello") {
+		// Set the client name and let everyone know
+		if c.setName(s) {
+			echo.broadcastClientEvent("Hello", c)
+		}
+	} else if strings.HasPrefix(sl, "clients") {
+		echo.clientList(c)
+	} else if strings.HasPrefix(sl, "policy") {
+		c.setPolicy(s)
+	} else if strings.HasPrefix(sl, "framing") {
+		setFraming(s)
+	} else if strings.HasPrefix(sl, "decoder") {
+		setDecoder(s)
+	} else if strings.HasPrefix(sl, "adcpconfig") {
+		adcpConfigCmd(c, s)
+	} else if strings.HasPrefix(sl, "transaction") {
+		transactionCmd(c, s)
+	} else if strings.HasPrefix(sl, "hooks") {
+		hooksCmd(c, s)
+	} else if strings.HasPrefix(sl, "receive") {
+		receiveCmd(c, s)
+	} else if strings.HasPrefix(sl, "transfer") {
+		transferCmd(c, s)
+	} else if strings.HasPrefix(sl, "test") {
+		testCmd(c, s)
+	} else if strings.HasPrefix(sl, "script") {
+		scriptCmd(c, s)
+	} else if strings.HasPrefix(sl, "modbus") {
+		modbusCmd(c, s)
+	} else if strings.HasPrefix(sl, "history") {
+		portHistory(c, s)
+	} else if strings.HasPrefix(sl, "resume") {
+		resumePort(c, s)
+	} else if strings.HasPrefix(sl, "open") {
 		openPort(s)
 	} else if strings.HasPrefix(sl, "close") {
 		closePort(s)
+	} else if strings.HasPrefix(sl, "lineending") {
+		setLineEnding(c, s)
+	} else if strings.HasPrefix(sl, "onopen") {
+		onOpenCmd(c, s)
+	} else if strings.HasPrefix(sl, "break") {
+		// Send a BREAK to the serial port
+		spBreak(s, c)
 	} else if strings.HasPrefix(sl, "send") {
 		// Write the data to the serial port
-		spWrite(s)
+		spWrite(s, c)
 	} else if strings.HasPrefix(sl, "list") {
 		serialPortList()
 	} else {
@@ -0,0 +1,392 @@
+///
+/// Framing of the data read from a serial port
+/// into records, eg. complete lines.
+///
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Forward the data as it is read.
+	framingRaw = "raw"
+
+	// Split the data into lines.
+	framingLine = "line"
+
+	// Split the data into fixed length records.
+	framingFixed = "fixed"
+
+	// Default time to wait for the rest of a line.
+	defaultLineTimeout = 500 * time.Millisecond
+)
+
+// portFramer splits the data read from a serial port into records.
+type portFramer interface {
+	// feed will add the data read from the port and
+	// return the complete records.  Malformed records
+	// are returned as errors.
+	feed(p []byte) ([][]byte, []error)
+
+	// flush will return the partial record
+	// held by the framer, or nil if there is none.
+	// A framer that cannot send a partial record
+	// drops it and returns an error.
+	flush() ([]byte, error)
+}
+
+// FramingMessage is broadcast when the
+// framing of a serial port is changed.
+type FramingMessage struct {
+	Cmd     string        // Framing
+	P       string        // the port, i.e. com22
+	Mode    string        // raw, line, fixed, slip, cobs, len8, len16 or len16le
+	Delim   string        // Line delimiter
+	Size    int           // Fixed record size
+	Timeout time.Duration // Time to wait for the rest of a record before it is sent
+}
+
+// FrameErrorMessage is broadcast when a malformed
+// record is read from a serial port.
+type FrameErrorMessage struct {
+	Cmd string    // FrameError
+	P   string    // the port, i.e. com22
+	Err string    // What was wrong with the record
+	Ts  time.Time // Time the error was found
+}
+
+// lineFramer splits the data into lines.  The
+// delimiter is kept at the end of each line.
+type lineFramer struct {
+	delim []byte // Line delimiter, eg. \r\n
+	buf   []byte // Partial line
+}
+
+// feed will add the data and return the complete lines.
+func (lf *lineFramer) feed(p []byte) ([][]byte, []error) {
+	lf.buf = append(lf.buf, p...)
+
+	var lines [][]byte
+	for {
+		i := bytes.Index(lf.buf, lf.delim)
+		if i < 0 {
+			break
+		}
+
+		end := i + len(lf.delim)
+		line := make([]byte, end)
+		copy(line, lf.buf[:end])
+		lines = append(lines, line)
+		lf.buf = lf.buf[end:]
+	}
+
+	if len(lf.buf) == 0 {
+		lf.buf = nil
+	}
+	return lines, nil
+}
+
+// flush will return the partial line.
+func (lf *lineFramer) flush() ([]byte, error) {
+	if len(lf.buf) == 0 {
+		return nil, nil
+	}
+	line := lf.buf
+	lf.buf = nil
+	return line, nil
+}
+
+// fixedFramer splits the data into fixed length records.
+type fixedFramer struct {
+	size int    // Record size
+	buf  []byte // Partial record
+}
+
+// feed will add the data and return the complete records.
+func (ff *fixedFramer) feed(p []byte) ([][]byte, []error) {
+	ff.buf = append(ff.buf, p...)
+
+	var records [][]byte
+	for len(ff.buf) >= ff.size {
+		record := make([]byte, ff.size)
+		copy(record, ff.buf[:ff.size])
+		records = append(records, record)
+		ff.buf = ff.buf[ff.size:]
+	}
+
+	if len(ff.buf) == 0 {
+		ff.buf = nil
+	}
+	return records, nil
+}
+
+// flush will return the partial record.
+func (ff *fixedFramer) flush() ([]byte, error) {
+	if len(ff.buf) == 0 {
+		return nil, nil
+	}
+	record := ff.buf
+	ff.buf = nil
+	return record, nil
+}
+
+// frameReader publishes each record from the framer as
+// its own message.  A partial record is published after
+// the timeout if no more data is read.
+type frameReader struct {
+	spio     *serialPortIO // Serial port the records are published on
+	framer   portFramer    // Splits the data into records
+	encoder  frameEncoder  // Wraps the data written to the port.  Nil to write the data as is.
+	isBinary bool          // Publish the records base64 encoded
+	timeout  time.Duration // Time to wait for the rest of a record.  0 to wait forever.
+
+	mu    sync.Mutex  // Protects the framer, the reader and the timer both use it
+	timer *time.Timer // Flushes the partial record after the timeout
+}
+
+// write will add the data read from the serial port and
+// publish the complete records.
+func (fr *frameReader) write(p []byte) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	records, errs := fr.framer.feed(p)
+	for _, record := range records {
+		fr.spio.publishRecord(record, fr.isBinary)
+	}
+	for _, err := range errs {
+		fr.spio.publishFrameError(err)
+	}
+
+	// Restart the timer for the partial record
+	if fr.timer != nil {
+		fr.timer.Stop()
+		fr.timer = nil
+	}
+	if fr.timeout > 0 {
+		fr.timer = time.AfterFunc(fr.timeout, fr.flush)
+	}
+}
+
+// flush will publish the partial record.
+func (fr *frameReader) flush() {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	if fr.timer != nil {
+		fr.timer.Stop()
+		fr.timer = nil
+	}
+
+	record, err := fr.framer.flush()
+	if record != nil {
+		fr.spio.publishRecord(record, fr.isBinary)
+	}
+	if err != nil {
+		fr.spio.publishFrameError(err)
+	}
+}
+
+// publishRecord will publish a record read from the serial port.
+// A binary record is base64 encoded so it is not changed by the JSON.
+func (spio *serialPortIO) publishRecord(p []byte, isBinary bool) {
+	if !isBinary {
+		spio.publishData(p)
+		return
+	}
+
+	data := base64.StdEncoding.EncodeToString(p)
+	m := &SpPortMessage{P: spio.portConf.Name, D: data, Enc: "base64"}
+	if err := spio.publish(m, data); err != nil {
+		log.Println(err)
+	}
+}
+
+// publishFrameError will let all the websocket clients
+// know a malformed record was read from the serial port.
+func (spio *serialPortIO) publishFrameError(frameErr error) {
+	log.Println("Frame error on " + spio.portConf.Name + ". " + frameErr.Error())
+
+	b, err := json.Marshal(FrameErrorMessage{Cmd: "FrameError", P: spio.portConf.Name, Err: frameErr.Error(), Ts: time.Now()})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	echo.wsBroadcast <- b
+}
+
+// publishData will publish the data read from the serial port.
+func (spio *serialPortIO) publishData(p []byte) {
+	data := string(p)
+
+	// Create a JSON message of the data
+	// and broadcast it
+	m := &SpPortMessage{P: spio.portConf.Name, D: data}
+	if err := spio.publish(m, data); err != nil {
+		log.Println(err)
+		echo.wsBroadcast <- []byte("Error creating json on " + spio.portConf.Name + " " +
+			err.Error() + " The data we were trying to convert is: " + data)
+	}
+}
+
+// getFrameReader will get the frame reader of the serial port.
+// It returns nil if the port is in raw mode.
+func (spio *serialPortIO) getFrameReader() *frameReader {
+	spio.frameMu.Lock()
+	defer spio.frameMu.Unlock()
+	return spio.frameReader
+}
+
+// setFrameReader will set the frame reader of the serial port.
+// Any partial record in the previous frame reader is published.
+// This is called from the echo hub, so the flush runs on its own
+// goroutine.  It may wait for the port reader to publish, and the
+// publish waits for the echo hub.
+func (spio *serialPortIO) setFrameReader(fr *frameReader) {
+	spio.frameMu.Lock()
+	old := spio.frameReader
+	spio.frameReader = fr
+	spio.frameMu.Unlock()
+
+	if old != nil {
+		go old.flush()
+	}
+}
+
+// parseDelimiter will get the line delimiter.  The
+// delimiter can be given by name, cr, lf or crlf, or
+// with escapes, eg. \r\n.
+func parseDelimiter(s string) string {
+	switch strings.ToLower(s) {
+	case "cr":
+		return "\r"
+	case "lf":
+		return "\n"
+	case "crlf":
+		return "\r\n"
+	}
+
+	r := strings.NewReplacer("\\r", "\r", "\\n", "\n", "\\t", "\t")
+	return r.Replace(s)
+}
+
+// setFraming will set how the data read from the serial port
+// is split into messages.
+// Cmd: FRAMING COM6 RAW
+// Cmd: FRAMING COM6 LINE [delimiter] [timeout]
+// Cmd: FRAMING COM6 FIXED [size] [timeout]
+// Cmd: FRAMING COM6 [SLIP|COBS|LEN8|LEN16|LEN16LE] [timeout]
+// The delimiter is cr, lf, crlf or an escaped string, eg. \r\n.
+// The timeout is how long to wait for the rest of a record, eg. 500ms.
+// The binary framings also wrap the data written to the port
+// and publish the records base64 encoded.
+func setFraming(cmd string) {
+	cmds := strings.Fields(cmd)
+	if len(cmds) < 3 {
+		log.Println("Could not parse framing command: " + cmd)
+		return
+	}
+
+	// Get the port name
+	portname := cmds[1]
+	spio, isFound := findPortByName(portname)
+	if !isFound {
+		log.Println("Could not find the serial port " + portname + " to set the framing.")
+		return
+	}
+
+	config := FramingMessage{Cmd: "Framing", P: spio.portConf.Name, Mode: strings.ToLower(cmds[2])}
+	fr := &frameReader{spio: spio}
+
+	// Position of the timeout in the command
+	timeoutIdx := 4
+
+	switch config.Mode {
+	case framingRaw:
+		spio.setFrameReader(nil)
+		broadcastFraming(config)
+		return
+
+	case framingLine:
+		config.Delim = "\n"
+		config.Timeout = defaultLineTimeout
+		if len(cmds) > 3 {
+			config.Delim = parseDelimiter(cmds[3])
+		}
+		if len(config.Delim) == 0 {
+			log.Println("Line delimiter cannot be empty")
+			return
+		}
+		fr.framer = &lineFramer{delim: []byte(config.Delim)}
+
+	case framingFixed:
+		if len(cmds) < 4 {
+			log.Println("Could not parse framing command, no record size: " + cmd)
+			return
+		}
+		size, err := strconv.Atoi(cmds[3])
+		if err != nil || size <= 0 {
+			log.Println("Record size given is bad: " + cmds[3])
+			return
+		}
+		config.Size = size
+		fr.framer = &fixedFramer{size: size}
+
+	case framingSLIP:
+		sf := &slipFramer{}
+		fr.framer, fr.encoder = sf, sf
+		timeoutIdx = 3
+
+	case framingCOBS:
+		cf := &cobsFramer{}
+		fr.framer, fr.encoder = cf, cf
+		timeoutIdx = 3
+
+	case framingLen8, framingLen16, framingLen16LE:
+		lf := &lengthFramer{size: 2, isBigEndian: config.Mode == framingLen16}
+		if config.Mode == framingLen8 {
+			lf.size = 1
+		}
+		fr.framer, fr.encoder = lf, lf
+		timeoutIdx = 3
+
+	default:
+		log.Println("Unknown framing mode: " + config.Mode)
+		return
+	}
+
+	// Get the timeout
+	if len(cmds) > timeoutIdx {
+		timeout, err := time.ParseDuration(cmds[timeoutIdx])
+		if err != nil {
+			log.Println("Framing timeout given is bad", err)
+			return
+		}
+		config.Timeout = timeout
+	}
+
+	fr.timeout = config.Timeout
+	fr.isBinary = fr.encoder != nil
+	spio.setFrameReader(fr)
+	broadcastFraming(config)
+}
+
+// broadcastFraming will let all the websocket clients
+// know the framing of the serial port changed.
+func broadcastFraming(config FramingMessage) {
+	b, err := json.Marshal(config)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	echo.broadcast(b)
+}
@@ -0,0 +1,108 @@
+///
+/// Tests of the line and fixed length framing.
+///
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestLineFramer will check the lines are split on the
+// delimiter, even when it is split across reads.
+func TestLineFramer(t *testing.T) {
+	tests := []struct {
+		name    string
+		delim   string
+		chunks  []string
+		want    []string
+		partial string
+	}{
+		{"one line", "\r\n", []string{"abc\r\n"}, []string{"abc\r\n"}, ""},
+		{"two lines", "\n", []string{"a\nb\n"}, []string{"a\n", "b\n"}, ""},
+		{"split line", "\r\n", []string{"ab", "c\r\nd"}, []string{"abc\r\n"}, "d"},
+		{"split delimiter", "\r\n", []string{"abc\r", "\ndef\r"}, []string{"abc\r\n"}, "def\r"},
+		{"only delimiter", "\r", []string{"\r\r"}, []string{"\r", "\r"}, ""},
+		{"no delimiter", "\n", []string{"abc", "def"}, nil, "abcdef"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lf := &lineFramer{delim: []byte(tt.delim)}
+			var chunks [][]byte
+			for _, c := range tt.chunks {
+				chunks = append(chunks, []byte(c))
+			}
+			var want [][]byte
+			for _, w := range tt.want {
+				want = append(want, []byte(w))
+			}
+
+			got, errs := feedAll(lf, chunks...)
+			checkRecords(t, got, want)
+			if len(errs) != 0 {
+				t.Errorf("errors %v", errs)
+			}
+			if partial, _ := lf.flush(); string(partial) != tt.partial {
+				t.Errorf("flush = %q, want %q", partial, tt.partial)
+			}
+		})
+	}
+}
+
+// TestLineFramerCopies will check the lines returned do
+// not change when more data is fed to the framer.
+func TestLineFramerCopies(t *testing.T) {
+	lf := &lineFramer{delim: []byte("\n")}
+	lines, _ := lf.feed([]byte("abc\nxy"))
+	lf.feed([]byte("zzzzzzzz\n"))
+	if !bytes.Equal(lines[0], []byte("abc\n")) {
+		t.Errorf("line changed to %q", lines[0])
+	}
+}
+
+// TestFixedFramer will check the records are the fixed size.
+func TestFixedFramer(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		chunks  [][]byte
+		want    [][]byte
+		partial []byte
+	}{
+		{"exact", 2, [][]byte{{1, 2, 3, 4}}, [][]byte{{1, 2}, {3, 4}}, nil},
+		{"split", 3, [][]byte{{1}, {2, 3, 4}, {5}}, [][]byte{{1, 2, 3}}, []byte{4, 5}},
+		{"short", 4, [][]byte{{1, 2}}, nil, []byte{1, 2}},
+		{"size one", 1, [][]byte{{7, 8}}, [][]byte{{7}, {8}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ff := &fixedFramer{size: tt.size}
+			got, _ := feedAll(ff, tt.chunks...)
+			checkRecords(t, got, tt.want)
+			if partial, _ := ff.flush(); !bytes.Equal(partial, tt.partial) {
+				t.Errorf("flush = % x, want % x", partial, tt.partial)
+			}
+		})
+	}
+}
+
+// TestParseDelimiter will check the named and escaped delimiters.
+func TestParseDelimiter(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"cr", "\r"},
+		{"LF", "\n"},
+		{"crlf", "\r\n"},
+		{`\r\n`, "\r\n"},
+		{`\t`, "\t"},
+		{";", ";"},
+	}
+	for _, tt := range tests {
+		if got := parseDelimiter(tt.s); got != tt.want {
+			t.Errorf("parseDelimiter(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+///
+/// Scrollback history of the serial ports
+/// replayed to new websocket clients.
+///
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// historyBuffer keeps the recent inbound and outbound
+// messages of a serial port.  The oldest messages are
+// removed when the buffer holds more than the max bytes
+// or max lines.
+type historyBuffer struct {
+	mu       sync.Mutex     // Protects the entries, the port reader and hub both add messages
+	entries  []historyEntry // Messages in the order they were added
+	bytes    int            // Total data bytes in the buffer
+	lines    int            // Total lines in the buffer
+	maxBytes int            // Max data bytes to keep.  0 to keep no history.
+	maxLines int            // Max lines to keep.  0 for no line limit.
+}
+
+// historyEntry is a single message kept in the history.
+type historyEntry struct {
+	msg   []byte // JSON message as broadcast to the websockets
+	seq   uint64 // Sequence number of the message
+	bytes int    // Size of the data in the message
+	lines int    // Number of lines in the data in the message
+}
+
+// stampedMessage is a message published on a serial port.
+// It is stamped with the epoch of the port, the sequence
+// number and time before it is kept in the history and broadcast.
+type stampedMessage interface {
+	stamp(epoch uint64, seq uint64, ts time.Time)
+}
+
+// GapMessage is sent to a websocket client when
+// messages it asked for are no longer in the history.
+type GapMessage struct {
+	Cmd      string // Gap
+	P        string // the port, i.e. com22
+	Epoch    uint64 // Epoch of the sequence numbers
+	From     uint64 // First sequence number missing
+	To       uint64 // Last sequence number missing
+	Reopened bool   // The port was opened again since the epoch the client gave, so all its messages after the seq are lost
+}
+
+// newEpoch will get the epoch of a serial port that is opened.
+// The sequence numbers start again at 1 each time a port is
+// opened, so the epoch tells them apart.
+func newEpoch() uint64 {
+	return uint64(time.Now().UnixNano())
+}
+
+// HistoryMessage is sent to a websocket client with
+// the history of a serial port.
+type HistoryMessage struct {
+	Cmd      string            // History
+	P        string            // the port, i.e. com22
+	Messages []json.RawMessage // Messages oldest first
+}
+
+// newHistoryBuffer will create the history buffer
+// with the given limits.
+func newHistoryBuffer(maxBytes int, maxLines int) *historyBuffer {
+	return &historyBuffer{maxBytes: maxBytes, maxLines: maxLines}
+}
+
+// add will add the message to the history.  The data is
+// the data in the message used to check the limits.  If
+// the message has no data, eg. a decoded event, the size
+// of the message is used.
+func (h *historyBuffer) add(msg []byte, seq uint64, data string) {
+	if h.maxBytes <= 0 {
+		return
+	}
+
+	size := len(data)
+	if size == 0 {
+		size = len(msg)
+	}
+
+	// A message always counts as at least one line
+	lines := strings.Count(data, "\n")
+	if lines == 0 {
+		lines = 1
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.entries = append(h.entries, historyEntry{msg: msg, seq: seq, bytes: size, lines: lines})
+	h.bytes += size
+	h.lines += lines
+
+	// Remove the oldest messages until the buffer is within the limits
+	for len(h.entries) > 0 && (h.bytes > h.maxBytes || (h.maxLines > 0 && h.lines > h.maxLines)) {
+		h.bytes -= h.entries[0].bytes
+		h.lines -= h.entries[0].lines
+		h.entries[0] = historyEntry{}
+		h.entries = h.entries[1:]
+	}
+}
+
+// messages will get a copy of all the messages in the history.
+func (h *historyBuffer) messages() []json.RawMessage {
+	msgs, _ := h.since(0)
+	return msgs
+}
+
+// since will get a copy of the messages in the history
+// after the given sequence number.  It also returns the
+// sequence number of the oldest message in the history,
+// or 0 if the history is empty.
+func (h *historyBuffer) since(seq uint64) ([]json.RawMessage, uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.entries) == 0 {
+		return nil, 0
+	}
+
+	msgs := make([]json.RawMessage, 0, len(h.entries))
+	for _, e := range h.entries {
+		if e.seq > seq {
+			msgs = append(msgs, e.msg)
+		}
+	}
+	return msgs, h.entries[0].seq
+}
+
+// publish will stamp the message with the next sequence number
+// and the time, keep it in the history and broadcast it.
+// The data is the data in the message used for the history limits.
+func (spio *serialPortIO) publish(m stampedMessage, data string) error {
+	// Hold the lock until the message is broadcast so the
+	// messages are in sequence order in the history and broadcast
+	spio.pubMu.Lock()
+	defer spio.pubMu.Unlock()
+
+	m.stamp(spio.epoch, spio.seq+1, time.Now())
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	seq := atomic.AddUint64(&spio.seq, 1)
+	spio.history.add(b, seq, data)
+	echo.wsBroadcast <- b
+	return nil
+}
+
+// lastSeq will get the sequence number of the last message published.
+// This does not take the publish lock, so the echo hub is not
+// blocked while a message is waiting to be broadcast.
+func (spio *serialPortIO) lastSeq() uint64 {
+	return atomic.LoadUint64(&spio.seq)
+}
+
+// sendHistory will send the history of the serial port
+// to the websocket client.  Nothing is sent if the
+// history is empty.
+// This must only be called from the echo hub.
+func sendHistory(c *websocketConn, spio *serialPortIO) {
+	msgs := spio.history.messages()
+	if len(msgs) == 0 {
+		return
+	}
+
+	b, err := json.Marshal(HistoryMessage{Cmd: "History", P: spio.portConf.Name, Messages: msgs})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	echo.sendTo(c, b)
+}
+
+// portHistory will send the history of the serial port to the client.
+// Cmd: HISTORY COM6
+func portHistory(c *websocketConn, cmd string) {
+	// Split the command in to the 2 parameters
+	cmds := strings.SplitN(strings.TrimSpace(cmd), " ", 2)
+	if len(cmds) != 2 {
+		log.Println("Could not parse history command: " + cmd)
+		return
+	}
+
+	// Get the port name
+	portname := strings.TrimSpace(cmds[1])
+
+	spio, isFound := findPortByName(portname)
+	if !isFound {
+		log.Println("Could not find the serial port " + portname + " to get the history.")
+		return
+	}
+
+	sendHistory(c, spio)
+}
+
+// resumePort will send the messages of the serial port after
+// the given epoch and sequence number to the client.  This lets a
+// client that reconnects get the messages it missed.  If some of the
+// messages are no longer in the history, a Gap message is sent first.
+// If the port was opened again since the epoch, a Gap covering all
+// the messages is sent, then all the history of the new epoch.
+// Cmd: RESUME COM6 1712345678901234567 1234
+func resumePort(c *websocketConn, cmd string) {
+	// Split the command in to the 4 parameters
+	cmds := strings.Fields(cmd)
+	if len(cmds) != 4 {
+		log.Println("Could not parse resume command: " + cmd)
+		return
+	}
+
+	// Get the port name
+	portname := cmds[1]
+
+	epoch, err := strconv.ParseUint(cmds[2], 10, 64)
+	if err != nil {
+		log.Println("Epoch given is bad", err)
+		return
+	}
+
+	seq, err := strconv.ParseUint(cmds[3], 10, 64)
+	if err != nil {
+		log.Println("Sequence number given is bad", err)
+		return
+	}
+
+	spio, isFound := findPortByName(portname)
+	if !isFound {
+		log.Println("Could not find the serial port " + portname + " to resume.")
+		return
+	}
+
+	// Get the last sequence number first so a message
+	// published now is not reported as a gap
+	last := spio.lastSeq()
+
+	// The messages after seq in the old epoch are lost, so
+	// send the whole history of the new epoch
+	isReopened := epoch != spio.epoch
+	if isReopened {
+		seq = 0
+	}
+	msgs, oldest := spio.history.since(seq)
+
+	// Check for messages missing from the history
+	gapTo := last
+	if oldest > 0 {
+		gapTo = oldest - 1
+	}
+	if gapTo > seq || isReopened {
+		b, err := json.Marshal(GapMessage{Cmd: "Gap", P: spio.portConf.Name, Epoch: spio.epoch, From: seq + 1, To: gapTo, Reopened: isReopened})
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		echo.sendTo(c, b)
+	}
+
+	if len(msgs) == 0 {
+		return
+	}
+
+	b, err := json.Marshal(HistoryMessage{Cmd: "History", P: spio.portConf.Name, Messages: msgs})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	echo.sendTo(c, b)
+}
@@ -0,0 +1,573 @@
+///
+/// Lua scripts with hooks on the serial port
+/// events and the websocket commands.
+///
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"path/filepath"
+	"runtime/metrics"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	// Max depth of the Lua call stack.
+	luaCallStackSize = 200
+
+	// Starting size of the Lua value stack.  It grows up to -lua-registry.
+	luaRegistrySize = 1024
+
+	// Largest string made by string.rep.
+	luaMaxRepSize = 1024 * 1024
+
+	// Deepest Lua table converted to JSON by emit.
+	luaMaxEmitDepth = 16
+
+	// How often the memory allocated by a running hook is checked.
+	luaMemoryCheckPeriod = time.Millisecond
+
+	// Writes to the serial ports queued by a script.
+	luaWriteQueueSize = 256
+)
+
+// Hook function names in the scripts.
+const (
+	hookData    = "onData"
+	hookOpen    = "onOpen"
+	hookClose   = "onClose"
+	hookCommand = "onCommand"
+)
+
+// errHookTimeout is returned when a hook runs longer
+// than the Lua timeout.  The script is disabled.
+var errHookTimeout = errors.New("Hook ran longer than the Lua timeout")
+
+// errHookMemory is returned when a hook allocates more than
+// the Lua memory limit, or the script keeps more than it.
+// The script is disabled.
+var errHookMemory = errors.New("Hook used more than the Lua memory limit")
+
+// HookEvent is a custom event sent by a script
+// to all the clients.
+type HookEvent struct {
+	Cmd    string      // Hook
+	Script string      // Name of the script
+	Event  string      // Name given by the script
+	Data   interface{} // Data given by the script
+	Ts     time.Time
+}
+
+// HookError is sent to all the clients when a hook fails.
+type HookError struct {
+	Cmd      string // HookError
+	Script   string // Name of the script
+	Hook     string // Hook that failed, eg. onData
+	Error    string
+	Disabled bool // The script went over its limits and no longer runs
+}
+
+// luaScript is a Lua script loaded from the
+// Lua directory.  Each script has its own state.
+type luaScript struct {
+	name       string
+	mu         sync.Mutex // Lua states cannot be used by more than one goroutine
+	state      *lua.LState
+	isDisabled bool              // Set when the script goes over its limits
+	writes     chan writeRequest // Writes to the serial ports, sent in order.  Closed with the state.
+}
+
+var (
+	// Scripts loaded from the Lua directory
+	luaScripts   []*luaScript
+	luaScriptsMu sync.RWMutex
+)
+
+// loadHooks will load all the scripts in the Lua directory.
+// The scripts already loaded are closed.
+func loadHooks() {
+	var loaded []*luaScript
+
+	if *luaDir != "" {
+		files, err := filepath.Glob(filepath.Join(*luaDir, "*.lua"))
+		if err != nil {
+			log.Println(err)
+		}
+		sort.Strings(files)
+
+		for _, f := range files {
+			ls, err := newLuaScript(f)
+			if err != nil {
+				log.Println("Could not load the Lua script " + f + ". " + err.Error())
+				continue
+			}
+			log.Println("Lua script " + ls.name + " loaded")
+			loaded = append(loaded, ls)
+		}
+	}
+
+	luaScriptsMu.Lock()
+	old := luaScripts
+	luaScripts = loaded
+	luaScriptsMu.Unlock()
+
+	for _, ls := range old {
+		ls.mu.Lock()
+		ls.close()
+		ls.isDisabled = true
+		ls.mu.Unlock()
+	}
+}
+
+// newLuaScript will run the script file in a new sandboxed state.
+// Only the base, table, string and math libraries are opened and
+// the functions that load files are removed.
+func newLuaScript(file string) (*luaScript, error) {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   luaCallStackSize,
+		RegistrySize:    luaRegistrySize,
+		RegistryMaxSize: *luaRegistry,
+	})
+
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "module", "require"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	ls := &luaScript{
+		name:   strings.TrimSuffix(filepath.Base(file), ".lua"),
+		state:  L,
+		writes: make(chan writeRequest, luaWriteQueueSize),
+	}
+	go ls.sendWrites()
+
+	if str, ok := L.GetGlobal("string").(*lua.LTable); ok {
+		L.SetField(str, "rep", L.NewFunction(luaRep))
+	}
+	L.SetGlobal("write", L.NewFunction(ls.luaWrite))
+	L.SetGlobal("emit", L.NewFunction(ls.luaEmit))
+	L.SetGlobal("log", L.NewFunction(ls.luaLog))
+
+	// The top level of the script runs with the same limits as a hook
+	err := ls.limit(func() error {
+		return L.DoFile(file)
+	})
+	if err != nil {
+		ls.close()
+		return nil, err
+	}
+
+	return ls, nil
+}
+
+// close will close the Lua state and stop the writes.
+// The script lock must be held, or the script not used yet.
+func (ls *luaScript) close() {
+	ls.state.Close()
+	close(ls.writes)
+}
+
+// sendWrites will send the writes of the script to the serial
+// hub in the order they were made.  It stops when the script
+// is closed.
+func (ls *luaScript) sendWrites() {
+	for wr := range ls.writes {
+		serialHub.write <- wr
+	}
+}
+
+// limit will run the Lua code and stop it if it runs longer
+// than the Lua timeout or allocates more than the Lua memory
+// limit.  The state checks the context before each instruction,
+// so the code is stopped by cancelling it.  When the code ends,
+// the memory kept by the script is checked against the limit.
+// The call and value stacks are limited by the state, and going
+// over them is an error like any other.
+func (ls *luaScript) limit(f func() error) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if *luaTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), *luaTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+
+	var isOverMemory int32
+	if *luaMemory > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go watchAllocs(done, cancel, &isOverMemory)
+	}
+
+	ls.state.SetContext(ctx)
+	defer ls.state.RemoveContext()
+
+	err := f()
+	switch {
+	case atomic.LoadInt32(&isOverMemory) != 0:
+		return errHookMemory
+	case ctx.Err() == context.DeadlineExceeded:
+		return errHookTimeout
+	case *luaMemory > 0 && luaStateSize(ls.state, *luaMemory) > *luaMemory:
+		return errHookMemory
+	}
+	return err
+}
+
+// heapAllocs will get the bytes allocated by the process so far.
+// Unlike runtime.ReadMemStats, this does not stop the world.
+func heapAllocs() int64 {
+	sample := []metrics.Sample{{Name: "/gc/heap/allocs:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return int64(sample[0].Value.Uint64())
+}
+
+// watchAllocs will cancel the running hook if more than the
+// Lua memory limit is allocated before done is closed.  The
+// bytes allocated by the whole process are counted, so the
+// limit is an upper bound on what the hook allocates.
+func watchAllocs(done chan struct{}, cancel context.CancelFunc, isOverMemory *int32) {
+	start := heapAllocs()
+	ticker := time.NewTicker(luaMemoryCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if heapAllocs()-start > *luaMemory {
+				atomic.StoreInt32(isOverMemory, 1)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// luaStateSize will estimate the bytes kept by the Lua state.
+// The globals, the tables and functions reachable from them
+// and their strings are counted.  It stops counting when the
+// size is over max.
+func luaStateSize(L *lua.LState, max int64) int64 {
+	var size int64
+	seen := map[lua.LValue]bool{}
+	values := []lua.LValue{L.G.Global}
+	for len(values) > 0 && size <= max {
+		lv := values[len(values)-1]
+		values = values[:len(values)-1]
+
+		switch v := lv.(type) {
+		case lua.LString:
+			size += int64(len(v)) + 16
+		case *lua.LTable:
+			if seen[v] {
+				continue
+			}
+			seen[v] = true
+			size += 64
+			v.ForEach(func(k lua.LValue, value lua.LValue) {
+				size += 32
+				values = append(values, k, value)
+			})
+			if v.Metatable != nil {
+				values = append(values, v.Metatable)
+			}
+		case *lua.LFunction:
+			if seen[v] {
+				continue
+			}
+			seen[v] = true
+			size += 64
+			for _, uv := range v.Upvalues {
+				values = append(values, uv.Value())
+			}
+		}
+	}
+	return size
+}
+
+// call will call the hook in the script if it is defined.
+// It returns the value returned by the hook, or nil.
+func (ls *luaScript) call(hook string, args ...lua.LValue) (lua.LValue, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if ls.isDisabled {
+		return nil, nil
+	}
+
+	fn, ok := ls.state.GetGlobal(hook).(*lua.LFunction)
+	if !ok {
+		return nil, nil
+	}
+
+	var ret lua.LValue
+	err := ls.limit(func() error {
+		if err := ls.state.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, args...); err != nil {
+			return err
+		}
+		ret = ls.state.Get(-1)
+		ls.state.Pop(1)
+		return nil
+	})
+
+	if err != nil {
+		// Leave the stack as it was before the call
+		ls.state.SetTop(0)
+
+		hookErr := HookError{Cmd: "HookError", Script: ls.name, Hook: hook, Error: err.Error()}
+		if err == errHookTimeout || err == errHookMemory {
+			ls.isDisabled = true
+			hookErr.Disabled = true
+		}
+		log.Println("Lua script " + ls.name + " " + hook + " failed. " + err.Error())
+		broadcastHook(hookErr)
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// hooks will get the scripts loaded.
+func hooks() []*luaScript {
+	luaScriptsMu.RLock()
+	defer luaScriptsMu.RUnlock()
+	return luaScripts
+}
+
+// runDataHooks will give the data read from the serial port
+// to the onData hooks.  A hook can return a string to replace
+// the data, or false to drop it.  It returns the data to publish.
+// This must only be called from the port reader.
+func runDataHooks(portName string, p []byte) []byte {
+	for _, ls := range hooks() {
+		ret, err := ls.call(hookData, lua.LString(portName), lua.LString(p))
+		if err != nil || ret == nil {
+			continue
+		}
+
+		switch v := ret.(type) {
+		case lua.LString:
+			p = []byte(v)
+		case lua.LBool:
+			if !bool(v) {
+				return nil
+			}
+		}
+	}
+	return p
+}
+
+// runPortHooks will call the onOpen or onClose hooks.
+func runPortHooks(hook string, portName string) {
+	for _, ls := range hooks() {
+		ls.call(hook, lua.LString(portName))
+	}
+}
+
+// runCommandHooks will give the websocket command to the
+// onCommand hooks.  It returns true if a hook returned true
+// to handle the command itself.
+func runCommandHooks(from string, cmd string) bool {
+	for _, ls := range hooks() {
+		ret, err := ls.call(hookCommand, lua.LString(from), lua.LString(cmd))
+		if err == nil && ret != nil && lua.LVAsBool(ret) {
+			return true
+		}
+	}
+	return false
+}
+
+// luaWrite will write the data to the serial port.
+// The data is sent as is, without a line ending.  The writes
+// are queued and sent in order.  It returns false if the
+// port is not open or the queue is full.
+// Lua: write(port, data)
+func (ls *luaScript) luaWrite(L *lua.LState) int {
+	portName := L.CheckString(1)
+	data := L.CheckString(2)
+
+	spio, isFound := findPortByName(portName)
+	if !isFound {
+		L.Push(lua.LFalse)
+		return 1
+	}
+
+	// Do not block the hook waiting for the write
+	select {
+	case ls.writes <- writeRequest{p: spio, d: data, from: "lua:" + ls.name}:
+		L.Push(lua.LTrue)
+	default:
+		log.Println("Lua " + ls.name + ": write queue is full, write to " + portName + " dropped")
+		L.Push(lua.LFalse)
+	}
+	return 1
+}
+
+// luaEmit will send a custom event to all the clients.
+// Lua: emit(name, data)
+func (ls *luaScript) luaEmit(L *lua.LState) int {
+	broadcastHook(HookEvent{
+		Cmd:    "Hook",
+		Script: ls.name,
+		Event:  L.CheckString(1),
+		Data:   luaToGo(L.Get(2), 0),
+		Ts:     time.Now(),
+	})
+	return 0
+}
+
+// luaLog will write the message to the log.
+// Lua: log(message)
+func (ls *luaScript) luaLog(L *lua.LState) int {
+	log.Println("Lua " + ls.name + ": " + L.CheckString(1))
+	return 0
+}
+
+// luaRep replaces string.rep so a script cannot
+// make a very large string in one call.
+func luaRep(L *lua.LState) int {
+	s := L.CheckString(1)
+	n := L.CheckInt(2)
+	if n <= 0 || len(s) == 0 {
+		L.Push(lua.LString(""))
+		return 1
+	}
+	if n > luaMaxRepSize/len(s) {
+		L.RaiseError("string.rep result is larger than %d bytes", luaMaxRepSize)
+		return 0
+	}
+	L.Push(lua.LString(strings.Repeat(s, n)))
+	return 1
+}
+
+// luaToGo will convert the Lua value so it can be sent as JSON.
+// A table with only array items is a list, otherwise an object.
+func luaToGo(lv lua.LValue, depth int) interface{} {
+	switch v := lv.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LNumber:
+		return float64(v)
+	case lua.LString:
+		return string(v)
+	case *lua.LTable:
+		if depth >= luaMaxEmitDepth {
+			return nil
+		}
+
+		n := v.MaxN()
+		isList := n > 0
+		v.ForEach(func(k lua.LValue, _ lua.LValue) {
+			if _, ok := k.(lua.LNumber); !ok {
+				isList = false
+			}
+		})
+
+		if isList {
+			list := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				list = append(list, luaToGo(v.RawGetInt(i), depth+1))
+			}
+			return list
+		}
+
+		m := map[string]interface{}{}
+		v.ForEach(func(k lua.LValue, value lua.LValue) {
+			m[k.String()] = luaToGo(value, depth+1)
+		})
+		return m
+	}
+	return nil
+}
+
+// broadcastHook will send the hook event to all the clients.
+// The event is dropped if the hub is busy, so a hook called
+// from the hub cannot block it.
+func broadcastHook(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	select {
+	case echo.wsBroadcast <- b:
+	default:
+		log.Println("Websocket broadcast is full, hook event dropped")
+	}
+}
+
+// hooksCmd will list or reload the Lua scripts.
+// Cmd: HOOKS LIST
+// Cmd: HOOKS RELOAD
+func hooksCmd(c *websocketConn, cmd string) {
+	cmds := strings.Fields(cmd)
+	if len(cmds) != 2 {
+		log.Println("Could not parse hooks command: " + cmd)
+		return
+	}
+
+	switch strings.ToLower(cmds[1]) {
+	case "reload":
+		// Do not block the hub while the scripts run
+		go func() {
+			loadHooks()
+			replyTo(c, hookList())
+		}()
+	case "list":
+		replyTo(c, hookList())
+	default:
+		log.Println("Unknown hooks command: " + cmd)
+	}
+}
+
+// HookList is the list of Lua scripts sent to a client.
+type HookList struct {
+	Cmd      string   // Hooks
+	Scripts  []string // Scripts loaded
+	Disabled []string // Scripts that went over their limits
+}
+
+// hookList will get the list of the Lua scripts.
+func hookList() HookList {
+	list := HookList{Cmd: "Hooks", Scripts: []string{}, Disabled: []string{}}
+	for _, ls := range hooks() {
+		ls.mu.Lock()
+		if ls.isDisabled {
+			list.Disabled = append(list.Disabled, ls.name)
+		} else {
+			list.Scripts = append(list.Scripts, ls.name)
+		}
+		ls.mu.Unlock()
+	}
+	return list
+}
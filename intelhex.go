@@ -0,0 +1,155 @@
+///
+/// Intel HEX firmware images.
+///
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Intel HEX record types.
+const (
+	hexData            = 0x00 // Data at the address
+	hexEndOfFile       = 0x01 // Last record in the file
+	hexExtendedSegment = 0x02 // Bits 4-19 of the address of the next records
+	hexStartSegment    = 0x03 // CS:IP start address
+	hexExtendedLinear  = 0x04 // Upper 16 bits of the address of the next records
+	hexStartLinear     = 0x05 // 32 bit start address
+)
+
+const (
+	// Most memory segments in an image.
+	maxHexImageSegments = 1024
+)
+
+// memorySegment is a block of data at an address in the device memory.
+type memorySegment struct {
+	address uint32
+	data    []byte
+}
+
+// firmwareImage is the data to write to the device memory.
+type firmwareImage struct {
+	segments []memorySegment // Sorted by address and not overlapping
+	start    uint32          // Start address from the image, eg. the Reset_Handler.  0 if not given.  Not used to start an STM32.
+}
+
+// size will get the number of bytes in the image.
+func (img *firmwareImage) size() int {
+	n := 0
+	for _, seg := range img.segments {
+		n += len(seg.data)
+	}
+	return n
+}
+
+// parseIntelHex will parse the Intel HEX file into the memory
+// segments.  Records at following addresses are joined into one
+// segment.  The checksum of each record is checked.
+func parseIntelHex(p []byte) (*firmwareImage, error) {
+	img := &firmwareImage{}
+	var base uint32
+	isEnd := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(p))
+	for lineNum := 1; scanner.Scan() && !isEnd; lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		where := "Line " + strconv.Itoa(lineNum) + " of the HEX file"
+		if line[0] != ':' {
+			return nil, errors.New(where + " does not start with a colon")
+		}
+		rec, err := hex.DecodeString(line[1:])
+		if err != nil || len(rec) < 5 || len(rec) != int(rec[0])+5 {
+			return nil, errors.New(where + " is not a HEX record")
+		}
+
+		var sum byte
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0 {
+			return nil, errors.New(where + " has a bad checksum")
+		}
+
+		data := rec[4 : len(rec)-1]
+		offset := uint32(rec[1])<<8 | uint32(rec[2])
+		switch rec[3] {
+		case hexData:
+			if err := img.add(base+offset, data); err != nil {
+				return nil, errors.New(where + ". " + err.Error())
+			}
+		case hexEndOfFile:
+			isEnd = true
+		case hexExtendedSegment:
+			if len(data) != 2 {
+				return nil, errors.New(where + " has a bad segment address")
+			}
+			base = (uint32(data[0])<<8 | uint32(data[1])) << 4
+		case hexExtendedLinear:
+			if len(data) != 2 {
+				return nil, errors.New(where + " has a bad linear address")
+			}
+			base = (uint32(data[0])<<8 | uint32(data[1])) << 16
+		case hexStartSegment:
+			if len(data) != 4 {
+				return nil, errors.New(where + " has a bad start address")
+			}
+			cs := uint32(data[0])<<8 | uint32(data[1])
+			ip := uint32(data[2])<<8 | uint32(data[3])
+			img.start = cs<<4 + ip
+		case hexStartLinear:
+			if len(data) != 4 {
+				return nil, errors.New(where + " has a bad start address")
+			}
+			img.start = uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+		default:
+			return nil, errors.New(where + " has an unknown record type " + strconv.Itoa(int(rec[3])))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !isEnd {
+		return nil, errors.New("HEX file has no end of file record")
+	}
+	if len(img.segments) == 0 {
+		return nil, errors.New("HEX file has no data")
+	}
+
+	sort.Slice(img.segments, func(i, j int) bool { return img.segments[i].address < img.segments[j].address })
+	for i := 1; i < len(img.segments); i++ {
+		prev := img.segments[i-1]
+		if prev.address+uint32(len(prev.data)) > img.segments[i].address {
+			return nil, errors.New("HEX file writes to 0x" + strconv.FormatUint(uint64(img.segments[i].address), 16) + " more than once")
+		}
+	}
+	return img, nil
+}
+
+// add will add the data at the address.  It is joined to
+// the segment it follows, otherwise a new segment is started.
+func (img *firmwareImage) add(address uint32, data []byte) error {
+	if n := len(img.segments); n > 0 {
+		last := &img.segments[n-1]
+		if last.address+uint32(len(last.data)) == address {
+			last.data = append(last.data, data...)
+			return nil
+		}
+	}
+	if len(img.segments) >= maxHexImageSegments {
+		return errors.New("Too many memory segments")
+	}
+	img.segments = append(img.segments, memorySegment{address: address, data: append([]byte(nil), data...)})
+	return nil
+}
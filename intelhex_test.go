@@ -0,0 +1,120 @@
+///
+/// Tests of the Intel HEX parsing and the STM32 blocks.
+///
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// hexFile will join the records into a HEX file.
+func hexFile(records ...string) []byte {
+	return []byte(strings.Join(records, "\r\n") + "\r\n")
+}
+
+// TestParseIntelHex will check the records are joined into
+// segments at the base address, and the start address is read.
+func TestParseIntelHex(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     []byte
+		segments []memorySegment
+		start    uint32
+	}{
+		{"joined", hexFile(":0400000001020304F2", ":020004000506EF", ":00000001FF"),
+			[]memorySegment{{0, []byte{1, 2, 3, 4, 5, 6}}}, 0},
+		{"linear address", hexFile(":020000040800F2", ":0400000001020304F2", ":01010000AA54", ":0400000508000121CD", ":00000001FF"),
+			[]memorySegment{{0x08000000, []byte{1, 2, 3, 4}}, {0x08000100, []byte{0xAA}}}, 0x08000121},
+		{"segment address", hexFile(":020000021000EC", ":0100100007E8", ":00000001FF"),
+			[]memorySegment{{0x10010, []byte{7}}}, 0},
+		{"sorted", hexFile(":01010000AA54", ":0400000001020304F2", ":00000001FF"),
+			[]memorySegment{{0, []byte{1, 2, 3, 4}}, {0x100, []byte{0xAA}}}, 0},
+		{"blank lines and after end", hexFile("", ":0400000001020304F2", "  ", ":00000001FF", "junk"),
+			[]memorySegment{{0, []byte{1, 2, 3, 4}}}, 0},
+		{"lower case", hexFile(":0400000001020304f2", ":00000001ff"),
+			[]memorySegment{{0, []byte{1, 2, 3, 4}}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := parseIntelHex(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(img.segments, tt.segments) || img.start != tt.start {
+				t.Errorf("image is %v start 0x%x, want %v start 0x%x", img.segments, img.start, tt.segments, tt.start)
+			}
+		})
+	}
+}
+
+// TestParseIntelHexErrors will check bad files are refused.
+func TestParseIntelHexErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file []byte
+	}{
+		{"no colon", hexFile("0400000001020304F2", ":00000001FF")},
+		{"bad checksum", hexFile(":0400000001020304F3", ":00000001FF")},
+		{"bad length", hexFile(":0500000001020304F2", ":00000001FF")},
+		{"not hex", hexFile(":04000000010203XXF2", ":00000001FF")},
+		{"no end", hexFile(":0400000001020304F2")},
+		{"no data", hexFile(":00000001FF")},
+		{"overlap", hexFile(":0400000001020304F2", ":020003000909E9", ":00000001FF")},
+		{"unknown type", hexFile(":00000006FA", ":00000001FF")},
+		{"bad linear address", hexFile(":0100000408F3", ":00000001FF")},
+	}
+	for _, tt := range tests {
+		if _, err := parseIntelHex(tt.file); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+// TestSTM32Blocks will check the blocks are word aligned,
+// padded with 0xFF, and no word is written twice.
+func TestSTM32Blocks(t *testing.T) {
+	ff := func(n int) []byte { return bytes.Repeat([]byte{0xFF}, n) }
+	data := func(n int) []byte { return bytes.Repeat([]byte{0x5A}, n) }
+
+	tests := []struct {
+		name     string
+		segments []memorySegment
+		want     []memorySegment
+	}{
+		{"aligned", []memorySegment{{0x1000, data(8)}},
+			[]memorySegment{{0x1000, data(8)}}},
+		{"padded", []memorySegment{{0x1001, []byte{1, 2}}},
+			[]memorySegment{{0x1000, []byte{0xFF, 1, 2, 0xFF}}}},
+		{"same word", []memorySegment{{0x1001, []byte{1}}, {0x1003, []byte{2}}},
+			[]memorySegment{{0x1000, []byte{0xFF, 1, 0xFF, 2}}}},
+		{"meet in a word", []memorySegment{{0x1001, []byte{1, 2}}, {0x1004, []byte{9}}, {0x1005, []byte{3}}},
+			[]memorySegment{{0x1000, []byte{0xFF, 1, 2, 0xFF, 9, 3, 0xFF, 0xFF}}}},
+		{"next word", []memorySegment{{0x1000, []byte{1, 2}}, {0x1006, []byte{3}}},
+			[]memorySegment{{0x1000, []byte{1, 2, 0xFF, 0xFF, 0xFF, 0xFF, 3, 0xFF}}}},
+		{"apart", []memorySegment{{0x1000, []byte{1}}, {0x2003, []byte{2}}},
+			[]memorySegment{{0x1000, []byte{1, 0xFF, 0xFF, 0xFF}}, {0x2000, []byte{0xFF, 0xFF, 0xFF, 2}}}},
+		{"split", []memorySegment{{0x1000, data(300)}},
+			[]memorySegment{{0x1000, data(256)}, {0x1100, data(44)}}},
+		{"split after merge", []memorySegment{{0x1002, data(254)}, {0x1100, data(2)}},
+			[]memorySegment{{0x1000, append(ff(2), data(254)...)}, {0x1100, append(data(2), ff(2)...)}}},
+		{"end of memory", []memorySegment{{0xFFFFFFFD, []byte{1, 2, 3}}},
+			[]memorySegment{{0xFFFFFFFC, []byte{0xFF, 1, 2, 3}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := stm32Blocks(&firmwareImage{segments: tt.segments})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("blocks are %v, want %v", got, tt.want)
+			}
+			for _, blk := range got {
+				if blk.address%4 != 0 || len(blk.data)%4 != 0 || len(blk.data) > stm32BlockSize {
+					t.Errorf("block at 0x%x of %d bytes is not whole words", blk.address, len(blk.data))
+				}
+			}
+		})
+	}
+}
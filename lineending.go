@@ -0,0 +1,140 @@
+///
+/// Line endings added to the commands sent to the
+/// serial ports, and the escapes in the commands.
+///
+
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// LineEnding is the line ending of a serial port sent to a client.
+type LineEnding struct {
+	Cmd    string // LineEnding
+	Port   string
+	Ending string // none, cr, lf or crlf
+	Error  string // Why the line ending could not be set
+}
+
+// Line endings by name.
+var lineEndingNames = map[string]string{
+	"none": "",
+	"cr":   "\r",
+	"lf":   "\n",
+	"crlf": "\r\n",
+}
+
+var (
+	// Line ending of each port by lower case port name.
+	// Kept when the port is closed and opened again.
+	lineEndings   = map[string]string{}
+	lineEndingsMu sync.Mutex
+)
+
+// checkLineEnding will check the name of the line ending.
+func checkLineEnding(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if _, isFound := lineEndingNames[name]; !isFound {
+		return "", errors.New("Unknown line ending " + name + ", use none, cr, lf or crlf")
+	}
+	return name, nil
+}
+
+// portLineEnding will get the name of the line ending of
+// the port.  The -line-ending flag is used if it is not set.
+func portLineEnding(portname string) string {
+	lineEndingsMu.Lock()
+	defer lineEndingsMu.Unlock()
+	if name, isFound := lineEndings[strings.ToLower(portname)]; isFound {
+		return name
+	}
+	return strings.ToLower(*lineEnding)
+}
+
+// parseEscapes will replace the escapes in the command with
+// the characters.  \0 \a \b \t \n \v \f \r \e \\ and \xHH are
+// supported.  Any other backslash is kept as is.
+func parseEscapes(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		switch s[i+1] {
+		case '0':
+			b.WriteByte(0)
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'v':
+			b.WriteByte('\v')
+		case 'f':
+			b.WriteByte('\f')
+		case 'r':
+			b.WriteByte('\r')
+		case 'e':
+			b.WriteByte(0x1B)
+		case '\\':
+			b.WriteByte('\\')
+		case 'x':
+			if i+3 < len(s) {
+				if v, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+					b.WriteByte(byte(v))
+					i += 3
+					continue
+				}
+			}
+			b.WriteString(s[i : i+2])
+		default:
+			b.WriteString(s[i : i+2])
+		}
+		i++
+	}
+	return b.String()
+}
+
+// setLineEnding will set or get the line ending added to
+// the commands sent to a port.
+// LINEENDING [portName] [none|cr|lf|crlf]
+// LINEENDING [portName]
+func setLineEnding(c *websocketConn, cmd string) {
+	args := strings.Fields(cmd)
+	if len(args) < 2 || len(args) > 3 {
+		log.Println("Could not parse lineending command: " + cmd)
+		return
+	}
+
+	resp := LineEnding{Cmd: "LineEnding", Port: args[1]}
+	if len(args) == 3 {
+		name, err := checkLineEnding(args[2])
+		if err != nil {
+			resp.Error = err.Error()
+			replyTo(c, resp)
+			return
+		}
+
+		lineEndingsMu.Lock()
+		lineEndings[strings.ToLower(args[1])] = name
+		lineEndingsMu.Unlock()
+		log.Println("Line ending of " + args[1] + " set to " + name + " by " + c.identity())
+	}
+
+	resp.Ending = portLineEnding(args[1])
+	replyTo(c, resp)
+}
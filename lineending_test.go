@@ -0,0 +1,62 @@
+///
+/// Tests of the line endings and the escapes in the commands sent.
+///
+
+package main
+
+import (
+	"testing"
+)
+
+// TestParseEscapes will check each escape, and that bad
+// escapes and a backslash at the end are kept as is.
+func TestParseEscapes(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"plain", "plain"},
+		{"", ""},
+		{`a\r\n`, "a\r\n"},
+		{`\0\a\b\t\n\v\f\r\e`, "\x00\a\b\t\n\v\f\r\x1B"},
+		{`\\`, `\`},
+		{`\\n`, `\n`},
+		{`\x41\x7e\xFF`, "A~\xFF"},
+		{`\x4`, `\x4`},
+		{`\x`, `\x`},
+		{`\xZZ`, `\xZZ`},
+		{`\x+1`, `\x+1`},
+		{`\q`, `\q`},
+		{`end\`, `end\`},
+		{`\x41B`, "AB"},
+		{`START\r`, "START\r"},
+	}
+	for _, tt := range tests {
+		if got := parseEscapes(tt.s); got != tt.want {
+			t.Errorf("parseEscapes(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+// TestCheckLineEnding will check the names of the line
+// endings are found in any case.
+func TestCheckLineEnding(t *testing.T) {
+	tests := []struct {
+		name  string
+		want  string
+		isBad bool
+	}{
+		{"none", "none", false},
+		{"cr", "cr", false},
+		{"LF", "lf", false},
+		{" CrLf ", "crlf", false},
+		{"nl", "", true},
+		{"\\r", "", true},
+	}
+	for _, tt := range tests {
+		got, err := checkLineEnding(tt.name)
+		if (err != nil) != tt.isBad || (!tt.isBad && got != tt.want) {
+			t.Errorf("checkLineEnding(%q) = %q, %v", tt.name, got, err)
+		}
+	}
+}
@@ -1,23 +1,54 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"flag"
-	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"text/template"
+	"time"
 )
 
 ///
 /// Flags to set at startup
 ///
 var (
-	version      = "0.1"
-	versionFloat = float32(0.1)
-	addr         = flag.String("addr", ":8989", "http service address")
-	port         = flag.String("port", "", "Serial COM Port")
-	baud         = flag.String("baud", "115200", "Baud Rate")
+	version          = "0.1"
+	gitCommit        = "" // Set with -ldflags "-X main.gitCommit=$(git rev-parse HEAD)"
+	versionFloat     = float32(0.1)
+	addr             = flag.String("addr", ":8989", "http service address")
+	port             = flag.String("port", "", "Serial COM Port")
+	baud             = flag.String("baud", "115200", "Baud Rate")
+	tlsCert          = flag.String("tls-cert", "", "TLS certificate file.  Serve HTTPS and WSS when given")
+	tlsKey           = flag.String("tls-key", "", "TLS private key file")
+	tlsClientCA      = flag.String("tls-client-ca", "", "CA bundle to verify client certificates.  Clients must present a certificate when given")
+	historyBytes     = flag.Int("history-bytes", 64*1024, "Bytes of serial port history replayed to new clients.  0 to disable")
+	historyLines     = flag.Int("history-lines", 1000, "Lines of serial port history replayed to new clients.  0 for no line limit")
+	batchSize        = flag.Int("batch-size", 4096, "Max bytes read from a serial port sent in one message.  0 to send each read")
+	batchLatency     = flag.Duration("batch-latency", 10*time.Millisecond, "Max time to hold serial port data to batch it.  0 to send each read")
+	slowClientPolicy = flag.String("slow-client-policy", policyDisconnect, "Default policy when a websocket client cannot keep up: disconnect, drop-oldest or coalesce")
+	origins          = flag.String("allowed-origins", "", "Comma separated list of allowed origins.  eg. https://dash.example.com,https://*.example.com.  Same origin only if not given")
+	scriptDir        = flag.String("script-dir", "", "Directory of the scripts that can be run by name.  Each script is a name.json file")
+	testDir          = flag.String("test-dir", "", "Directory of the test sequences that can be run by name.  Each sequence is a name.json file")
+	reportDir        = flag.String("report-dir", "reports", "Directory the test reports are saved in.  Empty to not save them")
+	downloadDir      = flag.String("download-dir", "downloads", "Directory the files received from the devices are saved in")
+	luaDir           = flag.String("lua-dir", "", "Directory of the Lua scripts with hooks on the serial port events.  Each *.lua file is loaded")
+	luaTimeout       = flag.Duration("lua-timeout", 100*time.Millisecond, "Max time a Lua hook can run before the script is disabled.  0 for no limit")
+	luaRegistry      = flag.Int("lua-registry", 64*1024, "Max size of the value stack of a Lua script.  A hook that overflows it fails")
+	luaMemory        = flag.Int64("lua-memory", 16*1024*1024, "Max bytes a Lua hook can allocate in one call, and a Lua script can keep, before the script is disabled.  0 for no limit")
+	breakMs          = flag.Int("break-ms", 400, "Default BREAK duration in milliseconds, up to 10000")
+	lineEnding       = flag.String("line-ending", "cr", "Default line ending added to the commands sent: none, cr, lf or crlf")
+	shutdownTimeout  = flag.Duration("shutdown-timeout", 5*time.Second, "Max time to wait for the transfers and the websocket clients to finish when the server stops")
+	admins           = flag.String("admins", "", "Comma separated client certificate names allowed to restart and exit the server")
+	adminLoopback    = flag.Bool("admin-loopback", false, "Allow the clients on the loopback address to restart and exit the server")
+	maxMessageSize   = flag.Int64("max-message-size", 64*1024, "Max size of a message from a websocket client.  Scripts, test runs and transfer chunks must fit in one message")
+	onOpen           = flag.String("on-open", "", "Comma separated scripts run when a port opens.  eg. COM6=adcp-wake,COM7=init")
 )
 
 // serialHander passes the template
@@ -28,6 +59,15 @@ func serialHandler(c http.ResponseWriter, req *http.Request) {
 	t.Execute(c, nil)
 }
 
+// writeJSON will write the value as the JSON
+// response to an HTTP request.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Error writing the JSON response. " + err.Error())
+	}
+}
+
 // main will start the application.
 func main() {
 	// Parse the flags
@@ -40,6 +80,7 @@ func main() {
 	log.Println("Port:" + *port)
 	log.Println("Baud:" + *baud)
 	log.Println("Addr: " + *addr)
+	log.Println("Allowed Origins: " + *origins)
 
 	// Convert the baud rate to int
 	baudInt, err := strconv.Atoi(*baud)
@@ -48,14 +89,71 @@ func main() {
 		return
 	}
 
+	// Check the slow client policy
+	if !isPolicy(*slowClientPolicy) {
+		log.Println("Unknown slow client policy: " + *slowClientPolicy)
+		return
+	}
+
+	// Check the line ending
+	if _, err := checkLineEnding(*lineEnding); err != nil {
+		log.Println(err)
+		return
+	}
+
+	// Check the default BREAK duration
+	if err := checkBreakMs(*breakMs); err != nil {
+		log.Println(err)
+		return
+	}
+
+	// Client certificates can only be verified over TLS
+	if len(*tlsClientCA) > 0 && len(*tlsCert) == 0 {
+		log.Println("A TLS certificate must be given with the TLS client CA")
+		return
+	}
+
+	// Load the Lua hooks
+	loadHooks()
+
+	// Set the sequences run when the ports open
+	if err := loadOnOpen(*onOpen); err != nil {
+		log.Println(err)
+		return
+	}
+
 	// Start Echo
 	go echo.init(port, baudInt)
 
+	// Set the origins allowed to use the websocket and HTTP endpoints
+	setAllowedOrigins(*origins)
+
 	// HTTP server
-	http.HandleFunc("/serial", serialHandler) // Display the websocket data
-	http.HandleFunc("/ws", wsHandler)         // wsHandler in websocketConn.go.  Creates websocket
-	if err := http.ListenAndServe(*addr, nil); err != nil {
-		fmt.Printf("Error trying to bind to port: %v, so exiting...", err)
-		log.Fatal("Error ListenAndServe:", err)
+	http.HandleFunc("/serial", corsHandler(serialHandler))           // Display the websocket data
+	http.HandleFunc("/ws", wsHandler)                                // wsHandler in websocketConn.go.  Creates websocket
+	http.HandleFunc("/transaction", corsHandler(transactionHandler)) // Send and wait for the response
+	http.HandleFunc("/modbus", corsHandler(modbusHandler))           // Modbus RTU request
+	http.HandleFunc("/adcp/config", corsHandler(adcpConfigHandler))  // ADCP configuration
+	http.HandleFunc("/transfer", corsHandler(transferHandler))       // Send a file with XMODEM or YMODEM
+	http.HandleFunc("/receive", corsHandler(receiveHandler))         // Receive files with YMODEM or ZMODEM
+	http.HandleFunc("/downloads/", corsHandler(downloadsHandler))    // List and download the files received
+	http.HandleFunc("/flash", corsHandler(flashHandler))             // Flash an STM32 with the UART bootloader
+
+	// Use TLS if a certificate is given
+	var tlsConfig *tls.Config
+	if len(*tlsCert) > 0 {
+		tlsConfig, err = newTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			log.Println("Error loading the TLS certificates. " + err.Error())
+			return
+		}
+		log.Println("TLS enabled")
 	}
+
+	// Shut down cleanly on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Serve until an admin or a signal stops the server
+	runServer(ctx, tlsConfig)
 }
@@ -0,0 +1,411 @@
+///
+/// Modbus RTU master on an open serial port.
+///
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Default time to wait for the slave to respond.
+	defaultModbusTimeout = 1000 * time.Millisecond
+
+	// Time to wait for another session on the port to finish.
+	modbusBusyWait = 5 * time.Second
+
+	// Added to the t1.5 time between the characters of a response.
+	// The serial port driver and USB adapters pass on the data
+	// in chunks, so a gap of t1.5 alone is often not a real gap.
+	modbusCharSlack = 20 * time.Millisecond
+)
+
+// Modbus function codes.
+const (
+	modbusReadCoils              = 0x01
+	modbusReadDiscreteInputs     = 0x02
+	modbusReadHoldingRegisters   = 0x03
+	modbusReadInputRegisters     = 0x04
+	modbusWriteSingleCoil        = 0x05
+	modbusWriteSingleRegister    = 0x06
+	modbusWriteMultipleCoils     = 0x0F
+	modbusWriteMultipleRegisters = 0x10
+)
+
+// modbusFunctions are the names of the function
+// codes used in the requests.
+var modbusFunctions = map[string]byte{
+	"read-coils":             modbusReadCoils,
+	"read-discrete-inputs":   modbusReadDiscreteInputs,
+	"read-holding-registers": modbusReadHoldingRegisters,
+	"read-input-registers":   modbusReadInputRegisters,
+	"write-coil":             modbusWriteSingleCoil,
+	"write-register":         modbusWriteSingleRegister,
+	"write-coils":            modbusWriteMultipleCoils,
+	"write-registers":        modbusWriteMultipleRegisters,
+}
+
+// modbusExceptions are the descriptions of
+// the exception codes.
+var modbusExceptions = map[byte]string{
+	0x01: "Illegal function",
+	0x02: "Illegal data address",
+	0x03: "Illegal data value",
+	0x04: "Slave device failure",
+	0x05: "Acknowledge",
+	0x06: "Slave device busy",
+	0x08: "Memory parity error",
+	0x0A: "Gateway path unavailable",
+	0x0B: "Gateway target device failed to respond",
+}
+
+// ModbusRequest is a Modbus request from a client.
+// Coils are given and returned as 0 or 1 in Values.
+type ModbusRequest struct {
+	ID       string   // Given by the client and returned in the response
+	Port     string   // Serial port the slave is on, i.e. COM5
+	Slave    byte     // Slave address.  0 to broadcast a write.
+	Function string   // Function name, eg. read-holding-registers
+	Address  uint16   // Starting address
+	Quantity uint16   // Number of coils or registers to read
+	Values   []uint16 // Values to write
+	Timeout  int      // Time to wait for the response in milliseconds.  0 for the default.
+}
+
+// ModbusResponse is the response to a Modbus request.
+type ModbusResponse struct {
+	Cmd           string   // Modbus
+	ID            string   // ID given in the request
+	Port          string   // Serial port the slave is on
+	Slave         byte     // Slave address
+	Function      string   // Function name
+	Address       uint16   // Starting address
+	Values        []uint16 // Values read, or written
+	Exception     byte     // Exception code from the slave.  0 if there was no exception.
+	ExceptionDesc string   // Description of the exception code
+	Error         string   // Error if the request failed
+	Ts            time.Time
+}
+
+// modbusCRC will calculate the Modbus CRC-16 of the data.
+func modbusCRC(p []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range p {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = (crc >> 1) ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// modbusFrameDelay will get the silent time between frames.
+// This is 3.5 characters at the baud rate, or 1.75 ms
+// above 19200 baud.
+func modbusFrameDelay(baud int) time.Duration {
+	if baud <= 0 || baud > 19200 {
+		return 1750 * time.Microsecond
+	}
+	// 11 bits per character
+	return time.Duration(35*11) * time.Second / time.Duration(10*baud)
+}
+
+// modbusCharDelay will get the longest silent time between
+// the characters of a frame.  This is 1.5 characters at the
+// baud rate, or 750 us above 19200 baud.
+func modbusCharDelay(baud int) time.Duration {
+	if baud <= 0 || baud > 19200 {
+		return 750 * time.Microsecond
+	}
+	// 11 bits per character
+	return time.Duration(15*11) * time.Second / time.Duration(10*baud)
+}
+
+// modbusFrameEnd will get the length of the response frame
+// in the data read, or -1 if the frame is not complete.
+func modbusFrameEnd(p []byte) int {
+	if len(p) < 3 {
+		return -1
+	}
+	n := modbusResponseLength(p)
+	if len(p) < n {
+		return -1
+	}
+	return n
+}
+
+// pdu will build the request PDU, the function code and data.
+func (req *ModbusRequest) pdu(fc byte) ([]byte, error) {
+	pdu := []byte{fc, byte(req.Address >> 8), byte(req.Address)}
+
+	switch fc {
+	case modbusReadCoils, modbusReadDiscreteInputs:
+		if req.Quantity < 1 || req.Quantity > 2000 {
+			return nil, errors.New("Quantity must be 1 to 2000")
+		}
+		pdu = append(pdu, byte(req.Quantity>>8), byte(req.Quantity))
+
+	case modbusReadHoldingRegisters, modbusReadInputRegisters:
+		if req.Quantity < 1 || req.Quantity > 125 {
+			return nil, errors.New("Quantity must be 1 to 125")
+		}
+		pdu = append(pdu, byte(req.Quantity>>8), byte(req.Quantity))
+
+	case modbusWriteSingleCoil:
+		if len(req.Values) != 1 {
+			return nil, errors.New("One value must be given")
+		}
+		if req.Values[0] != 0 {
+			pdu = append(pdu, 0xFF, 0x00)
+		} else {
+			pdu = append(pdu, 0x00, 0x00)
+		}
+
+	case modbusWriteSingleRegister:
+		if len(req.Values) != 1 {
+			return nil, errors.New("One value must be given")
+		}
+		pdu = append(pdu, byte(req.Values[0]>>8), byte(req.Values[0]))
+
+	case modbusWriteMultipleCoils:
+		n := len(req.Values)
+		if n < 1 || n > 1968 {
+			return nil, errors.New("1 to 1968 values must be given")
+		}
+		coils := make([]byte, (n+7)/8)
+		for i, v := range req.Values {
+			if v != 0 {
+				coils[i/8] |= 1 << uint(i%8)
+			}
+		}
+		pdu = append(pdu, byte(n>>8), byte(n), byte(len(coils)))
+		pdu = append(pdu, coils...)
+
+	case modbusWriteMultipleRegisters:
+		n := len(req.Values)
+		if n < 1 || n > 123 {
+			return nil, errors.New("1 to 123 values must be given")
+		}
+		pdu = append(pdu, byte(n>>8), byte(n), byte(n*2))
+		for _, v := range req.Values {
+			pdu = append(pdu, byte(v>>8), byte(v))
+		}
+	}
+
+	return pdu, nil
+}
+
+// modbusResponseLength will get the length of the response
+// frame from the first 3 bytes of the response.
+func modbusResponseLength(header []byte) int {
+	fc := header[1]
+	switch {
+	case fc&0x80 != 0:
+		// Exception: address, function, code, CRC
+		return 5
+	case fc <= modbusReadInputRegisters:
+		// Address, function, byte count, data, CRC
+		return 3 + int(header[2]) + 2
+	default:
+		// Writes echo the address and quantity or value
+		return 8
+	}
+}
+
+// runModbus will send the request to the slave and
+// wait for the response.
+func runModbus(req ModbusRequest) ModbusResponse {
+	resp := ModbusResponse{
+		Cmd:      "Modbus",
+		ID:       req.ID,
+		Port:     req.Port,
+		Slave:    req.Slave,
+		Function: req.Function,
+		Address:  req.Address,
+	}
+
+	err := req.run(&resp)
+	if err != nil {
+		log.Println("Modbus request failed. " + err.Error())
+		resp.Error = err.Error()
+	}
+	resp.Ts = time.Now()
+	return resp
+}
+
+// run will send the request to the slave and fill
+// in the response.
+func (req *ModbusRequest) run(resp *ModbusResponse) error {
+	fc, isFound := modbusFunctions[strings.ToLower(req.Function)]
+	if !isFound {
+		return errors.New("Unknown Modbus function " + req.Function)
+	}
+
+	if req.Slave > 247 {
+		return errors.New("Slave address must be 0 to 247")
+	}
+	if req.Slave == 0 && fc <= modbusReadInputRegisters {
+		return errors.New("Reads cannot be broadcast")
+	}
+
+	pdu, err := req.pdu(fc)
+	if err != nil {
+		return err
+	}
+
+	spio, isFound := findPortByName(req.Port)
+	if !isFound {
+		return errors.New("Could not find the serial port " + req.Port)
+	}
+
+	timeout := defaultModbusTimeout
+	if req.Timeout > 0 {
+		timeout = time.Duration(req.Timeout) * time.Millisecond
+	}
+
+	// Build the frame with the CRC, low byte first
+	frame := append([]byte{req.Slave}, pdu...)
+	crc := modbusCRC(frame)
+	frame = append(frame, byte(crc), byte(crc>>8))
+
+	ps, err := spio.openSession("modbus", modbusBusyWait)
+	if err != nil {
+		return err
+	}
+	defer ps.close()
+
+	// Wait for the line to be silent before sending
+	// and drop anything left from a previous frame
+	delay := modbusFrameDelay(spio.portConf.Baud)
+	time.Sleep(delay)
+	ps.discard()
+
+	if err := ps.write(frame); err != nil {
+		return err
+	}
+
+	// A broadcast has no response, give the slaves time to process it
+	if req.Slave == 0 {
+		time.Sleep(delay)
+		resp.Values = req.Values
+		return nil
+	}
+
+	// One deadline for the whole response.  Once it starts,
+	// the frame ends early if the slave stops for more than t1.5.
+	start := time.Now()
+	if err := ps.waitData(timeout); err != nil {
+		return err
+	}
+	adu, err := ps.readUntil(modbusFrameEnd, timeout-time.Since(start), modbusCharDelay(spio.portConf.Baud)+modbusCharSlack)
+	if err == errIdle {
+		return errors.New("Response ended after " + strconv.Itoa(len(adu)) + " bytes")
+	}
+	if err != nil {
+		return err
+	}
+
+	// Check the CRC
+	n := len(adu)
+	if modbusCRC(adu[:n-2]) != uint16(adu[n-2])|uint16(adu[n-1])<<8 {
+		return errors.New("Bad CRC in the response")
+	}
+	if adu[0] != req.Slave {
+		return errors.New("Response from slave " + strconv.Itoa(int(adu[0])) + " instead of " + strconv.Itoa(int(req.Slave)))
+	}
+
+	// Check for an exception
+	if adu[1] == fc|0x80 {
+		resp.Exception = adu[2]
+		resp.ExceptionDesc = modbusExceptions[adu[2]]
+		return nil
+	}
+	if adu[1] != fc {
+		return errors.New("Response function code " + strconv.Itoa(int(adu[1])) + " does not match the request")
+	}
+
+	data := adu[2 : n-2]
+	switch fc {
+	case modbusReadCoils, modbusReadDiscreteInputs:
+		data = data[1:]
+		if len(data) != (int(req.Quantity)+7)/8 {
+			return errors.New("Response has " + strconv.Itoa(len(data)) + " bytes of coils for " + strconv.Itoa(int(req.Quantity)) + " coils")
+		}
+		resp.Values = make([]uint16, req.Quantity)
+		for i := range resp.Values {
+			resp.Values[i] = uint16(data[i/8]>>uint(i%8)) & 1
+		}
+
+	case modbusReadHoldingRegisters, modbusReadInputRegisters:
+		data = data[1:]
+		if len(data) != int(req.Quantity)*2 {
+			return errors.New("Response has " + strconv.Itoa(len(data)) + " bytes of registers for " + strconv.Itoa(int(req.Quantity)) + " registers")
+		}
+		resp.Values = make([]uint16, req.Quantity)
+		for i := range resp.Values {
+			resp.Values[i] = uint16(data[i*2])<<8 | uint16(data[i*2+1])
+		}
+
+	default:
+		// Writes echo the address, and the value or quantity
+		if !bytes.Equal(data, pdu[1:5]) {
+			return errors.New("Write response does not echo the request, got " + hex.EncodeToString(data) + " instead of " + hex.EncodeToString(pdu[1:5]))
+		}
+		resp.Values = req.Values
+	}
+
+	return nil
+}
+
+// modbusCmd will run the Modbus request given as JSON and send
+// the response to the client that sent the command.
+// Cmd: MODBUS {"Port":"COM5","Slave":1,"Function":"read-holding-registers","Address":0,"Quantity":2}
+func modbusCmd(c *websocketConn, cmd string) {
+	var req ModbusRequest
+
+	// Get the JSON after the command
+	cmds := strings.SplitN(strings.TrimSpace(cmd), " ", 2)
+	if len(cmds) != 2 {
+		replyTo(c, ModbusResponse{Cmd: "Modbus", Error: "Could not parse modbus command: " + cmd})
+		return
+	}
+	if err := json.Unmarshal([]byte(cmds[1]), &req); err != nil {
+		replyTo(c, ModbusResponse{Cmd: "Modbus", Error: "Bad modbus request. " + err.Error()})
+		return
+	}
+
+	// Do not block the echo hub while waiting for the slave
+	go func() {
+		replyTo(c, runModbus(req))
+	}()
+}
+
+// modbusHandler runs the Modbus request given as
+// JSON in the body of a POST request.
+func modbusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	var req ModbusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad modbus request. "+err.Error(), 400)
+		return
+	}
+
+	writeJSON(w, runModbus(req))
+}
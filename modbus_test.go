@@ -0,0 +1,157 @@
+///
+/// Tests of the Modbus RTU frames.
+///
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// TestModbusCRC will check the CRC against the known values.
+// The CRC is sent low byte first, so the CRC of a frame
+// with its CRC is 0.
+func TestModbusCRC(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want uint16
+	}{
+		{[]byte("123456789"), 0x4B37},
+		{[]byte{}, 0xFFFF},
+		{[]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0A}, 0xCDC5},
+		{[]byte{0x11, 0x03, 0x00, 0x6B, 0x00, 0x03}, 0x8776},
+		{[]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0A, 0xC5, 0xCD}, 0x0000},
+	}
+	for _, tt := range tests {
+		if got := modbusCRC(tt.data); got != tt.want {
+			t.Errorf("modbusCRC(% x) = 0x%04x, want 0x%04x", tt.data, got, tt.want)
+		}
+	}
+}
+
+// TestModbusPDU will check the request PDU of each function
+// and that bad quantities and values are refused.
+func TestModbusPDU(t *testing.T) {
+	tests := []struct {
+		name string
+		fc   byte
+		req  ModbusRequest
+		want []byte
+	}{
+		{"read coils", modbusReadCoils, ModbusRequest{Address: 0x0013, Quantity: 19}, []byte{0x01, 0x00, 0x13, 0x00, 0x13}},
+		{"read inputs", modbusReadDiscreteInputs, ModbusRequest{Address: 0x00C4, Quantity: 22}, []byte{0x02, 0x00, 0xC4, 0x00, 0x16}},
+		{"read holding", modbusReadHoldingRegisters, ModbusRequest{Address: 0x006B, Quantity: 3}, []byte{0x03, 0x00, 0x6B, 0x00, 0x03}},
+		{"read input registers", modbusReadInputRegisters, ModbusRequest{Address: 0x0008, Quantity: 125}, []byte{0x04, 0x00, 0x08, 0x00, 0x7D}},
+		{"write coil on", modbusWriteSingleCoil, ModbusRequest{Address: 0x00AC, Values: []uint16{1}}, []byte{0x05, 0x00, 0xAC, 0xFF, 0x00}},
+		{"write coil off", modbusWriteSingleCoil, ModbusRequest{Address: 0x00AC, Values: []uint16{0}}, []byte{0x05, 0x00, 0xAC, 0x00, 0x00}},
+		{"write register", modbusWriteSingleRegister, ModbusRequest{Address: 0x0001, Values: []uint16{0x0003}}, []byte{0x06, 0x00, 0x01, 0x00, 0x03}},
+		{"write coils", modbusWriteMultipleCoils, ModbusRequest{Address: 0x0013, Values: []uint16{1, 0, 1, 1, 0, 0, 1, 1, 1, 0}},
+			[]byte{0x0F, 0x00, 0x13, 0x00, 0x0A, 0x02, 0xCD, 0x01}},
+		{"write registers", modbusWriteMultipleRegisters, ModbusRequest{Address: 0x0001, Values: []uint16{0x000A, 0x0102}},
+			[]byte{0x10, 0x00, 0x01, 0x00, 0x02, 0x04, 0x00, 0x0A, 0x01, 0x02}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.req.pdu(tt.fc)
+			if err != nil || !bytes.Equal(got, tt.want) {
+				t.Errorf("pdu = % x, %v, want % x", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// TestModbusPDUErrors will check the quantities and
+// number of values outside the limits are refused.
+func TestModbusPDUErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		fc   byte
+		req  ModbusRequest
+	}{
+		{"no coils", modbusReadCoils, ModbusRequest{Quantity: 0}},
+		{"too many coils", modbusReadCoils, ModbusRequest{Quantity: 2001}},
+		{"no registers", modbusReadHoldingRegisters, ModbusRequest{Quantity: 0}},
+		{"too many registers", modbusReadInputRegisters, ModbusRequest{Quantity: 126}},
+		{"no coil value", modbusWriteSingleCoil, ModbusRequest{}},
+		{"two register values", modbusWriteSingleRegister, ModbusRequest{Values: []uint16{1, 2}}},
+		{"too many coil values", modbusWriteMultipleCoils, ModbusRequest{Values: make([]uint16, 1969)}},
+		{"no register values", modbusWriteMultipleRegisters, ModbusRequest{}},
+		{"too many register values", modbusWriteMultipleRegisters, ModbusRequest{Values: make([]uint16, 124)}},
+	}
+	for _, tt := range tests {
+		if _, err := tt.req.pdu(tt.fc); err == nil {
+			t.Errorf("%s: pdu gave no error", tt.name)
+		}
+	}
+}
+
+// TestModbusResponseLength will check the length of the
+// response frame from its first 3 bytes.
+func TestModbusResponseLength(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   int
+	}{
+		{"read coils", []byte{0x01, 0x01, 0x03}, 8},
+		{"read holding", []byte{0x11, 0x03, 0x06}, 11},
+		{"read input registers", []byte{0x01, 0x04, 0xFA}, 255},
+		{"write coil", []byte{0x01, 0x05, 0x00}, 8},
+		{"write register", []byte{0x01, 0x06, 0x00}, 8},
+		{"write coils", []byte{0x01, 0x0F, 0x00}, 8},
+		{"write registers", []byte{0x01, 0x10, 0x00}, 8},
+		{"exception", []byte{0x01, 0x83, 0x02}, 5},
+	}
+	for _, tt := range tests {
+		if got := modbusResponseLength(tt.header); got != tt.want {
+			t.Errorf("%s: modbusResponseLength(% x) = %d, want %d", tt.name, tt.header, got, tt.want)
+		}
+	}
+}
+
+// TestModbusFrameEnd will check a response is only complete
+// when all of its bytes are read.
+func TestModbusFrameEnd(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"empty", []byte{}, -1},
+		{"address and function", []byte{0x01, 0x03}, -1},
+		{"short read", []byte{0x01, 0x03, 0x04, 0x00, 0x01, 0x00}, -1},
+		{"read", []byte{0x01, 0x03, 0x02, 0x00, 0x01, 0x79, 0x84}, 7},
+		{"read and more", []byte{0x01, 0x03, 0x02, 0x00, 0x01, 0x79, 0x84, 0x00}, 7},
+		{"exception", []byte{0x01, 0x83, 0x02, 0xC0, 0xF1}, 5},
+		{"short write", []byte{0x01, 0x06, 0x00, 0x01, 0x00, 0x03, 0x98}, -1},
+	}
+	for _, tt := range tests {
+		if got := modbusFrameEnd(tt.data); got != tt.want {
+			t.Errorf("%s: modbusFrameEnd = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestModbusDelays will check the t1.5 and t3.5 times.
+func TestModbusDelays(t *testing.T) {
+	tests := []struct {
+		baud  int
+		char  time.Duration
+		frame time.Duration
+	}{
+		{9600, 1718750 * time.Nanosecond, 4010416 * time.Nanosecond},
+		{19200, 859375 * time.Nanosecond, 2005208 * time.Nanosecond},
+		{115200, 750 * time.Microsecond, 1750 * time.Microsecond},
+		{0, 750 * time.Microsecond, 1750 * time.Microsecond},
+	}
+	for _, tt := range tests {
+		if got := modbusCharDelay(tt.baud); got != tt.char {
+			t.Errorf("modbusCharDelay(%d) = %v, want %v", tt.baud, got, tt.char)
+		}
+		if got := modbusFrameDelay(tt.baud); got != tt.frame {
+			t.Errorf("modbusFrameDelay(%d) = %v, want %v", tt.baud, got, tt.frame)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+///
+/// NMEA 0183 sentence decoder.
+///
+
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	// Longest NMEA sentence kept while waiting for the end of line.
+	// The standard max is 82 characters, some devices send longer.
+	maxNMEALength = 256
+)
+
+// nmeaDecoder finds NMEA 0183 sentences in the data read
+// from a serial port.  It checks the checksum and decodes
+// GGA, RMC, VTG, HDT and ZDA sentences.  Other sentences
+// are published with their fields.
+type nmeaDecoder struct {
+	buf            []byte // Partial sentence
+	checksumErrors int    // Number of sentences with a bad checksum
+}
+
+// NMEAChecksumError is the event data for a
+// sentence with a bad checksum.
+type NMEAChecksumError struct {
+	Sentence string // Sentence with the bad checksum
+	Count    int    // Number of bad checksums on the port
+}
+
+// NMEASentence is the event data for a sentence
+// that is not decoded.
+type NMEASentence struct {
+	Talker string   // Talker ID, eg. GP
+	Fields []string // Fields after the sentence type
+}
+
+// NMEAGGA is the GPS fix data.
+type NMEAGGA struct {
+	Talker     string
+	Time       string   // UTC time hhmmss.ss
+	Latitude   *float64 // Decimal degrees, negative south.  nil with no fix.
+	Longitude  *float64 // Decimal degrees, negative west.  nil with no fix.
+	Quality    int      // Fix quality.  0 is no fix.
+	Satellites int      // Number of satellites used
+	HDOP       float64  // Horizontal dilution of precision
+	Altitude   float64  // Antenna altitude above mean sea level in meters
+	GeoidSep   float64  // Geoid separation in meters
+}
+
+// NMEARMC is the recommended minimum GPS data.
+type NMEARMC struct {
+	Talker     string
+	Time       string   // UTC time hhmmss.ss
+	Status     string   // A is valid, V is warning
+	Latitude   *float64 // Decimal degrees, negative south.  nil with no fix.
+	Longitude  *float64 // Decimal degrees, negative west.  nil with no fix.
+	SpeedKnots float64  // Speed over ground in knots
+	Course     float64  // Course over ground in degrees true
+	Date       string   // Date ddmmyy
+	MagVar     float64  // Magnetic variation in degrees, negative west
+}
+
+// NMEAVTG is the course and speed over ground.
+type NMEAVTG struct {
+	Talker       string
+	CourseTrue   float64 // Course in degrees true
+	CourseMag    float64 // Course in degrees magnetic
+	SpeedKnots   float64 // Speed in knots
+	SpeedKmPerHr float64 // Speed in km/h
+}
+
+// NMEAHDT is the true heading.
+type NMEAHDT struct {
+	Talker  string
+	Heading float64 // Heading in degrees true
+}
+
+// NMEAZDA is the UTC time and date.
+type NMEAZDA struct {
+	Talker      string
+	Time        string // UTC time hhmmss.ss
+	Day         int
+	Month       int
+	Year        int
+	ZoneHours   int // Local zone offset hours
+	ZoneMinutes int // Local zone offset minutes
+}
+
+// decode will add the data and return an event
+// for each complete sentence.
+func (nd *nmeaDecoder) decode(p []byte) []*PortEvent {
+	var events []*PortEvent
+
+	for _, b := range p {
+		switch {
+		case b == '$' || b == '!':
+			// Start of a sentence
+			nd.buf = append(nd.buf[:0], b)
+		case b == '\r' || b == '\n':
+			if len(nd.buf) > 0 {
+				if event := nd.sentence(string(nd.buf)); event != nil {
+					events = append(events, event)
+				}
+			}
+			nd.buf = nd.buf[:0]
+		case len(nd.buf) > 0:
+			nd.buf = append(nd.buf, b)
+			if len(nd.buf) > maxNMEALength {
+				nd.buf = nd.buf[:0]
+			}
+		}
+	}
+
+	return events
+}
+
+// sentence will check the checksum and decode the sentence.
+// A sentence without a checksum is flagged as unchecked.
+// It returns nil if the line is not a sentence.
+func (nd *nmeaDecoder) sentence(s string) *PortEvent {
+	body := s[1:]
+
+	// Check the checksum if one is given
+	isChecked := false
+	if i := strings.LastIndexByte(body, '*'); i >= 0 {
+		sum, err := strconv.ParseUint(strings.TrimSpace(body[i+1:]), 16, 8)
+		if err != nil || byte(sum) != nmeaChecksum([]byte(body[:i])) {
+			nd.checksumErrors++
+			return &PortEvent{
+				Cmd:  "NMEAError",
+				Type: "Checksum",
+				Data: NMEAChecksumError{Sentence: s, Count: nd.checksumErrors},
+			}
+		}
+		body = body[:i]
+		isChecked = true
+	}
+
+	fields := strings.Split(body, ",")
+	if len(fields[0]) < 3 {
+		return nil
+	}
+
+	// Proprietary sentences start with P and have no talker
+	address := fields[0]
+	talker, kind := address[:2], address[2:]
+	if address[0] == 'P' {
+		talker, kind = "P", address[1:]
+	}
+
+	f := nmeaFields(fields[1:])
+	event := &PortEvent{Cmd: "NMEA", Type: kind, Unchecked: !isChecked}
+
+	switch kind {
+	case "GGA":
+		event.Data = NMEAGGA{
+			Talker:     talker,
+			Time:       f.str(0),
+			Latitude:   f.latLon(1, 2),
+			Longitude:  f.latLon(3, 4),
+			Quality:    f.int(5),
+			Satellites: f.int(6),
+			HDOP:       f.float(7),
+			Altitude:   f.float(8),
+			GeoidSep:   f.float(10),
+		}
+	case "RMC":
+		event.Data = NMEARMC{
+			Talker:     talker,
+			Time:       f.str(0),
+			Status:     f.str(1),
+			Latitude:   f.latLon(2, 3),
+			Longitude:  f.latLon(4, 5),
+			SpeedKnots: f.float(6),
+			Course:     f.float(7),
+			Date:       f.str(8),
+			MagVar:     f.signed(9, 10, "W"),
+		}
+	case "VTG":
+		event.Data = NMEAVTG{
+			Talker:       talker,
+			CourseTrue:   f.float(0),
+			CourseMag:    f.float(2),
+			SpeedKnots:   f.float(4),
+			SpeedKmPerHr: f.float(6),
+		}
+	case "HDT":
+		event.Data = NMEAHDT{Talker: talker, Heading: f.float(0)}
+	case "ZDA":
+		event.Data = NMEAZDA{
+			Talker:      talker,
+			Time:        f.str(0),
+			Day:         f.int(1),
+			Month:       f.int(2),
+			Year:        f.int(3),
+			ZoneHours:   f.int(4),
+			ZoneMinutes: f.int(5),
+		}
+	default:
+		event.Data = NMEASentence{Talker: talker, Fields: f}
+	}
+
+	return event
+}
+
+// nmeaChecksum will calculate the XOR checksum of
+// the sentence between the $ and *.
+func nmeaChecksum(p []byte) byte {
+	var sum byte
+	for _, b := range p {
+		sum ^= b
+	}
+	return sum
+}
+
+// nmeaFields are the fields of a sentence after
+// the address.  Missing or empty fields are 0.
+type nmeaFields []string
+
+// str will get the field as a string.
+func (f nmeaFields) str(i int) string {
+	if i >= len(f) {
+		return ""
+	}
+	return f[i]
+}
+
+// float will get the field as a number.
+func (f nmeaFields) float(i int) float64 {
+	v, _ := strconv.ParseFloat(f.str(i), 64)
+	return v
+}
+
+// int will get the field as an integer.
+func (f nmeaFields) int(i int) int {
+	v, _ := strconv.Atoi(f.str(i))
+	return v
+}
+
+// signed will get the field as a number that is
+// negative when the next field is the given hemisphere.
+func (f nmeaFields) signed(i int, hemi int, negative string) float64 {
+	v := f.float(i)
+	if strings.EqualFold(f.str(hemi), negative) {
+		return -v
+	}
+	return v
+}
+
+// latLon will get a latitude or longitude in decimal degrees
+// from the ddmm.mmmm field and the N, S, E or W field.
+// It returns nil if the field is empty, when there is no fix.
+func (f nmeaFields) latLon(i int, hemi int) *float64 {
+	v, err := strconv.ParseFloat(f.str(i), 64)
+	if err != nil {
+		return nil
+	}
+	deg := float64(int(v / 100))
+	dec := deg + (v-deg*100)/60
+
+	switch strings.ToUpper(f.str(hemi)) {
+	case "S", "W":
+		dec = -dec
+	}
+	return &dec
+}
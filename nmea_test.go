@@ -0,0 +1,154 @@
+///
+/// Tests of the NMEA 0183 sentence decoder.
+///
+
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// float will get a pointer to the value.
+func float(v float64) *float64 {
+	return &v
+}
+
+// checkLatLon will check the position is the one wanted.
+// A nil position is wanted when there is no fix.
+func checkLatLon(t *testing.T, name string, got *float64, want *float64) {
+	t.Helper()
+	switch {
+	case got == nil && want == nil:
+	case got == nil || want == nil:
+		t.Errorf("%s is %v, want %v", name, got, want)
+	case math.Abs(*got-*want) > 1e-9:
+		t.Errorf("%s is %v, want %v", name, *got, *want)
+	}
+}
+
+// TestNMEAChecksum will check the XOR of the sentence,
+// including any spaces in it.
+func TestNMEAChecksum(t *testing.T) {
+	tests := []struct {
+		body string
+		want byte
+	}{
+		{"GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,", 0x47},
+		{"GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W", 0x6A},
+		{"HEHDT,274.07,T ", 0x39},
+		{"HEHDT,274.07,T", 0x19},
+		{"", 0x00},
+	}
+	for _, tt := range tests {
+		if got := nmeaChecksum([]byte(tt.body)); got != tt.want {
+			t.Errorf("nmeaChecksum(%q) = 0x%02X, want 0x%02X", tt.body, got, tt.want)
+		}
+	}
+}
+
+// TestNMEADecode will check each sentence type is decoded,
+// and bad or missing checksums are reported.
+func TestNMEADecode(t *testing.T) {
+	tests := []struct {
+		name      string
+		line      string
+		cmd       string
+		kind      string
+		unchecked bool
+		data      interface{}
+	}{
+		{"GGA", "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47\r\n", "NMEA", "GGA", false,
+			NMEAGGA{Talker: "GP", Time: "123519", Latitude: float(48.1173), Longitude: float(11.516666666666667),
+				Quality: 1, Satellites: 8, HDOP: 0.9, Altitude: 545.4, GeoidSep: 46.9}},
+		{"GGA no fix", "$GPGGA,002153.000,,,,,0,00,,,M,,M,,*7D\r\n", "NMEA", "GGA", false,
+			NMEAGGA{Talker: "GP", Time: "002153.000"}},
+		{"RMC", "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A\r\n", "NMEA", "RMC", false,
+			NMEARMC{Talker: "GP", Time: "123519", Status: "A", Latitude: float(48.1173), Longitude: float(11.516666666666667),
+				SpeedKnots: 22.4, Course: 84.4, Date: "230394", MagVar: -3.1}},
+		{"VTG", "$GPVTG,054.7,T,034.4,M,005.5,N,010.2,K*48\r\n", "NMEA", "VTG", false,
+			NMEAVTG{Talker: "GP", CourseTrue: 54.7, CourseMag: 34.4, SpeedKnots: 5.5, SpeedKmPerHr: 10.2}},
+		{"HDT with a space", "$HEHDT,274.07,T *39\r\n", "NMEA", "HDT", false,
+			NMEAHDT{Talker: "HE", Heading: 274.07}},
+		{"ZDA", "$GPZDA,201530.00,04,07,2002,00,00*60\r\n", "NMEA", "ZDA", false,
+			NMEAZDA{Talker: "GP", Time: "201530.00", Day: 4, Month: 7, Year: 2002}},
+		{"proprietary", "$PGRME,15.0,M,45.0,M,25.0,M*1C\r\n", "NMEA", "GRME", false,
+			NMEASentence{Talker: "P", Fields: []string{"15.0", "M", "45.0", "M", "25.0", "M"}}},
+		{"no checksum", "$HEHDT,274.07,T\r\n", "NMEA", "HDT", true,
+			NMEAHDT{Talker: "HE", Heading: 274.07}},
+		{"bad checksum", "$HEHDT,274.07,T*39\r\n", "NMEAError", "Checksum", false,
+			NMEAChecksumError{Sentence: "$HEHDT,274.07,T*39", Count: 1}},
+		{"bad checksum hex", "$HEHDT,274.07,T*ZZ\r\n", "NMEAError", "Checksum", false,
+			NMEAChecksumError{Sentence: "$HEHDT,274.07,T*ZZ", Count: 1}},
+		{"south west", "$GPGGA,1,4807.038,S,01131.000,W,1,08,0.9,545.4,M,46.9,M,,\n", "NMEA", "GGA", true,
+			NMEAGGA{Talker: "GP", Time: "1", Latitude: float(-48.1173), Longitude: float(-11.516666666666667),
+				Quality: 1, Satellites: 8, HDOP: 0.9, Altitude: 545.4, GeoidSep: 46.9}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nd := &nmeaDecoder{}
+			events := nd.decode([]byte(tt.line))
+			if len(events) != 1 {
+				t.Fatalf("got %d events, want 1", len(events))
+			}
+			e := events[0]
+			if e.Cmd != tt.cmd || e.Type != tt.kind || e.Unchecked != tt.unchecked {
+				t.Errorf("event is %s %s unchecked %v, want %s %s unchecked %v", e.Cmd, e.Type, e.Unchecked, tt.cmd, tt.kind, tt.unchecked)
+			}
+
+			// The positions are compared on their own, they are not exact
+			switch want := tt.data.(type) {
+			case NMEAGGA:
+				got := e.Data.(NMEAGGA)
+				checkLatLon(t, "Latitude", got.Latitude, want.Latitude)
+				checkLatLon(t, "Longitude", got.Longitude, want.Longitude)
+				got.Latitude, got.Longitude, want.Latitude, want.Longitude = nil, nil, nil, nil
+				e.Data, tt.data = got, want
+			case NMEARMC:
+				got := e.Data.(NMEARMC)
+				checkLatLon(t, "Latitude", got.Latitude, want.Latitude)
+				checkLatLon(t, "Longitude", got.Longitude, want.Longitude)
+				got.Latitude, got.Longitude, want.Latitude, want.Longitude = nil, nil, nil, nil
+				e.Data, tt.data = got, want
+			}
+			if !reflect.DeepEqual(e.Data, tt.data) {
+				t.Errorf("data is %+v, want %+v", e.Data, tt.data)
+			}
+		})
+	}
+}
+
+// TestNMEASplit will check sentences split across reads are
+// decoded, and noise and overlong lines are skipped.
+func TestNMEASplit(t *testing.T) {
+	nd := &nmeaDecoder{}
+	var events []*PortEvent
+	for _, p := range []string{"noise\r\n$GPVTG,054.7,T,034.", "4,M,005.5,N,010.2,K*48\r", "\n$HEHDT,274.07,T *39\r\n"} {
+		events = append(events, nd.decode([]byte(p))...)
+	}
+	if len(events) != 2 || events[0].Type != "VTG" || events[1].Type != "HDT" {
+		t.Fatalf("got %d events, want VTG and HDT", len(events))
+	}
+
+	long := make([]byte, maxNMEALength+10)
+	for i := range long {
+		long[i] = 'A'
+	}
+	long[0] = '$'
+	if events := nd.decode(append(long, '\r', '\n')); len(events) != 0 {
+		t.Errorf("overlong line gave %d events", len(events))
+	}
+}
+
+// TestNMEAChecksumCount will check the bad checksums are counted.
+func TestNMEAChecksumCount(t *testing.T) {
+	nd := &nmeaDecoder{}
+	events := nd.decode([]byte("$HEHDT,1,T*00\r\n$HEHDT,2,T*00\r\n"))
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	if got := events[1].Data.(NMEAChecksumError).Count; got != 2 {
+		t.Errorf("count is %d, want 2", got)
+	}
+}
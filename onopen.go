@@ -0,0 +1,132 @@
+///
+/// Sequences run on a serial port when it opens,
+/// eg. to wake up a device with a BREAK.
+///
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OnOpenList is the list of the on open sequences sent to a client.
+type OnOpenList struct {
+	Cmd   string            // OnOpen
+	Ports map[string]string // Name of the script run when each port opens
+}
+
+var (
+	// Script run when a port opens, by lower case port name
+	onOpenSequences = map[string]*ScriptRequest{}
+	onOpenMu        sync.Mutex
+)
+
+// loadOnOpen will set the on open sequences from the
+// -on-open flag, eg. COM6=adcp-wake,COM7=init
+func loadOnOpen(list string) error {
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return errors.New("Bad on open sequence " + item + ", use port=script")
+		}
+		setOnOpen(strings.TrimSpace(kv[0]), &ScriptRequest{Name: strings.TrimSpace(kv[1])})
+	}
+	return nil
+}
+
+// setOnOpen will set the script run when the port opens.
+// A nil request removes it.
+func setOnOpen(portname string, req *ScriptRequest) {
+	onOpenMu.Lock()
+	defer onOpenMu.Unlock()
+	if req == nil {
+		delete(onOpenSequences, strings.ToLower(portname))
+		return
+	}
+	onOpenSequences[strings.ToLower(portname)] = req
+}
+
+// runOnOpen will run the on open sequence of the port,
+// if it has one.  The progress is sent to all the clients
+// as Script events.
+func runOnOpen(portname string) {
+	onOpenMu.Lock()
+	seq, isFound := onOpenSequences[strings.ToLower(portname)]
+	onOpenMu.Unlock()
+	if !isFound {
+		return
+	}
+
+	req := *seq
+	req.ID = "onopen-" + portname
+	req.Port = portname
+	run, err := newScriptRun(req, broadcastScriptEvent)
+	if err != nil {
+		log.Println("Could not run the on open sequence of " + portname + ". " + err.Error())
+		broadcastScriptEvent(ScriptEvent{Cmd: "Script", ID: req.ID, Name: req.Name, Port: portname, Event: "failed", Error: err.Error(), Ts: time.Now()})
+		return
+	}
+	run.run()
+}
+
+// onOpenCmd will set, remove or list the sequences run
+// when the ports open.  A sequence is a script by name,
+// or the steps of a script.
+// Cmd: ONOPEN COM6 adcp-wake
+// Cmd: ONOPEN COM6 {"Steps":[{"Op":"break","Timeout":300},{"Op":"sleep","Timeout":1000},{"Op":"send","Data":"CSTOP\r"}]}
+// Cmd: ONOPEN COM6 OFF
+// Cmd: ONOPEN LIST
+func onOpenCmd(c *websocketConn, cmd string) {
+	cmds := strings.SplitN(strings.TrimSpace(cmd), " ", 3)
+	if len(cmds) == 2 && strings.ToLower(cmds[1]) == "list" {
+		list := OnOpenList{Cmd: "OnOpen", Ports: map[string]string{}}
+		onOpenMu.Lock()
+		for port, req := range onOpenSequences {
+			list.Ports[port] = req.Name
+		}
+		onOpenMu.Unlock()
+		replyTo(c, list)
+		return
+	}
+	if len(cmds) != 3 {
+		log.Println("Could not parse onopen command: " + cmd)
+		return
+	}
+
+	portname := cmds[1]
+	arg := strings.TrimSpace(cmds[2])
+	switch {
+	case strings.ToLower(arg) == "off":
+		setOnOpen(portname, nil)
+		log.Println("On open sequence of " + portname + " removed by " + c.identity())
+
+	case strings.HasPrefix(arg, "{"):
+		s := &Script{}
+		if err := json.Unmarshal([]byte(arg), s); err != nil {
+			replyTo(c, ScriptEvent{Cmd: "Script", Port: portname, Event: "failed", Error: "Bad script. " + err.Error(), Ts: time.Now()})
+			return
+		}
+		if _, err := s.validate(); err != nil {
+			replyTo(c, ScriptEvent{Cmd: "Script", Port: portname, Event: "failed", Error: "Bad script. " + err.Error(), Ts: time.Now()})
+			return
+		}
+		if s.Name == "" {
+			s.Name = "onopen"
+		}
+		setOnOpen(portname, &ScriptRequest{Name: s.Name, Script: s})
+		log.Println("On open sequence of " + portname + " set by " + c.identity())
+
+	default:
+		setOnOpen(portname, &ScriptRequest{Name: arg})
+		log.Println("On open sequence of " + portname + " set to " + arg + " by " + c.identity())
+	}
+}
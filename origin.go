@@ -0,0 +1,130 @@
+///
+/// Origin checking and CORS policy for the
+/// websocket upgrade and the HTTP endpoints.
+///
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// allowedOrigins is the list of origins allowed to
+// connect.  An entry can be an exact origin, eg. https://dash.example.com,
+// a wildcard origin, eg. https://*.example.com, a host
+// with any scheme, eg. *.example.com, or * to allow all.
+// If the list is empty, only same-origin requests are allowed.
+var allowedOrigins []string
+
+// setAllowedOrigins will set the allowed origins from
+// a comma separated list.
+func setAllowedOrigins(list string) {
+	allowedOrigins = nil
+	for _, o := range strings.Split(list, ",") {
+		o = strings.ToLower(strings.TrimSpace(o))
+		if len(o) > 0 {
+			allowedOrigins = append(allowedOrigins, strings.TrimSuffix(o, "/"))
+		}
+	}
+}
+
+// checkOrigin will check if the request origin is allowed.
+// Requests without an Origin header do not come from a
+// browser and are allowed.
+func checkOrigin(r *http.Request) bool {
+	isAllowed, _ := matchOrigin(r)
+	return isAllowed
+}
+
+// matchOrigin will check if the request origin is allowed.
+// isExplicit is set if it is the same origin or matched an
+// origin in the list other than *, so it can be trusted with
+// credentials.
+func matchOrigin(r *http.Request) (isAllowed bool, isExplicit bool) {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true, false
+	}
+
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || len(u.Host) == 0 {
+		log.Println("Bad origin given: " + origin)
+		return false, false
+	}
+
+	// No list given, so only allow the same origin
+	if len(allowedOrigins) == 0 {
+		isSame := u.Host == strings.ToLower(r.Host)
+		return isSame, isSame
+	}
+
+	full := u.Scheme + "://" + u.Host
+	isAny := false
+	for _, pattern := range allowedOrigins {
+		if pattern == "*" {
+			isAny = true
+			continue
+		}
+
+		// Match the host only if no scheme is given
+		target := full
+		if !strings.Contains(pattern, "://") {
+			target = u.Host
+		}
+
+		if isMatch, _ := path.Match(pattern, target); isMatch {
+			return true, true
+		}
+	}
+	if isAny {
+		return true, false
+	}
+
+	log.Println("Origin not allowed: " + origin)
+	return false, false
+}
+
+// corsHandler will apply the CORS policy to an HTTP handler.
+// Requests from an origin not allowed are rejected.  Only an
+// origin matched explicitly is sent back with credentials
+// allowed.  An origin allowed by * gets a literal * without
+// credentials.  Preflight requests are answered here and are
+// not passed to the handler.
+func corsHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+
+		if len(origin) > 0 {
+			isAllowed, isExplicit := matchOrigin(r)
+			if !isAllowed {
+				http.Error(w, "Origin not allowed", 403)
+				return
+			}
+
+			if isExplicit {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			}
+			w.Header().Add("Vary", "Origin")
+		}
+
+		// Preflight request
+		if r.Method == "OPTIONS" && len(r.Header.Get("Access-Control-Request-Method")) > 0 {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			if headers := r.Header.Get("Access-Control-Request-Headers"); len(headers) > 0 {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		h(w, r)
+	}
+}
@@ -0,0 +1,576 @@
+///
+/// File transfers from the devices on the serial ports.
+/// Files are received with YMODEM or ZMODEM into the
+/// downloads directory and offered for HTTP download.
+///
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Default time to wait for the sender to start.
+	defaultReceiveTimeout = 60 * time.Second
+
+	// Time to wait for the next block or header from the sender.
+	receiveBlockTimeout = 10 * time.Second
+
+	// Time between the C sent to ask a YMODEM sender to start.
+	ymodemStartInterval = 3 * time.Second
+
+	// Largest file that can be received.
+	maxDownloadSize = 1024 * 1024 * 1024
+
+	// Suffix of a file still being received.
+	partialSuffix = ".part"
+)
+
+// Receive protocols.  YMODEM is protocolYMODEM.
+const (
+	protocolZMODEM = "zmodem"
+)
+
+// errBadBlock is returned when a block or packet is
+// received with a bad CRC.  The sender is asked again.
+var errBadBlock = errors.New("Bad block received")
+
+// ReceiveRequest is a request from a client to receive
+// files from a device on a serial port.
+type ReceiveRequest struct {
+	ID       string // Given by the client and sent in the events.  Also used to cancel with transfer cancel.
+	Port     string // Serial port the device is on, i.e. COM5
+	Protocol string // ymodem or zmodem
+	Command  string // Sent as is before the receive starts, eg. to ask the device to send the files
+	Timeout  int    // Time to wait for the sender to start in milliseconds.  0 for the default.
+}
+
+// ReceiveEvent is the progress and result of a
+// receive, sent to all the clients.
+type ReceiveEvent struct {
+	Cmd      string // Receive
+	ID       string // ID of the receive
+	Port     string
+	Protocol string
+	File     string   // File being received
+	Files    []string // Files received in the downloads directory
+	Event    string   // start, progress, file, done, failed or cancelled
+	Received int64    // Bytes of the file received
+	Size     int64    // Size of the file.  -1 if not known.
+	Error    string   // Why the receive failed
+	Ts       time.Time
+}
+
+// DownloadItem is a file in the downloads directory.
+type DownloadItem struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// fileReceiver writes the files received on a
+// serial port to the downloads directory.
+type fileReceiver struct {
+	ps      *portSession
+	event   ReceiveEvent
+	last    time.Time // Time of the last progress event
+	file    *os.File  // File being received.  Nil between files.
+	path    string    // Path the file is renamed to when it is received
+	size    int64     // Size of the file.  -1 if not known.
+	written int64     // Bytes written to the file
+}
+
+// downloadPath will get a path in the downloads directory for
+// the file name.  A number is added if the file already exists.
+func downloadPath(name string) string {
+	name = fileNameChars.ReplaceAllString(filepath.Base(name), "_")
+	if name == "" || name == "." || name == ".." || name == "_" {
+		name = "download"
+	}
+
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	path := filepath.Join(*downloadDir, name)
+	for i := 1; ; i++ {
+		_, errFile := os.Stat(path)
+		_, errPart := os.Stat(path + partialSuffix)
+		if os.IsNotExist(errFile) && os.IsNotExist(errPart) {
+			return path
+		}
+		path = filepath.Join(*downloadDir, stem+"-"+strconv.Itoa(i)+ext)
+	}
+}
+
+// create will start writing a file.  It is written with
+// the partial suffix until it is received.
+func (fr *fileReceiver) create(name string, size int64) error {
+	if size > maxDownloadSize {
+		return errors.New("File " + name + " is larger than " + strconv.Itoa(maxDownloadSize) + " bytes")
+	}
+
+	fr.path = downloadPath(name)
+	f, err := os.Create(fr.path + partialSuffix)
+	if err != nil {
+		return err
+	}
+
+	fr.file = f
+	fr.size = size
+	fr.written = 0
+
+	fr.event.File = filepath.Base(fr.path)
+	fr.event.Received = 0
+	fr.event.Size = size
+	fr.progress(true)
+	return nil
+}
+
+// write will add the data to the file.  Data past the
+// size of the file is padding and is dropped.
+func (fr *fileReceiver) write(p []byte) error {
+	if fr.file == nil {
+		return errors.New("Data received before the file name")
+	}
+	if fr.size >= 0 && fr.written+int64(len(p)) > fr.size {
+		p = p[:fr.size-fr.written]
+	}
+	if fr.written+int64(len(p)) > maxDownloadSize {
+		return errors.New("File is larger than " + strconv.Itoa(maxDownloadSize) + " bytes")
+	}
+
+	n, err := fr.file.Write(p)
+	fr.written += int64(n)
+	fr.event.Received = fr.written
+	fr.progress(false)
+	return err
+}
+
+// finish will close the file and give it its name.
+func (fr *fileReceiver) finish() error {
+	if fr.file == nil {
+		return nil
+	}
+
+	err := fr.file.Close()
+	fr.file = nil
+	if err == nil {
+		err = os.Rename(fr.path+partialSuffix, fr.path)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Println("Received " + fr.path + " " + strconv.FormatInt(fr.written, 10) + " bytes")
+	fr.event.Files = append(fr.event.Files, filepath.Base(fr.path))
+	fr.event.Event = "file"
+	fr.event.Ts = time.Now()
+	broadcastReceive(fr.event)
+	return nil
+}
+
+// abort will close and remove the file being received.
+// When the server shuts down, the partial file is kept.
+func (fr *fileReceiver) abort() {
+	if fr.file == nil {
+		return
+	}
+	if isShuttingDown() {
+		if err := fr.file.Sync(); err != nil {
+			log.Println("Error flushing " + fr.path + partialSuffix + ". " + err.Error())
+		}
+		fr.file.Close()
+		fr.file = nil
+		log.Println("Kept " + fr.path + partialSuffix + " with " + strconv.FormatInt(fr.written, 10) + " bytes received")
+		return
+	}
+	fr.file.Close()
+	fr.file = nil
+	os.Remove(fr.path + partialSuffix)
+}
+
+// progress will send the progress of the file at most
+// every interval, or now if force is set.
+func (fr *fileReceiver) progress(force bool) {
+	if !force && time.Since(fr.last) < transferProgressInterval {
+		return
+	}
+	fr.last = time.Now()
+	fr.event.Event = "progress"
+	fr.event.Ts = fr.last
+	broadcastReceive(fr.event)
+}
+
+// runReceive will receive the files in a session on the serial
+// port and send the progress to all the clients.  It returns
+// the last event.
+func runReceive(req ReceiveRequest) ReceiveEvent {
+	beginWork()
+	defer endWork()
+
+	fr := &fileReceiver{event: ReceiveEvent{
+		Cmd:      "Receive",
+		ID:       req.ID,
+		Port:     req.Port,
+		Protocol: strings.ToLower(req.Protocol),
+		Files:    []string{},
+		Size:     -1,
+	}}
+
+	err := fr.run(req)
+
+	fr.event.Event = "done"
+	if err == errCancelled || err == errTransferCancelled {
+		fr.event.Event = "cancelled"
+		fr.event.Error = err.Error()
+	} else if err != nil {
+		fr.event.Event = "failed"
+		fr.event.Error = err.Error()
+	}
+	if err != nil {
+		log.Println("Receive " + fr.event.ID + " " + fr.event.Event + ". " + err.Error())
+	}
+
+	fr.event.Ts = time.Now()
+	broadcastReceive(fr.event)
+	return fr.event
+}
+
+// run will receive the files with the protocol.
+func (fr *fileReceiver) run(req ReceiveRequest) error {
+	protocol := strings.ToLower(req.Protocol)
+	if protocol != protocolYMODEM && protocol != protocolZMODEM {
+		return errors.New("Unknown receive protocol " + req.Protocol)
+	}
+
+	// Add the receive to the transfers so it can be cancelled
+	ft, err := addTransfer(TransferRequest{ID: req.ID, Port: req.Port, Protocol: protocol})
+	if err != nil {
+		return err
+	}
+	defer ft.remove()
+	fr.event.ID = ft.req.ID
+
+	spio, isFound := findPortByName(req.Port)
+	if !isFound {
+		return errors.New("Could not find the serial port " + req.Port)
+	}
+	if err := os.MkdirAll(*downloadDir, 0755); err != nil {
+		return err
+	}
+
+	ps, err := spio.openSession("receive "+ft.req.ID, transferBusyWait)
+	if err != nil {
+		return err
+	}
+	defer ps.close()
+	ps.cancel = ft.stop
+	fr.ps = ps
+
+	fr.event.Event = "start"
+	fr.event.Ts = time.Now()
+	broadcastReceive(fr.event)
+
+	timeout := defaultReceiveTimeout
+	if req.Timeout > 0 {
+		timeout = time.Duration(req.Timeout) * time.Millisecond
+	}
+
+	ps.discard()
+	if req.Command != "" {
+		if err := ps.write([]byte(req.Command)); err != nil {
+			return err
+		}
+	}
+
+	if protocol == protocolYMODEM {
+		err = fr.receiveYMODEM(timeout)
+	} else {
+		err = (&zmodemReceiver{fr: fr}).receive(timeout)
+	}
+
+	if err != nil {
+		fr.abort()
+		if protocol == protocolYMODEM {
+			ps.write([]byte{xmodemCAN, xmodemCAN, xmodemCAN})
+		} else {
+			ps.write([]byte(zmodemCancel))
+		}
+	}
+	return err
+}
+
+// readBlock will read a YMODEM block.  It returns the
+// header, which is EOT at the end of the file.
+func (fr *fileReceiver) readBlock(timeout time.Duration) (byte, byte, []byte, error) {
+	h, err := fr.ps.read(1, timeout)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	size := 0
+	switch h[0] {
+	case xmodemSOH:
+		size = 128
+	case xmodemSTX:
+		size = 1024
+	case xmodemEOT:
+		return xmodemEOT, 0, nil, nil
+	case xmodemCAN:
+		// Two CAN in a row cancels
+		if b, err := fr.ps.read(1, time.Second); err == nil && b[0] == xmodemCAN {
+			return 0, 0, nil, errTransferCancelled
+		}
+		return 0, 0, nil, errBadBlock
+	default:
+		return 0, 0, nil, errBadBlock
+	}
+
+	// Block number, its inverse, the data and the CRC
+	blk, err := fr.ps.read(size+4, receiveBlockTimeout)
+	if err != nil {
+		return 0, 0, nil, errBadBlock
+	}
+
+	num := blk[0]
+	data := blk[2 : size+2]
+	crc := uint16(blk[size+2])<<8 | uint16(blk[size+3])
+	if blk[1] != ^num || crc16XMODEM(data) != crc {
+		return 0, 0, nil, errBadBlock
+	}
+	return h[0], num, data, nil
+}
+
+// nak will drop the rest of a bad block and ask for it again.
+func (fr *fileReceiver) nak(retries *int) error {
+	*retries++
+	if *retries > xmodemMaxRetries {
+		return errors.New("Too many bad blocks")
+	}
+	time.Sleep(100 * time.Millisecond)
+	fr.ps.discard()
+	return fr.ps.write([]byte{xmodemNAK})
+}
+
+// receiveYMODEM will receive a YMODEM batch.  Each file starts
+// with block 0 giving its name and size, and an empty block 0
+// ends the batch.
+func (fr *fileReceiver) receiveYMODEM(startTimeout time.Duration) error {
+	for {
+		// Ask for block 0 with a C until the sender starts
+		var num byte
+		var data []byte
+		deadline := time.Now().Add(startTimeout)
+		for {
+			if time.Now().After(deadline) {
+				return errTimeout
+			}
+			if err := fr.ps.write([]byte{xmodemCRC}); err != nil {
+				return err
+			}
+
+			var h byte
+			var err error
+			h, num, data, err = fr.readBlock(ymodemStartInterval)
+			if err == errTimeout || err == errBadBlock || (err == nil && h == xmodemEOT) {
+				fr.ps.discard()
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			break
+		}
+		if num != 0 {
+			return errors.New("Expected block 0, received block " + strconv.Itoa(int(num)))
+		}
+
+		// Block 0 is the name, then the size and other fields
+		fields := strings.SplitN(string(data), "\x00", 3)
+		if fields[0] == "" {
+			// End of the batch
+			return fr.ps.write([]byte{xmodemACK})
+		}
+		size := int64(-1)
+		if len(fields) > 1 {
+			if info := strings.Fields(fields[1]); len(info) > 0 {
+				if n, err := strconv.ParseInt(info[0], 10, 64); err == nil {
+					size = n
+				}
+			}
+		}
+		if err := fr.create(fields[0], size); err != nil {
+			return err
+		}
+		if err := fr.ps.write([]byte{xmodemACK, xmodemCRC}); err != nil {
+			return err
+		}
+
+		// Receive the data blocks
+		expected := byte(1)
+		retries := 0
+		isEOT := false
+		for {
+			h, num, data, err := fr.readBlock(receiveBlockTimeout)
+			if err == errBadBlock || err == errTimeout {
+				if err := fr.nak(&retries); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			// NAK the first EOT to be sure it is not noise
+			if h == xmodemEOT {
+				if !isEOT {
+					isEOT = true
+					if err := fr.ps.write([]byte{xmodemNAK}); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := fr.ps.write([]byte{xmodemACK}); err != nil {
+					return err
+				}
+				break
+			}
+			isEOT = false
+
+			switch num {
+			case expected:
+				if err := fr.write(data); err != nil {
+					return err
+				}
+				expected++
+				retries = 0
+			case expected - 1:
+				// The ACK was lost and the block sent again
+			default:
+				return errors.New("Received block " + strconv.Itoa(int(num)) + " instead of " + strconv.Itoa(int(expected)))
+			}
+			if err := fr.ps.write([]byte{xmodemACK}); err != nil {
+				return err
+			}
+		}
+
+		if err := fr.finish(); err != nil {
+			return err
+		}
+		startTimeout = receiveBlockTimeout
+	}
+}
+
+// broadcastReceive will send the receive event to all the clients.
+func broadcastReceive(event ReceiveEvent) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	echo.wsBroadcast <- b
+}
+
+// receiveCmd will start receiving files from the serial port.
+// The receive is cancelled with transfer cancel.
+// Cmd: RECEIVE {"ID":"1","Port":"COM5","Protocol":"zmodem","Command":"DUMP\r"}
+func receiveCmd(c *websocketConn, cmd string) {
+	var req ReceiveRequest
+
+	// Get the JSON after the command
+	cmds := strings.SplitN(strings.TrimSpace(cmd), " ", 2)
+	if len(cmds) != 2 {
+		replyTo(c, ReceiveEvent{Cmd: "Receive", Event: "failed", Error: "Could not parse receive command: " + cmd})
+		return
+	}
+	if err := json.Unmarshal([]byte(cmds[1]), &req); err != nil {
+		replyTo(c, ReceiveEvent{Cmd: "Receive", Event: "failed", Error: "Bad receive request. " + err.Error()})
+		return
+	}
+
+	// Do not block the echo hub while the files are received
+	go runReceive(req)
+}
+
+// receiveHandler receives the files given in the JSON
+// body of a POST request.  It responds when the receive ends.
+func receiveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	var req ReceiveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad receive request. "+err.Error(), 400)
+		return
+	}
+
+	writeJSON(w, runReceive(req))
+}
+
+// downloadsHandler lists the files received, or
+// downloads the file given in the path.
+// GET /downloads/
+// GET /downloads/log1.bin
+func downloadsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/downloads")
+	name = strings.TrimPrefix(name, "/")
+	if name == "" {
+		writeJSON(w, downloadList())
+		return
+	}
+
+	// Only the files received can be downloaded
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") || strings.HasSuffix(name, partialSuffix) {
+		http.NotFound(w, r)
+		return
+	}
+	path := filepath.Join(*downloadDir, name)
+	if info, err := os.Stat(path); err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"\"")
+	http.ServeFile(w, r, path)
+}
+
+// downloadList will get the files received.
+func downloadList() []DownloadItem {
+	list := []DownloadItem{}
+
+	f, err := os.Open(*downloadDir)
+	if err != nil {
+		return list
+	}
+	defer f.Close()
+
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		log.Println(err)
+	}
+	for _, info := range infos {
+		if info.IsDir() || strings.HasSuffix(info.Name(), partialSuffix) {
+			continue
+		}
+		list = append(list, DownloadItem{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
@@ -0,0 +1,658 @@
+///
+/// Expect style scripts that run a session
+/// with a device on an open serial port.
+///
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Default time to wait for an expect to match.
+	defaultExpectTimeout = 5000 * time.Millisecond
+
+	// Max steps run by a script.  Stops a script that loops forever.
+	maxScriptSteps = 10000
+
+	// Time to wait for another session on the port to finish.
+	scriptBusyWait = 5 * time.Second
+)
+
+// Script step operations.
+const (
+	scriptSend    = "send"
+	scriptBreak   = "break"
+	scriptExpect  = "expect"
+	scriptMeasure = "measure"
+	scriptSleep   = "sleep"
+	scriptGoto    = "goto"
+	scriptFail    = "fail"
+	scriptEnd     = "end"
+)
+
+// scriptVar matches a variable in the data sent or
+// the pattern expected, eg. ${version}
+var scriptVar = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// Script is a list of steps run in order on a serial port.
+type Script struct {
+	Name  string
+	Steps []ScriptStep
+}
+
+// ScriptStep is a step of a script.
+type ScriptStep struct {
+	Label   string   // Name used to go to the step
+	Op      string   // send, break, expect, measure, sleep, goto, fail or end
+	Data    string   // send: Data to send with any line ending.  Escapes such as \x03 are replaced.
+	Match   string   // expect, measure: Regular expression to wait for.  The first group of a measure is the value.
+	Timeout int      // expect, measure: Time to wait in milliseconds.  sleep: Time to sleep in milliseconds.  break: Duration in milliseconds, 0 for -break-ms.
+	Capture []string // expect: Variables set to the groups of the match
+	Goto    string   // expect: Label to go to on a match.  goto: Label to go to.
+	Else    string   // expect: Label to go to on a timeout.  Empty to fail the script.
+	Message string   // fail: Reason the script failed
+	Name    string   // measure: Name of the measurement.  The variable is set to the value.
+	Min     *float64 // measure: Lowest value that passes.  nil for no limit.
+	Max     *float64 // measure: Highest value that passes.  nil for no limit.
+	Units   string   // measure: Units of the value, eg. V
+}
+
+// TestMeasurement is a value measured by a script
+// and the limits it was compared with.
+type TestMeasurement struct {
+	Name  string
+	Value float64
+	Min   *float64
+	Max   *float64
+	Units string
+	Pass  bool
+}
+
+// ScriptRequest is a request from a client to run a script.
+type ScriptRequest struct {
+	ID     string            // Given by the client and sent in the events.  Also used to stop the script.
+	Port   string            // Serial port to run the script on, i.e. COM5
+	Name   string            // Name of an uploaded script or a script in the script directory
+	Script *Script           // Script to run instead of a named one
+	Vars   map[string]string // Variables set before the script runs
+}
+
+// ScriptEvent is the progress and result of a
+// script, sent to all the clients.
+type ScriptEvent struct {
+	Cmd   string // Script
+	ID    string // ID of the run
+	Name  string // Name of the script
+	Port  string
+	Event string            // start, send, break, expect, measure, sleep, done or failed
+	Step  int               // Index of the step
+	Data  string            // Data sent or matched
+	Vars  map[string]string // Variables when the script ended
+	Error string            // Why the script failed
+	Ts    time.Time
+}
+
+// ScriptList is the list of scripts sent to a client.
+type ScriptList struct {
+	Cmd     string   // Scripts
+	Scripts []string // Uploaded scripts and scripts in the script directory
+	Running []string // IDs of the scripts running
+}
+
+// scriptRun is a script running on a serial port.
+type scriptRun struct {
+	id           string
+	script       *Script
+	port         string
+	vars         map[string]string
+	labels       map[string]int    // Index of the step for each label
+	measurements []TestMeasurement // Values measured by the script
+	stop         chan struct{}     // Closed to stop the script
+	events       func(ScriptEvent)
+}
+
+var (
+	// Scripts uploaded by the clients by name
+	scripts   = map[string]*Script{}
+	scriptsMu sync.Mutex
+
+	// Scripts running by ID
+	scriptRuns   = map[string]*scriptRun{}
+	scriptRunsMu sync.Mutex
+
+	// Used to give an ID to a run without one
+	scriptRunCount int
+)
+
+// validate will check the steps and find the labels.
+func (s *Script) validate() (map[string]int, error) {
+	labels := map[string]int{}
+	for i, step := range s.Steps {
+		if step.Label != "" {
+			if _, isFound := labels[step.Label]; isFound {
+				return nil, errors.New("Label " + step.Label + " is used twice")
+			}
+			labels[step.Label] = i
+		}
+	}
+
+	for i, step := range s.Steps {
+		where := "Step " + strconv.Itoa(i) + ": "
+		switch strings.ToLower(step.Op) {
+		case scriptSend, scriptSleep, scriptFail, scriptEnd:
+		case scriptBreak:
+			if step.Timeout > 0 {
+				if err := checkBreakMs(step.Timeout); err != nil {
+					return nil, errors.New(where + err.Error())
+				}
+			}
+		case scriptExpect, scriptMeasure:
+			if _, err := regexp.Compile(step.Match); err != nil {
+				return nil, errors.New(where + "Bad match pattern. " + err.Error())
+			}
+			if strings.ToLower(step.Op) == scriptMeasure && step.Name == "" {
+				return nil, errors.New(where + "No name for the measurement")
+			}
+		case scriptGoto:
+			if step.Goto == "" {
+				return nil, errors.New(where + "No label to go to")
+			}
+		default:
+			return nil, errors.New(where + "Unknown op " + step.Op)
+		}
+
+		for _, label := range []string{step.Goto, step.Else} {
+			if _, isFound := labels[label]; label != "" && !isFound {
+				return nil, errors.New(where + "Unknown label " + label)
+			}
+		}
+	}
+
+	return labels, nil
+}
+
+// loadScript will get the uploaded script with the name, or
+// load it from the script directory.
+func loadScript(name string) (*Script, error) {
+	scriptsMu.Lock()
+	s, isFound := scripts[name]
+	scriptsMu.Unlock()
+	if isFound {
+		return s, nil
+	}
+
+	if *scriptDir == "" {
+		return nil, errors.New("Unknown script " + name)
+	}
+
+	s = &Script{}
+	if err := loadJSONFile(*scriptDir, name, s); err != nil {
+		return nil, err
+	}
+	if s.Name == "" {
+		s.Name = name
+	}
+	return s, nil
+}
+
+// loadJSONFile will load name.json from the directory.
+// The name cannot leave the directory.
+func loadJSONFile(dir string, name string, v interface{}) error {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return errors.New("Bad name " + name)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, name+".json"))
+	if err != nil {
+		return errors.New("Could not load " + name + ". " + err.Error())
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return errors.New("Bad JSON in " + name + ". " + err.Error())
+	}
+	return nil
+}
+
+// scriptNames will get the names of the uploaded scripts
+// and the scripts in the script directory.
+func scriptNames() []string {
+	names := map[string]bool{}
+
+	scriptsMu.Lock()
+	for name := range scripts {
+		names[name] = true
+	}
+	scriptsMu.Unlock()
+
+	if *scriptDir != "" {
+		files, err := filepath.Glob(filepath.Join(*scriptDir, "*.json"))
+		if err != nil {
+			log.Println(err)
+		}
+		for _, f := range files {
+			names[strings.TrimSuffix(filepath.Base(f), ".json")] = true
+		}
+	}
+
+	list := make([]string, 0, len(names))
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// newScriptRun will get the script for the request and
+// make it ready to run.
+func newScriptRun(req ScriptRequest, events func(ScriptEvent)) (*scriptRun, error) {
+	s := req.Script
+	if s == nil {
+		var err error
+		if s, err = loadScript(req.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	labels, err := s.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	run := &scriptRun{
+		id:     req.ID,
+		script: s,
+		port:   req.Port,
+		vars:   map[string]string{},
+		labels: labels,
+		stop:   make(chan struct{}),
+		events: events,
+	}
+	for k, v := range req.Vars {
+		run.vars[k] = v
+	}
+
+	scriptRunsMu.Lock()
+	defer scriptRunsMu.Unlock()
+	if run.id == "" {
+		scriptRunCount++
+		run.id = "script-" + strconv.Itoa(scriptRunCount)
+	}
+	if _, isFound := scriptRuns[run.id]; isFound {
+		return nil, errors.New("Script " + run.id + " is already running")
+	}
+	scriptRuns[run.id] = run
+	return run, nil
+}
+
+// event will send the progress of the script.
+func (run *scriptRun) event(event string, step int, data string) {
+	run.events(ScriptEvent{
+		Cmd:   "Script",
+		ID:    run.id,
+		Name:  run.script.Name,
+		Port:  run.port,
+		Event: event,
+		Step:  step,
+		Data:  data,
+		Ts:    time.Now(),
+	})
+}
+
+// expand will replace the variables in the text.
+// Variables in a pattern match their value as is.
+func (run *scriptRun) expand(s string, isPattern bool) string {
+	return scriptVar.ReplaceAllStringFunc(s, func(v string) string {
+		value := run.vars[scriptVar.FindStringSubmatch(v)[1]]
+		if isPattern {
+			return regexp.QuoteMeta(value)
+		}
+		return value
+	})
+}
+
+// run will run the script on the serial port and send
+// the progress and result.  It returns the error that
+// failed the script.
+func (run *scriptRun) run() error {
+	beginWork()
+	defer endWork()
+
+	defer func() {
+		scriptRunsMu.Lock()
+		if scriptRuns[run.id] == run {
+			delete(scriptRuns, run.id)
+		}
+		scriptRunsMu.Unlock()
+	}()
+
+	run.event("start", 0, "")
+	err := run.session()
+
+	result := ScriptEvent{
+		Cmd:   "Script",
+		ID:    run.id,
+		Name:  run.script.Name,
+		Port:  run.port,
+		Event: "done",
+		Vars:  run.vars,
+		Ts:    time.Now(),
+	}
+	if err != nil {
+		log.Println("Script " + run.id + " failed. " + err.Error())
+		result.Event = "failed"
+		result.Error = err.Error()
+	}
+	run.events(result)
+	return err
+}
+
+// session will run the steps of the script in a
+// session on the serial port.
+func (run *scriptRun) session() error {
+	spio, isFound := findPortByName(run.port)
+	if !isFound {
+		return errors.New("Could not find the serial port " + run.port)
+	}
+
+	ps, err := spio.openSession("script "+run.id, scriptBusyWait)
+	if err != nil {
+		return err
+	}
+	defer ps.close()
+	ps.cancel = run.stop
+
+	return run.steps(ps)
+}
+
+// steps will run the steps of the script in the session.
+func (run *scriptRun) steps(ps *portSession) error {
+	i := 0
+	for count := 0; i < len(run.script.Steps); count++ {
+		if count >= maxScriptSteps {
+			return errors.New("Script ran more than " + strconv.Itoa(maxScriptSteps) + " steps")
+		}
+
+		select {
+		case <-run.stop:
+			return errCancelled
+		default:
+		}
+
+		step := run.script.Steps[i]
+		next := i + 1
+
+		switch strings.ToLower(step.Op) {
+		case scriptSend:
+			data := run.expand(parseEscapes(step.Data), false)
+			if err := ps.write([]byte(data)); err != nil {
+				return err
+			}
+			run.event(scriptSend, i, data)
+
+		case scriptBreak:
+			ms := step.Timeout
+			if ms <= 0 {
+				ms = *breakMs
+			}
+			if err := ps.sendBreak(ms); err != nil {
+				return err
+			}
+			run.event(scriptBreak, i, "")
+
+		case scriptExpect:
+			groups, err := run.expect(ps, step)
+			if err == errTimeout && step.Else != "" {
+				run.event(scriptExpect, i, "")
+				next = run.labels[step.Else]
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			// Set the variables to the groups of the match
+			for j, name := range step.Capture {
+				if j+1 < len(groups) {
+					run.vars[name] = string(groups[j+1])
+				}
+			}
+
+			run.event(scriptExpect, i, string(groups[0]))
+			if step.Goto != "" {
+				next = run.labels[step.Goto]
+			}
+
+		case scriptMeasure:
+			groups, err := run.expect(ps, step)
+			if err != nil {
+				return err
+			}
+			if err := run.measure(step, groups); err != nil {
+				return err
+			}
+			run.event(scriptMeasure, i, string(groups[0]))
+
+		case scriptSleep:
+			run.event(scriptSleep, i, "")
+			select {
+			case <-time.After(time.Duration(step.Timeout) * time.Millisecond):
+			case <-run.stop:
+				return errCancelled
+			}
+
+		case scriptGoto:
+			next = run.labels[step.Goto]
+
+		case scriptFail:
+			return errors.New(run.expand(step.Message, false))
+
+		case scriptEnd:
+			return nil
+		}
+
+		i = next
+	}
+
+	return nil
+}
+
+// expect will wait for the pattern of the step and return
+// the groups of the match.  The error is errTimeout if
+// the pattern is not found in time.
+func (run *scriptRun) expect(ps *portSession, step ScriptStep) ([][]byte, error) {
+	timeout := defaultExpectTimeout
+	if step.Timeout > 0 {
+		timeout = time.Duration(step.Timeout) * time.Millisecond
+	}
+
+	re, err := regexp.Compile(run.expand(step.Match, true))
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ps.readUntil(func(p []byte) int {
+		if loc := re.FindIndex(p); loc != nil {
+			return loc[1]
+		}
+		return -1
+	}, timeout, 0)
+	if err == errTimeout && step.Else == "" {
+		return nil, errors.New("Timeout waiting for " + re.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	groups := re.FindSubmatch(data)
+	if groups == nil {
+		groups = [][]byte{data}
+	}
+	return groups, nil
+}
+
+// measure will get the value from the groups of the match and
+// compare it with the limits.  It returns an error if the value
+// is not a number or is out of the limits.
+func (run *scriptRun) measure(step ScriptStep, groups [][]byte) error {
+	text := string(groups[0])
+	if len(groups) > 1 {
+		text = string(groups[1])
+	}
+	text = strings.TrimSpace(text)
+
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return errors.New(step.Name + " is not a number: " + text)
+	}
+	run.vars[step.Name] = text
+
+	m := TestMeasurement{
+		Name:  step.Name,
+		Value: value,
+		Min:   step.Min,
+		Max:   step.Max,
+		Units: step.Units,
+		Pass:  (step.Min == nil || value >= *step.Min) && (step.Max == nil || value <= *step.Max),
+	}
+	run.measurements = append(run.measurements, m)
+
+	if !m.Pass {
+		return errors.New(step.Name + " " + text + step.Units + " is out of the limits " + formatLimits(step.Min, step.Max))
+	}
+	return nil
+}
+
+// formatLimits will write the limits as [min, max].
+func formatLimits(min *float64, max *float64) string {
+	s := "["
+	if min != nil {
+		s += strconv.FormatFloat(*min, 'g', -1, 64)
+	}
+	s += ", "
+	if max != nil {
+		s += strconv.FormatFloat(*max, 'g', -1, 64)
+	}
+	return s + "]"
+}
+
+// stopScript will stop the running script.
+func stopScript(id string) bool {
+	scriptRunsMu.Lock()
+	defer scriptRunsMu.Unlock()
+
+	run, isFound := scriptRuns[id]
+	if !isFound {
+		return false
+	}
+	delete(scriptRuns, id)
+	close(run.stop)
+	return true
+}
+
+// stopAllScripts will stop the running scripts.
+func stopAllScripts() {
+	scriptRunsMu.Lock()
+	defer scriptRunsMu.Unlock()
+	for id, run := range scriptRuns {
+		delete(scriptRuns, id)
+		close(run.stop)
+	}
+}
+
+// broadcastScriptEvent will send the script event to all the clients.
+func broadcastScriptEvent(event ScriptEvent) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	echo.wsBroadcast <- b
+}
+
+// scriptCmd will upload, run, stop or list scripts.
+// The progress of a script is sent to all the clients.
+// Cmd: SCRIPT UPLOAD {"Name":"login","Steps":[{"Op":"expect","Match":"login:"}]}
+// Cmd: SCRIPT RUN {"ID":"1","Port":"COM5","Name":"login"}
+// Cmd: SCRIPT STOP 1
+// Cmd: SCRIPT LIST
+func scriptCmd(c *websocketConn, cmd string) {
+	cmds := strings.SplitN(strings.TrimSpace(cmd), " ", 3)
+	if len(cmds) < 2 {
+		log.Println("Could not parse script command: " + cmd)
+		return
+	}
+
+	arg := ""
+	if len(cmds) == 3 {
+		arg = cmds[2]
+	}
+
+	switch strings.ToLower(cmds[1]) {
+	case "upload":
+		s := &Script{}
+		if err := json.Unmarshal([]byte(arg), s); err != nil {
+			replyTo(c, ScriptEvent{Cmd: "Script", Event: "failed", Error: "Bad script. " + err.Error()})
+			return
+		}
+		if _, err := s.validate(); err != nil || s.Name == "" {
+			if err == nil {
+				err = errors.New("The script must have a name")
+			}
+			replyTo(c, ScriptEvent{Cmd: "Script", Name: s.Name, Event: "failed", Error: "Bad script. " + err.Error()})
+			return
+		}
+
+		scriptsMu.Lock()
+		scripts[s.Name] = s
+		scriptsMu.Unlock()
+		log.Println("Script " + s.Name + " uploaded by " + c.identity())
+		replyTo(c, ScriptEvent{Cmd: "Script", Name: s.Name, Event: "uploaded", Ts: time.Now()})
+
+	case "run":
+		var req ScriptRequest
+		if err := json.Unmarshal([]byte(arg), &req); err != nil {
+			replyTo(c, ScriptEvent{Cmd: "Script", Event: "failed", Error: "Bad script request. " + err.Error()})
+			return
+		}
+
+		// Do not block the echo hub while the script runs
+		go func() {
+			run, err := newScriptRun(req, broadcastScriptEvent)
+			if err != nil {
+				replyTo(c, ScriptEvent{Cmd: "Script", ID: req.ID, Name: req.Name, Port: req.Port, Event: "failed", Error: err.Error(), Ts: time.Now()})
+				return
+			}
+			run.run()
+		}()
+
+	case "stop":
+		if !stopScript(strings.TrimSpace(arg)) {
+			log.Println("Could not find the script " + arg + " to stop.")
+		}
+
+	case "list":
+		list := ScriptList{Cmd: "Scripts", Scripts: scriptNames(), Running: []string{}}
+		scriptRunsMu.Lock()
+		for id := range scriptRuns {
+			list.Running = append(list.Running, id)
+		}
+		scriptRunsMu.Unlock()
+		sort.Strings(list.Running)
+		replyTo(c, list)
+
+	default:
+		log.Println("Unknown script command: " + cmd)
+	}
+}
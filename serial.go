@@ -2,25 +2,52 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ricorx7/go-serial"
 )
 
+const (
+	// Size of the buffer to read from the serial port.
+	readBufferSize = 1024
+
+	// Longest BREAK in milliseconds.  The writes to the
+	// port wait while a BREAK is sent.
+	maxBreakMs = 10000
+)
+
 // serialPortIO is the  Serial Port struct.
 // The portIO and serialPort
 // are the same object but use
 // different interfaces.
 type serialPortIO struct {
-	portConf   *SerialConfig      // The serial port configuration
-	portIO     io.ReadWriteCloser // Read, Write and Close interface to read and write to the serial port
-	serialPort *serial.SerialPort // Serial port connection to manage the
-	done       chan bool          // signals the end of this request
-	isClosing  bool               // Keep track of whether we're being actively closed just so we don't show scary error messages
+	portConf     *SerialConfig           // The serial port configuration
+	portIO       io.ReadWriteCloser      // Read, Write and Close interface to read and write to the serial port
+	serialPort   *serial.SerialPort      // Serial port connection to manage the
+	done         chan bool               // signals the end of this request
+	isClosing    bool                    // Keep track of whether we're being actively closed just so we don't show scary error messages
+	history      *historyBuffer          // Recent messages replayed to new clients
+	pubMu        sync.Mutex              // Keeps the sequence numbers in order in the history and the broadcast
+	epoch        uint64                  // Set when the port is opened.  The sequence numbers start again in each epoch.
+	seq          uint64                  // Sequence number of the last message published.  Only changed with the publish lock held.
+	frameMu      sync.Mutex              // Protects the frame reader
+	frameReader  *frameReader            // Splits the data read into records.  Nil to batch the data as it is read.
+	writeMu      sync.Mutex              // Serializes the writes to the serial port
+	sessionLock  chan struct{}           // Held by the open session, so only one session is open at a time
+	sessionMu    sync.Mutex              // Protects the session
+	session      *portSession            // Exclusive session using the port.  Nil if there is none.
+	heldWrites   []heldWrite             // Writes from the clients waiting for the session to end.  Protected by the session lock.
+	isReaderDone bool                    // Set when the reader stops, so no new sessions are started
+	decoderMu    sync.Mutex              // Protects the decoders
+	decoders     map[string]eventDecoder // Decoders publishing events from the data read, by name
+	isDecodeOnly bool                    // Publish only the decoded events, not the data read
 }
 
 // SerialConfig is the Serial Port configuration.
@@ -57,6 +84,7 @@ type SpPortItem struct {
 
 // serialPortHub is the Serial port HUB.
 type serialPortHub struct {
+	mu         sync.RWMutex           // Protects the ports, they are looked up outside the hub
 	ports      map[*serialPortIO]bool // Opened serial ports.
 	write      chan writeRequest      // Write data to serial port
 	register   chan *serialPortIO     // Register requests from the connections.
@@ -67,8 +95,19 @@ type serialPortHub struct {
 // Wrap the message received from
 // the serial port into a JSON struct.
 type SpPortMessage struct {
-	P string // the port, i.e. com22
-	D string // the data, i.e. G0 X0 Y0
+	P     string    // the port, i.e. com22
+	D     string    // the data, i.e. G0 X0 Y0
+	Enc   string    // Encoding of the data.  base64 for binary records, empty for text.
+	Epoch uint64    // Epoch of the port, set each time it is opened
+	Seq   uint64    // Sequence number of the message on the port in the epoch
+	Ts    time.Time // Time the data was read
+}
+
+// stamp will set the epoch, sequence number and time of the message.
+func (m *SpPortMessage) stamp(epoch uint64, seq uint64, ts time.Time) {
+	m.Epoch = epoch
+	m.Seq = seq
+	m.Ts = ts
 }
 
 // writeRequest will send a Write request.
@@ -77,8 +116,34 @@ type SpPortMessage struct {
 // be sent to.  The serial port can be found
 // by the name with the findPortByName().
 type writeRequest struct {
-	p *serialPortIO // Serial Port
-	d string        // Data
+	p       *serialPortIO  // Serial Port
+	d       string         // Data
+	from    string         // Identity of the client that sent the data
+	c       *websocketConn // Client told when the write is refused.  Nil if not sent by a client.
+	breakMs int            // Send a BREAK for this many milliseconds instead of the data
+}
+
+// SpSentMessage is broadcast when data is written
+// to the serial port.  This lets all the clients
+// see the commands sent by the other clients.
+type SpSentMessage struct {
+	Cmd     string    // Sent
+	P       string    // the port, i.e. com22
+	D       string    // the data written, i.e. CSHOW
+	Enc     string    // Encoding of the data.  base64 for binary data written by a session, empty for text.
+	Epoch   uint64    // Epoch of the port, set each time it is opened
+	Seq     uint64    // Sequence number of the message on the port in the epoch
+	Ts      time.Time // Time the data was written
+	From    string    // Identity of the client that sent the data
+	Break   bool      // Set if a BREAK was sent instead of data
+	BreakMs int       // Duration of the BREAK in milliseconds
+}
+
+// stamp will set the epoch, sequence number and time of the message.
+func (m *SpSentMessage) stamp(epoch uint64, seq uint64, ts time.Time) {
+	m.Epoch = epoch
+	m.Seq = seq
+	m.Ts = ts
 }
 
 // serialHub is the Serial Port hub.
@@ -95,21 +160,26 @@ func (sh *serialPortHub) run() {
 
 	log.Print("Inside run of serialhub")
 
+	// Publish the Sent events without blocking the hub
+	go publishSent()
+
 	for {
 		select {
 		// Register a port
 		case p := <-sh.register:
 			log.Print("Registering a port: ", p.portConf.Name)
-			echo.wsBroadcast <- []byte("{\"Cmd\":\"Open\",\"Desc\":\"Got register/open on port.\",\"Port\":\"" + p.portConf.Name + ",\"Baud\":" + strconv.Itoa(p.portConf.Baud) + "}")
+			tryBroadcast([]byte("{\"Cmd\":\"Open\",\"Desc\":\"Got register/open on port.\",\"Port\":\"" + p.portConf.Name + ",\"Baud\":" + strconv.Itoa(p.portConf.Baud) + "}"))
 
 			// Register the serial port with the map
+			sh.mu.Lock()
 			sh.ports[p] = true
+			sh.mu.Unlock()
 			log.Println("Serial Port registered")
 
 			// Unregister a port
 		case p := <-sh.unregister:
 			log.Print("Unregistering a port: ", p.portConf.Name)
-			echo.wsBroadcast <- []byte("{\"Cmd\":\"Close\",\"Desc\":\"Got unregister/close on port.\",\"Port\":\"" + p.portConf.Name + "\",\"Baud\":" + strconv.Itoa(p.portConf.Baud) + "}")
+			tryBroadcast([]byte("{\"Cmd\":\"Close\",\"Desc\":\"Got unregister/close on port.\",\"Port\":\"" + p.portConf.Name + "\",\"Baud\":" + strconv.Itoa(p.portConf.Baud) + "}"))
 
 			// Set flag that the serial port is closing
 			// so any loops can stops
@@ -119,7 +189,9 @@ func (sh *serialPortHub) run() {
 			p.serialPort.Close()
 
 			// Delete the serial port from the map
+			sh.mu.Lock()
 			delete(sh.ports, p)
+			sh.mu.Unlock()
 
 			// Write to the serial port
 		case wr := <-sh.write:
@@ -158,19 +230,28 @@ func openSerialPort(portname string, baud int) {
 
 	// Create the serial port IO struct
 	spio := &serialPortIO{
-		portConf:   config, // Port configuration
-		portIO:     sp,     // Serial port IO.ReadWriteCloser interface
-		serialPort: sp,     // Serial port hardware commands
-		isClosing:  false,  // Set flag that the port is not closed
+		portConf:    config, // Port configuration
+		portIO:      sp,     // Serial port IO.ReadWriteCloser interface
+		serialPort:  sp,     // Serial port hardware commands
+		isClosing:   false,  // Set flag that the port is not closed
+		history:     newHistoryBuffer(*historyBytes, *historyLines),
+		epoch:       newEpoch(),
+		sessionLock: make(chan struct{}, 1),
+		decoders:    make(map[string]eventDecoder),
 	}
 
 	// Register the serial port
 	serialHub.register <- spio
+	runPortHooks(hookOpen, portname)
+
+	// Wake up or set up the device
+	go runOnOpen(portname)
 
 	// Unregister the serial port when shutdown
 	defer func() {
 		log.Println("Shutting down the serialPortIO")
 		serialHub.unregister <- spio
+		runPortHooks(hookClose, portname)
 	}()
 
 	log.Println("Serial Port Reader started")
@@ -200,12 +281,25 @@ func closeSerialPort(portName string) {
 // Will loop through waiting for data and
 // and Read will unblock until data is available.
 // It will then send the data to the websocket.
+// The data is batched so a fast port does not
+// send many small messages.
 func (spio *serialPortIO) reader() {
 
-	for {
-		//var buf bytes.Buffer
-		ch := make([]byte, 1024)
+	// Reuse the read buffer, the batcher copies the data
+	ch := make([]byte, readBufferSize)
+	batcher := newReadBatcher(spio, *batchSize, *batchLatency)
 
+	// Publish any data left in the batch or partial record
+	// and let an open session know the port is closed
+	defer func() {
+		spio.closeSessionInput()
+		batcher.flush()
+		if fr := spio.getFrameReader(); fr != nil {
+			fr.flush()
+		}
+	}()
+
+	for {
 		// Read in data
 		n, err := spio.portIO.Read(ch)
 
@@ -228,21 +322,31 @@ func (spio *serialPortIO) reader() {
 			}
 
 			//log.Print("Read " + strconv.Itoa(n) + " bytes ch: " + string(ch))
-			// Set the incoming data to a string and trim blank
-			data := string(ch[:n])
+			// Give the data to the open session instead of broadcasting it
+			if spio.deliverSession(ch[:n]) {
+				continue
+			}
 
-			// Create a JSON message of the data
-			m := SpPortMessage{spio.portConf.Name, data}
-			b, err := json.Marshal(m)
-			if err != nil {
-				log.Println(err)
-				echo.wsBroadcast <- []byte("Error creating json on " + spio.portConf.Name + " " +
-					err.Error() + " The data we were trying to convert is: " + string(ch[:n]))
-				break
+			// Let the Lua hooks rewrite or drop the data
+			data := runDataHooks(spio.portConf.Name, ch[:n])
+			if len(data) == 0 {
+				continue
+			}
+
+			// Decode the data into events, and stop here
+			// if only the events are published
+			if spio.runDecoders(data) {
+				continue
 			}
 
-			// Broadcast the JSON data
-			echo.wsBroadcast <- b
+			// Split the data into records if framing is
+			// set, otherwise add the data to the batch
+			if fr := spio.getFrameReader(); fr != nil {
+				batcher.flush()
+				fr.write(data)
+			} else {
+				batcher.write(data)
+			}
 		}
 	}
 }
@@ -250,32 +354,157 @@ func (spio *serialPortIO) reader() {
 // write the data to the serial port.
 // This will take a writeRequest.  The writeRequest
 // will include the serial port pointer.
-// It will also check if the command is a BREAK.
+// A BREAK is sent instead if the request has a duration.
 func write(wr writeRequest, id string) {
 	log.Println("serial write port: " + wr.p.portConf.Name)
 	log.Println("serial Write: " + wr.d)
 
-	// Check if the command is a BREAK
-	cmdU := strings.ToUpper(wr.d)
-	if cmdU == "BREAK" {
-		wr.p.serialPort.SendBreak(400)
+	// Hold the write until the session using the port ends
+	if wr.p.holdWrite(wr) {
 		return
 	}
+	writeNow(wr)
+}
+
+// writeNow will write the data, or send the BREAK, to the
+// serial port without checking for a session.
+func writeNow(wr writeRequest) {
+	// Send a BREAK
+	if wr.breakMs > 0 {
+		if err := wr.p.sendBreak(wr.breakMs); err != nil {
+			log.Println("Error sending a BREAK to " + wr.p.portConf.Name + ". " + err.Error())
+			spErrTo(wr.c, "Error sending a BREAK to "+wr.p.portConf.Name+". "+err.Error())
+			return
+		}
+		broadcastSent(wr, true)
+		return
+	}
+
+	// Wrap the data in a frame if the port uses binary framing
+	data := []byte(wr.d)
+	if fr := wr.p.getFrameReader(); fr != nil && fr.encoder != nil {
+		var err error
+		if data, err = fr.encoder.encode(data); err != nil {
+			log.Println("Write to " + wr.p.portConf.Name + " refused. " + err.Error())
+			spErrTo(wr.c, "Write to "+wr.p.portConf.Name+" refused. "+err.Error())
+			return
+		}
+	}
 
 	// FINALLY, OF ALL THE CODE IN THIS PROJECT
 	// WE TRULY/FINALLY GET TO WRITE TO THE SERIAL PORT!
-	wr.p.portIO.Write([]byte(wr.d))
+	wr.p.writeData(data)
+	broadcastSent(wr, false)
+}
+
+// writeData will write the data to the serial port.
+// The writes from the hub and the sessions are serialized.
+func (spio *serialPortIO) writeData(p []byte) (int, error) {
+	spio.writeMu.Lock()
+	defer spio.writeMu.Unlock()
+	return spio.portIO.Write(p)
+}
+
+// sendBreak will hold the serial port TX line low for
+// the milliseconds.  It is serialized with the writes.
+func (spio *serialPortIO) sendBreak(ms int) error {
+	if err := checkBreakMs(ms); err != nil {
+		return err
+	}
+	spio.writeMu.Lock()
+	defer spio.writeMu.Unlock()
+	return spio.serialPort.SendBreak(ms)
+}
+
+// spErr will broadcast the error to all the websocket clients.
+func spErr(err string) {
+	b, _ := json.Marshal(map[string]string{"Error": err})
+	tryBroadcast(b)
+}
+
+// spErrTo will send the error to the websocket client, or
+// to all the clients if it was not sent by a client.  Like
+// spErr, the serial hub is never blocked by the echo hub.
+func spErrTo(c *websocketConn, err string) {
+	if c == nil {
+		spErr(err)
+		return
+	}
+	b, _ := json.Marshal(map[string]string{"Error": err})
+	select {
+	case echo.reply <- wsReply{c: c, d: b}:
+	default:
+		log.Println("Reply is full, error dropped: " + err)
+	}
+}
+
+// tryBroadcast will send the message to all the websocket clients
+// if the echo hub can take it.  The serial hub uses this so it is
+// never blocked by the echo hub, which may be waiting on it.
+func tryBroadcast(b []byte) {
+	select {
+	case echo.wsBroadcast <- b:
+	default:
+		log.Println("Broadcast is full, message dropped: " + string(b))
+	}
+}
+
+// sentMessage is a Sent event waiting to be published.
+type sentMessage struct {
+	p *serialPortIO
+	m *SpSentMessage
+}
+
+// sentQueue holds the Sent events until they are published.
+// The serial hub and the sessions never wait on the echo hub.
+var sentQueue = make(chan sentMessage, 1000)
+
+// publishSent will publish the Sent events in the order they were queued.
+func publishSent() {
+	for s := range sentQueue {
+		if err := s.p.publish(s.m, s.m.D); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// queueSent will queue the Sent event to be published.
+// It is dropped if the queue is full.
+func queueSent(p *serialPortIO, m *SpSentMessage) {
+	m.Cmd = "Sent"
+	m.P = p.portConf.Name
+	select {
+	case sentQueue <- sentMessage{p: p, m: m}:
+	default:
+		log.Println("Sent queue is full, Sent event dropped for " + p.portConf.Name)
+	}
+}
+
+// broadcastSent will let all the websocket clients
+// know data was written to the serial port and
+// which client sent it.
+func broadcastSent(wr writeRequest, isBreak bool) {
+	queueSent(wr.p, &SpSentMessage{
+		D:       wr.d,
+		From:    wr.from,
+		Break:   isBreak,
+		BreakMs: wr.breakMs,
+	})
 }
 
 // spWrite will write data to the serial port.
 // This will take a 3 parameters.
 // SEND [portName] [cmd]
+// SEND:[none|cr|lf|crlf] [portName] [cmd]
 // SEND is the command to send data to the serial port.
+// The line ending of the port is added to the command,
+// unless one is given after SEND.
 // portName is the serial port name.  eg. COM5
 // CMD is the command to accomplish.  eg. CSHOW
+// Escapes such as \x03 and \e in the command are replaced.
 // It will then construct the writeRequest to send the data
-// to the serial port.
-func spWrite(arg string) {
+// to the serial port.  c is the client that sent the command.
+func spWrite(arg string, c *websocketConn) {
 	log.Println("Inside spWrite arg: " + arg)
 	// Trim the command
 	arg = strings.TrimPrefix(arg, " ")
@@ -291,6 +520,17 @@ func spWrite(arg string) {
 	// Get the portname
 	portname := strings.Trim(args[1], " ")
 	log.Println("The port to write to is:" + portname + "---")
+
+	// Get the line ending given with the command
+	ending := ""
+	if i := strings.Index(args[0], ":"); i >= 0 {
+		var err error
+		if ending, err = checkLineEnding(args[0][i+1:]); err != nil {
+			log.Println(err)
+			spErr(err.Error())
+			return
+		}
+	}
 	log.Println("The data is:" + args[2] + "---")
 
 	//see if we have this port open
@@ -310,8 +550,19 @@ func spWrite(arg string) {
 	// Set the serial port
 	wr.p = spio
 
-	// include newline and trim the end
-	wr.d = strings.Trim(args[2], "") + "\r"
+	// Set who sent the data
+	wr.from = c.identity()
+	wr.c = c
+
+	// Replace the line ending the client sent with the one
+	// of the port.  Binary framed data does not need one.
+	wr.d = parseEscapes(strings.TrimRight(args[2], "\r\n"))
+	if fr := spio.getFrameReader(); fr == nil || fr.encoder == nil {
+		if ending == "" {
+			ending = portLineEnding(portname)
+		}
+		wr.d += lineEndingNames[ending]
+	}
 
 	log.Println("spWRite to serial port " + wr.d)
 
@@ -319,11 +570,68 @@ func spWrite(arg string) {
 	serialHub.write <- wr
 }
 
+// checkBreakMs will check the duration of a BREAK.
+func checkBreakMs(ms int) error {
+	if ms <= 0 || ms > maxBreakMs {
+		return errors.New("Bad BREAK duration " + strconv.Itoa(ms) + ", use 1 to " + strconv.Itoa(maxBreakMs) + " ms")
+	}
+	return nil
+}
+
+// spBreak will send a BREAK to the serial port.
+// BREAK [portName] [ms]
+// ms is the duration of the BREAK in milliseconds, up to 10000.
+// The -break-ms flag is used if it is not given.
+// c is the client that sent the command.
+func spBreak(arg string, c *websocketConn) {
+	args := strings.Fields(arg)
+	if len(args) < 2 || len(args) > 3 {
+		log.Println("Could not parse break command: " + arg)
+		spErrTo(c, "Could not parse break command: "+arg)
+		return
+	}
+
+	ms := *breakMs
+	if len(args) == 3 {
+		var err error
+		if ms, err = strconv.Atoi(args[2]); err != nil {
+			log.Println("Bad BREAK duration: " + args[2])
+			spErrTo(c, "Bad BREAK duration: "+args[2])
+			return
+		}
+	}
+	if err := checkBreakMs(ms); err != nil {
+		log.Println(err)
+		spErrTo(c, err.Error())
+		return
+	}
+
+	spio, isFound := findPortByName(args[1])
+	if !isFound {
+		log.Println("We could not find the serial port " + args[1] + " to send a BREAK to.")
+		return
+	}
+
+	serialHub.write <- writeRequest{p: spio, from: c.identity(), c: c, breakMs: ms}
+}
+
+// openPorts will get a list of the open serial ports.
+func (sh *serialPortHub) openPorts() []*serialPortIO {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	ports := make([]*serialPortIO, 0, len(sh.ports))
+	for port := range sh.ports {
+		ports = append(ports, port)
+	}
+	return ports
+}
+
 // findPortByName will find the serial port by the name.
 // This will check the map for the serial port pointer.
 func findPortByName(portname string) (*serialPortIO, bool) {
 	portnamel := strings.ToLower(portname)
-	for port := range serialHub.ports {
+	for _, port := range serialHub.openPorts() {
 		if strings.ToLower(port.portConf.Name) == portnamel {
 			// we found our port
 			return port, true
@@ -332,6 +640,24 @@ func findPortByName(portname string) (*serialPortIO, bool) {
 	return nil, false
 }
 
+// portSerialNumber will get the serial number of the
+// device on the serial port.  It is empty if not known.
+func portSerialNumber(portname string) string {
+	list, _ := GetList()
+	metaports, _ := GetMetaList()
+
+	for _, item := range list {
+		if strings.EqualFold(item.Name, portname) {
+			pi := SpPortItem{Name: item.Name, SerialNumber: item.SerialNumber}
+			if len(metaports) > 0 {
+				setMetaData(&pi, metaports)
+			}
+			return pi.SerialNumber
+		}
+	}
+	return ""
+}
+
 // serialPortList will get the Serial Port list.
 // It will then broadcast the serial port list to the
 // websocket.
@@ -345,7 +671,7 @@ func serialPortList() {
 	// happen on windows in a fallback scenario where an
 	// open port can't be identified because it is locked,
 	// so just solve that by manually inserting
-	for port := range serialHub.ports {
+	for _, port := range serialHub.openPorts() {
 
 		isFound := false
 		for _, item := range list {
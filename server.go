@@ -0,0 +1,346 @@
+///
+/// Server commands: baud rates, hostname, version,
+/// and the restart and exit allowed to the admins.
+/// The server shuts down cleanly on exit, SIGINT or SIGTERM.
+///
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Server actions requested by the admins.
+const (
+	actionRestart = "restart"
+	actionExit    = "exit"
+)
+
+const (
+	// Time to wait for a serial port to close.
+	portCloseTimeout = 5 * time.Second
+
+	// Reason sent to the clients in the close frame.
+	shutdownReason = "Server shutting down"
+)
+
+var (
+	// The restart or exit requested by an admin
+	serverActions = make(chan string, 1)
+
+	// Closed when the server starts to shut down
+	shuttingDown = make(chan struct{})
+
+	// Number of transfers, scripts and tests running
+	runningWork int64
+)
+
+// BaudRateList is the list of baud rates supported on this platform.
+type BaudRateList struct {
+	Cmd       string // BaudRates
+	BaudRates []int
+}
+
+// HostnameInfo is the name of the machine running the server.
+type HostnameInfo struct {
+	Cmd      string // Hostname
+	Hostname string
+	Error    string // Why the hostname could not be read
+}
+
+// VersionInfo is the build of the server.
+type VersionInfo struct {
+	Cmd       string // Version
+	Version   string
+	Commit    string // Git commit the server was built from
+	Modified  bool   // Set if the tree had changes not committed
+	BuildTime string // Time of the commit
+	GoVersion string
+}
+
+// ServerEvent is sent to all the clients when an admin restarts
+// or stops the server, and to a client whose request is refused.
+type ServerEvent struct {
+	Cmd   string // Server
+	Event string // restart, exit or refused
+	From  string // Identity of the client that asked
+	Error string // Why the request was refused
+	Ts    time.Time
+}
+
+// getVersion will get the version and the git commit.  The commit
+// is set with -ldflags "-X main.gitCommit=...", or read from the
+// build information Go adds when built in a git tree.
+func getVersion() VersionInfo {
+	info := VersionInfo{Cmd: "Version", Version: version, Commit: gitCommit, GoVersion: runtime.Version()}
+
+	if bi, isFound := debug.ReadBuildInfo(); isFound {
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+				}
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			case "vcs.time":
+				info.BuildTime = s.Value
+			}
+		}
+	}
+	return info
+}
+
+// isAdmin will check if the client can restart and stop the
+// server.  The client must be named in -admins by a verified
+// certificate, or be on the loopback address with -admin-loopback.
+func (wsConn *websocketConn) isAdmin() bool {
+	if *adminLoopback {
+		host, _, err := net.SplitHostPort(wsConn.remoteAddr)
+		if ip := net.ParseIP(host); err == nil && ip != nil && ip.IsLoopback() {
+			return true
+		}
+	}
+
+	if !wsConn.isVerified {
+		return false
+	}
+	for _, name := range strings.Split(*admins, ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 && name == wsConn.getName() {
+			return true
+		}
+	}
+	return false
+}
+
+// serverCmd will run the server commands.
+// Cmd: BAUDRATES
+// Cmd: HOSTNAME
+// Cmd: VERSION
+// Cmd: RESTART
+// Cmd: EXIT
+func serverCmd(c *websocketConn, cmd string) {
+	action := strings.ToLower(strings.TrimSpace(cmd))
+	switch action {
+	case "baudrates":
+		replyTo(c, BaudRateList{Cmd: "BaudRates", BaudRates: supportedBaudRates})
+
+	case "hostname":
+		info := HostnameInfo{Cmd: "Hostname"}
+		name, err := os.Hostname()
+		if err != nil {
+			info.Error = err.Error()
+		}
+		info.Hostname = name
+		replyTo(c, info)
+
+	case "version":
+		replyTo(c, getVersion())
+
+	case actionRestart, actionExit:
+		if !c.isAdmin() {
+			log.Println("Refused " + action + " from " + c.identity() + ", not an admin")
+			replyTo(c, ServerEvent{Cmd: "Server", Event: "refused", From: c.identity(), Error: "Only an admin can " + action + " the server", Ts: time.Now()})
+			return
+		}
+
+		select {
+		case serverActions <- action:
+			log.Println("Server " + action + " requested by " + c.identity())
+			replyTo(c, ServerEvent{Cmd: "Server", Event: action, From: c.identity(), Ts: time.Now()})
+		default:
+			replyTo(c, ServerEvent{Cmd: "Server", Event: "refused", From: c.identity(), Error: "A restart or exit is already running", Ts: time.Now()})
+		}
+
+	default:
+		log.Println("Unknown server command: " + cmd)
+	}
+}
+
+// runServer will serve HTTP until an admin stops the server or
+// the context is done.  On a restart, the listener is shut down,
+// the work on the serial ports is cancelled, the ports are closed
+// and opened again, then the listener is started.
+func runServer(ctx context.Context, tlsConfig *tls.Config) {
+	for {
+		server := &http.Server{Addr: *addr, TLSConfig: tlsConfig}
+
+		serveErr := make(chan error, 1)
+		go func() {
+			// Certificates are given through the TLS config
+			if server.TLSConfig != nil {
+				serveErr <- server.ListenAndServeTLS("", "")
+			} else {
+				serveErr <- server.ListenAndServe()
+			}
+		}()
+
+		var action string
+		select {
+		case err := <-serveErr:
+			fmt.Printf("Error trying to bind to port: %v, so exiting...", err)
+			log.Fatal("Error ListenAndServe:", err)
+
+		case <-ctx.Done():
+			// A second signal stops the server at once
+			signal.Reset(os.Interrupt, syscall.SIGTERM)
+			log.Println("Signal received")
+			action = actionExit
+
+		case action = <-serverActions:
+		}
+
+		if action == actionExit {
+			shutdown(server)
+			log.Println("Server stopped")
+			return
+		}
+
+		log.Println("Shutting down the listener to restart")
+		stopServing(server, time.Now().Add(*shutdownTimeout))
+		restartPorts()
+		log.Println("Server restarted")
+	}
+}
+
+// isShuttingDown will check if the server is shutting down.
+func isShuttingDown() bool {
+	select {
+	case <-shuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+// beginWork will count a transfer, script or test as running,
+// so the shutdown can wait for it to end.
+func beginWork() {
+	atomic.AddInt64(&runningWork, 1)
+}
+
+// endWork will count a transfer, script or test as ended.
+func endWork() {
+	atomic.AddInt64(&runningWork, -1)
+}
+
+// shutdown will stop accepting connections, cancel the transfers,
+// scripts and tests, close the websockets with a close frame and
+// close the serial ports.  It waits up to -shutdown-timeout for
+// the work to end and the clients to be sent what is left.
+// A file being received is kept with its partial suffix.
+func shutdown(server *http.Server) {
+	log.Println("Shutting down")
+	deadline := time.Now().Add(*shutdownTimeout)
+	close(shuttingDown)
+
+	stopServing(server, deadline)
+
+	echo.closeClients(shutdownReason, deadline)
+	closeAllPorts()
+}
+
+// stopServing will stop accepting connections, cancel the
+// transfers, scripts and tests, and wait until the deadline
+// for them and the sessions on the serial ports to end, so
+// the ports can be closed.
+func stopServing(server *http.Server, deadline time.Time) {
+	// Stop accepting connections while the work is cancelled.
+	// The HTTP requests running a transfer end when it is cancelled.
+	listenerDone := make(chan struct{})
+	go func() {
+		shutdownListener(server, deadline)
+		close(listenerDone)
+	}()
+
+	cancelAllTransfers()
+	stopAllScripts()
+	stopAllTestStations()
+	for atomic.LoadInt64(&runningWork) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&runningWork); n > 0 {
+		log.Println(strconv.FormatInt(n, 10) + " transfers, scripts or tests did not end in time")
+	}
+	<-listenerDone
+
+	waitSessions(deadline)
+}
+
+// waitSessions will wait until the deadline for the sessions
+// on the open serial ports to end, eg. a Modbus request.
+// The session lock of each port is kept, so no session
+// starts before the port is closed.
+func waitSessions(deadline time.Time) {
+	for _, spio := range serialHub.openPorts() {
+		select {
+		case spio.sessionLock <- struct{}{}:
+			continue
+		default:
+		}
+
+		select {
+		case spio.sessionLock <- struct{}{}:
+		case <-time.After(time.Until(deadline)):
+			log.Println("Session on " + spio.portConf.Name + " did not end in time")
+		}
+	}
+}
+
+// shutdownListener will stop accepting connections and wait
+// until the deadline for the HTTP requests to finish.
+func shutdownListener(server *http.Server, deadline time.Time) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Error shutting down the listener. " + err.Error())
+	}
+}
+
+// closeAllPorts will close the open serial ports and wait for
+// them to close.  It returns the ports that were open.
+func closeAllPorts() []SerialConfig {
+	var closed []SerialConfig
+	for _, spio := range serialHub.openPorts() {
+		closed = append(closed, *spio.portConf)
+		serialHub.unregister <- spio
+	}
+
+	deadline := time.Now().Add(portCloseTimeout)
+	for _, conf := range closed {
+		for {
+			if _, isFound := findPortByName(conf.Name); !isFound {
+				break
+			}
+			if time.Now().After(deadline) {
+				log.Println("Serial port " + conf.Name + " did not close")
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return closed
+}
+
+// restartPorts will close the open serial ports
+// and open them again with the same baud rate.
+func restartPorts() {
+	for _, conf := range closeAllPorts() {
+		log.Println("Opening the serial port " + conf.Name + " again")
+		go openSerialPort(conf.Name, conf.Baud)
+	}
+}
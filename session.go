@@ -0,0 +1,320 @@
+///
+/// Exclusive sessions on a serial port for
+/// request and response protocols.
+///
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"log"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// Number of reads buffered for a session.
+	sessionBufferSize = 256
+
+	// Number of writes from the clients held while a session
+	// is open.  More writes are refused.
+	maxHeldWrites = 256
+
+	// Time a write is held while a session is open.  An older
+	// write is dropped when the session ends.
+	heldWriteTimeout = 30 * time.Second
+)
+
+// errPortBusy is returned when the serial port
+// is used by another session.
+var errPortBusy = errors.New("Serial port is busy")
+
+// errPortClosed is returned when the serial port
+// is closed during a session.
+var errPortClosed = errors.New("Serial port closed")
+
+// errTimeout is returned when the data is not
+// read from the serial port in time.
+var errTimeout = errors.New("Timeout waiting for the serial port")
+
+// errCancelled is returned when the owner of the
+// session cancels a read.
+var errCancelled = errors.New("Cancelled")
+
+// errIdle is returned when no data is read from
+// the serial port for the idle time.
+var errIdle = errors.New("Serial port is idle")
+
+// portSession gives a single caller exclusive use of a
+// serial port.  While the session is open, the data read
+// from the port is given to the session instead of being
+// broadcast, and writes from the clients are held until it ends.
+type portSession struct {
+	spio    *serialPortIO   // Serial port used by the session
+	owner   string          // What is using the port, eg. modbus
+	in      chan []byte     // Data read from the port.  Closed when the port closes.
+	pending []byte          // Data read from the port not used yet
+	cancel  <-chan struct{} // Closed by the owner to stop a read.  nil if not used.
+}
+
+// openSession will start an exclusive session on the
+// serial port.  It will wait up to the given time for
+// another session to finish.
+func (spio *serialPortIO) openSession(owner string, wait time.Duration) (*portSession, error) {
+	select {
+	case spio.sessionLock <- struct{}{}:
+	case <-time.After(wait):
+		return nil, errPortBusy
+	}
+
+	ps := &portSession{
+		spio:  spio,
+		owner: owner,
+		in:    make(chan []byte, sessionBufferSize),
+	}
+
+	spio.sessionMu.Lock()
+	if spio.isReaderDone {
+		spio.sessionMu.Unlock()
+		<-spio.sessionLock
+		return nil, errPortClosed
+	}
+	spio.session = ps
+	spio.sessionMu.Unlock()
+
+	log.Println("Session " + owner + " started on " + spio.portConf.Name)
+	return ps, nil
+}
+
+// heldWrite is a write from a client waiting for the session to end.
+type heldWrite struct {
+	wr writeRequest
+	at time.Time // Time the write was held
+}
+
+// holdWrite will hold the write if a session is open on the
+// serial port.  It returns false if there is no session and
+// the write can be sent now.  The write is refused if too many
+// are held.
+func (spio *serialPortIO) holdWrite(wr writeRequest) bool {
+	spio.sessionMu.Lock()
+	defer spio.sessionMu.Unlock()
+
+	ps := spio.session
+	if ps == nil {
+		return false
+	}
+
+	if len(spio.heldWrites) >= maxHeldWrites {
+		log.Println("Serial port " + spio.portConf.Name + " is busy with " + ps.owner + ", write refused")
+		spErrTo(wr.c, "Serial port "+spio.portConf.Name+" is busy with "+ps.owner+", write refused")
+		return true
+	}
+
+	log.Println("Serial port " + spio.portConf.Name + " is busy with " + ps.owner + ", write held")
+	spio.heldWrites = append(spio.heldWrites, heldWrite{wr: wr, at: time.Now()})
+	return true
+}
+
+// getSession will get the open session on the serial port.
+// It returns nil if there is no session.
+func (spio *serialPortIO) getSession() *portSession {
+	spio.sessionMu.Lock()
+	defer spio.sessionMu.Unlock()
+	return spio.session
+}
+
+// deliverSession will give the data read from the serial
+// port to the open session.  It returns false if there is
+// no session and the data must be broadcast.
+// This must only be called from the port reader.
+func (spio *serialPortIO) deliverSession(p []byte) bool {
+	ps := spio.getSession()
+	if ps == nil {
+		return false
+	}
+
+	data := make([]byte, len(p))
+	copy(data, p)
+
+	select {
+	case ps.in <- data:
+	default:
+		log.Println("Session " + ps.owner + " on " + spio.portConf.Name + " is not reading, data dropped")
+	}
+	return true
+}
+
+// closeSessionInput will let the open session know the
+// serial port is closed.
+// This must only be called from the port reader when it stops.
+func (spio *serialPortIO) closeSessionInput() {
+	spio.sessionMu.Lock()
+	defer spio.sessionMu.Unlock()
+
+	spio.isReaderDone = true
+	if spio.session != nil {
+		close(spio.session.in)
+	}
+}
+
+// close will end the session and let the data
+// read from the serial port be broadcast again.
+// The writes held while it was open are sent first.
+// The session lock is held while they are sent, so
+// they go out before any new write.
+func (ps *portSession) close() {
+	ps.spio.sessionMu.Lock()
+	ps.spio.session = nil
+	for _, hw := range ps.spio.heldWrites {
+		if time.Since(hw.at) > heldWriteTimeout {
+			log.Println("Held write to " + ps.spio.portConf.Name + " dropped, the port was busy for too long")
+			spErrTo(hw.wr.c, "Write to "+ps.spio.portConf.Name+" dropped, the port was busy with "+ps.owner+" for too long")
+			continue
+		}
+		writeNow(hw.wr)
+	}
+	ps.spio.heldWrites = nil
+	ps.spio.sessionMu.Unlock()
+
+	log.Println("Session " + ps.owner + " ended on " + ps.spio.portConf.Name)
+	<-ps.spio.sessionLock
+}
+
+// write will write the data to the serial port.  The clients
+// are sent a Sent event from the owner of the session.
+func (ps *portSession) write(p []byte) error {
+	if _, err := ps.spio.writeData(p); err != nil {
+		return err
+	}
+
+	m := &SpSentMessage{D: string(p), From: ps.owner}
+	if !utf8.Valid(p) {
+		m.D = base64.StdEncoding.EncodeToString(p)
+		m.Enc = "base64"
+	}
+	queueSent(ps.spio, m)
+	return nil
+}
+
+// sendBreak will send a BREAK of the milliseconds to the serial port.
+func (ps *portSession) sendBreak(ms int) error {
+	if err := ps.spio.sendBreak(ms); err != nil {
+		return err
+	}
+	queueSent(ps.spio, &SpSentMessage{From: ps.owner, Break: true, BreakMs: ms})
+	return nil
+}
+
+// discard will drop any data read from the serial port
+// that was not used yet.
+func (ps *portSession) discard() {
+	ps.pending = nil
+	for {
+		select {
+		case _, ok := <-ps.in:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// fill will wait for more data from the serial port
+// and add it to the pending data.
+func (ps *portSession) fill(deadline *time.Timer) error {
+	select {
+	case data, ok := <-ps.in:
+		if !ok {
+			return errPortClosed
+		}
+		ps.pending = append(ps.pending, data...)
+		return nil
+	case <-deadline.C:
+		return errTimeout
+	case <-ps.cancel:
+		return errCancelled
+	}
+}
+
+// read will read exactly n bytes from the serial port.
+// It returns an error if the bytes are not read within
+// the timeout.
+func (ps *portSession) read(n int, timeout time.Duration) ([]byte, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for len(ps.pending) < n {
+		if err := ps.fill(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	data := ps.pending[:n:n]
+	ps.pending = ps.pending[n:]
+	return data, nil
+}
+
+// waitData will wait for data to be read from the serial
+// port.  The data is kept to be read.  It returns an error
+// if no data is read within the timeout.
+func (ps *portSession) waitData(timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for len(ps.pending) == 0 {
+		if err := ps.fill(deadline); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readUntil will read from the serial port until the match
+// function finds the end of the response.  The match function
+// is given all the data read so far and returns the length of
+// the response, or -1 if the response is not complete.
+// The read stops with errTimeout after the timeout, or if
+// idle is not 0, with errIdle when no data is read for the idle time.
+// The data read so far is returned with the error.
+func (ps *portSession) readUntil(match func([]byte) int, timeout time.Duration, idle time.Duration) ([]byte, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		if n := match(ps.pending); n >= 0 {
+			data := ps.pending[:n:n]
+			ps.pending = ps.pending[n:]
+			return data, nil
+		}
+
+		var idleC <-chan time.Time
+		if idle > 0 {
+			idleC = time.After(idle)
+		}
+
+		select {
+		case data, ok := <-ps.in:
+			if !ok {
+				return ps.takePending(), errPortClosed
+			}
+			ps.pending = append(ps.pending, data...)
+		case <-deadline.C:
+			return ps.takePending(), errTimeout
+		case <-idleC:
+			return ps.takePending(), errIdle
+		case <-ps.cancel:
+			return ps.takePending(), errCancelled
+		}
+	}
+}
+
+// takePending will get and clear the pending data.
+func (ps *portSession) takePending() []byte {
+	data := ps.pending
+	ps.pending = nil
+	return data
+}
@@ -0,0 +1,624 @@
+///
+/// Flash STM32 devices with the ROM bootloader on the UART (AN3155).
+/// The RTS and DTR lines drive BOOT0 and NRST to start the bootloader.
+///
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ricorx7/go-serial"
+)
+
+// STM32 bootloader bytes.
+const (
+	stm32Sync = 0x7F // Starts the bootloader and sets the baud rate
+	stm32ACK  = 0x79 // Command accepted
+	stm32NACK = 0x1F // Command refused
+)
+
+// STM32 bootloader commands.
+const (
+	stm32Get           = 0x00 // Bootloader version and commands
+	stm32GetID         = 0x02 // Product ID
+	stm32ReadMemory    = 0x11 // Read up to 256 bytes
+	stm32Go            = 0x21 // Jump to the application
+	stm32WriteMemory   = 0x31 // Write up to 256 bytes
+	stm32Erase         = 0x43 // Erase with 1 byte page numbers
+	stm32ExtendedErase = 0x44 // Erase with 2 byte page numbers
+)
+
+const (
+	// Most bytes read or written by a command.
+	stm32BlockSize = 256
+
+	// Default address of the flash memory.
+	stm32FlashAddress = 0x08000000
+
+	// Time to wait for the bootloader to answer a command.
+	stm32AckTimeout = time.Second
+
+	// Time to wait for a mass erase.  Large devices take 30 seconds.
+	stm32EraseTimeout = 40 * time.Second
+
+	// Times the sync byte is sent before the flash fails.
+	stm32SyncRetries = 5
+
+	// Time NRST is held to reset the device, and the time
+	// the bootloader takes to start after the reset.
+	stm32ResetPulse = 50 * time.Millisecond
+	stm32BootDelay  = 100 * time.Millisecond
+)
+
+// FlashRequest is a request from a client to flash an STM32 on a serial port.
+type FlashRequest struct {
+	ID        string // Given by the client and sent in the events.  Also used to cancel the flash.
+	Port      string // Serial port the device is on, i.e. COM5
+	Format    string // hex or bin.  Defaults to hex if the image starts with a colon.
+	Address   uint32 // Address a bin image is written to.  Defaults to 0x08000000.
+	Erase     string // all or none.  Defaults to all.
+	NoVerify  bool   // Do not read back the memory written
+	NoGo      bool   // Stay in the bootloader when done
+	GoAddress uint32 // Address of the vector table the application is started from.  Defaults to the start of the image.
+	Boot      string // Line driving BOOT0: rts, dtr or none.  Prefix with ! if inverted.  Defaults to rts.
+	Reset     string // Line driving NRST: dtr, rts or none.  Prefix with ! if inverted.  Defaults to dtr.
+}
+
+// FlashEvent is the progress and result of flashing
+// a device, sent to all the clients.
+type FlashEvent struct {
+	Cmd        string // Flash
+	ID         string // ID of the flash
+	Port       string
+	Event      string // start, connected, erase, write, verify, go, done, failed or cancelled
+	Chip       string // Product ID of the device, i.e. 0x0413
+	Bootloader string // Version of the bootloader, i.e. 3.1
+	Done       int    // Bytes written or verified
+	Size       int    // Bytes in the image
+	Error      string // Why the flash failed
+	Ts         time.Time
+}
+
+// stm32Loader runs the bootloader commands in a
+// session on a serial port.
+type stm32Loader struct {
+	ps       *portSession
+	version  byte   // Bootloader version
+	commands []byte // Commands supported by the bootloader
+}
+
+// waitAck will wait for the bootloader to accept the command.
+func (sl *stm32Loader) waitAck(timeout time.Duration) error {
+	b, err := sl.ps.read(1, timeout)
+	if err != nil {
+		return err
+	}
+	switch b[0] {
+	case stm32ACK:
+		return nil
+	case stm32NACK:
+		return errors.New("Bootloader refused the command")
+	}
+	return errors.New("Unexpected answer 0x" + strconv.FormatUint(uint64(b[0]), 16) + " from the bootloader")
+}
+
+// command will send the command and its complement.
+func (sl *stm32Loader) command(cmd byte) error {
+	sl.ps.discard()
+	if err := sl.ps.write([]byte{cmd, ^cmd}); err != nil {
+		return err
+	}
+	if err := sl.waitAck(stm32AckTimeout); err != nil {
+		return fmt.Errorf("Command 0x%x failed. %w", cmd, err)
+	}
+	return nil
+}
+
+// sendWithChecksum will send the data followed by the XOR
+// of the bytes, then wait for the bootloader to accept it.
+func (sl *stm32Loader) sendWithChecksum(p []byte, timeout time.Duration) error {
+	var sum byte
+	for _, b := range p {
+		sum ^= b
+	}
+	if err := sl.ps.write(append(p, sum)); err != nil {
+		return err
+	}
+	return sl.waitAck(timeout)
+}
+
+// sendAddress will send the address of a read, write or go.
+func (sl *stm32Loader) sendAddress(address uint32) error {
+	return sl.sendWithChecksum([]byte{byte(address >> 24), byte(address >> 16), byte(address >> 8), byte(address)}, stm32AckTimeout)
+}
+
+// sync will send the sync byte so the bootloader finds the baud
+// rate.  A NACK means the bootloader was already synced.
+func (sl *stm32Loader) sync() error {
+	for try := 0; try < stm32SyncRetries; try++ {
+		sl.ps.discard()
+		if err := sl.ps.write([]byte{stm32Sync}); err != nil {
+			return err
+		}
+
+		b, err := sl.ps.read(1, stm32AckTimeout)
+		if err == errTimeout {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if b[0] == stm32ACK || b[0] == stm32NACK {
+			return nil
+		}
+	}
+	return errors.New("Bootloader did not answer.  Check BOOT0, the wiring and that the port uses even parity.")
+}
+
+// get will get the bootloader version and the commands it supports.
+func (sl *stm32Loader) get() error {
+	if err := sl.command(stm32Get); err != nil {
+		return err
+	}
+	n, err := sl.ps.read(1, stm32AckTimeout)
+	if err != nil {
+		return err
+	}
+	data, err := sl.ps.read(int(n[0])+1, stm32AckTimeout)
+	if err != nil {
+		return err
+	}
+	sl.version = data[0]
+	sl.commands = data[1:]
+	return sl.waitAck(stm32AckTimeout)
+}
+
+// supports will check the bootloader supports the command.
+func (sl *stm32Loader) supports(cmd byte) bool {
+	return bytes.IndexByte(sl.commands, cmd) >= 0
+}
+
+// getID will get the product ID of the device.
+func (sl *stm32Loader) getID() (uint16, error) {
+	if err := sl.command(stm32GetID); err != nil {
+		return 0, err
+	}
+	n, err := sl.ps.read(1, stm32AckTimeout)
+	if err != nil {
+		return 0, err
+	}
+	data, err := sl.ps.read(int(n[0])+1, stm32AckTimeout)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) < 2 {
+		return 0, errors.New("Product ID is too short")
+	}
+	return uint16(data[0])<<8 | uint16(data[1]), sl.waitAck(stm32AckTimeout)
+}
+
+// eraseAll will erase all the flash memory.
+func (sl *stm32Loader) eraseAll() error {
+	switch {
+	case sl.supports(stm32ExtendedErase):
+		if err := sl.command(stm32ExtendedErase); err != nil {
+			return err
+		}
+		return sl.sendWithChecksum([]byte{0xFF, 0xFF}, stm32EraseTimeout)
+	case sl.supports(stm32Erase):
+		if err := sl.command(stm32Erase); err != nil {
+			return err
+		}
+		// The global erase is 0xFF with the checksum 0x00
+		if err := sl.ps.write([]byte{0xFF, 0x00}); err != nil {
+			return err
+		}
+		return sl.waitAck(stm32EraseTimeout)
+	}
+	return errors.New("Bootloader does not support erase")
+}
+
+// readMemory will read up to 256 bytes at the address.
+func (sl *stm32Loader) readMemory(address uint32, n int) ([]byte, error) {
+	if err := sl.command(stm32ReadMemory); err != nil {
+		return nil, err
+	}
+	if err := sl.sendAddress(address); err != nil {
+		return nil, err
+	}
+	if err := sl.ps.write([]byte{byte(n - 1), ^byte(n - 1)}); err != nil {
+		return nil, err
+	}
+	if err := sl.waitAck(stm32AckTimeout); err != nil {
+		return nil, err
+	}
+	return sl.ps.read(n, stm32AckTimeout)
+}
+
+// writeMemory will write up to 256 bytes at the address.
+// The length must be a multiple of 4.
+func (sl *stm32Loader) writeMemory(address uint32, p []byte) error {
+	if err := sl.command(stm32WriteMemory); err != nil {
+		return err
+	}
+	if err := sl.sendAddress(address); err != nil {
+		return err
+	}
+	return sl.sendWithChecksum(append([]byte{byte(len(p) - 1)}, p...), stm32AckTimeout)
+}
+
+// goTo will start the application at the address.
+func (sl *stm32Loader) goTo(address uint32) error {
+	if err := sl.command(stm32Go); err != nil {
+		return err
+	}
+	return sl.sendAddress(address)
+}
+
+// stm32Words will align the segments of the image to words of
+// 4 bytes, padded with 0xFF, the value of erased flash.  Segments
+// that meet or share a word are merged, so each word is written once.
+func stm32Words(img *firmwareImage) []memorySegment {
+	var words []memorySegment
+	for _, seg := range img.segments {
+		start := seg.address &^ 3
+		end := (uint64(seg.address) + uint64(len(seg.data)) + 3) &^ 3
+
+		// Merge with the last segment if it reaches this word
+		n := len(words)
+		if n == 0 || uint64(words[n-1].address)+uint64(len(words[n-1].data)) < uint64(start) {
+			words = append(words, memorySegment{address: start})
+			n++
+		}
+		last := &words[n-1]
+		if size := int(end - uint64(last.address)); size > len(last.data) {
+			last.data = append(last.data, bytes.Repeat([]byte{0xFF}, size-len(last.data))...)
+		}
+		copy(last.data[seg.address-last.address:], seg.data)
+	}
+	return words
+}
+
+// stm32Blocks will split the image into the blocks written
+// by the bootloader.  The blocks are word aligned and no
+// word is in two blocks.
+func stm32Blocks(img *firmwareImage) []memorySegment {
+	var blocks []memorySegment
+	for _, seg := range stm32Words(img) {
+		address := seg.address
+		data := seg.data
+
+		for sent := 0; sent < len(data); sent += stm32BlockSize {
+			end := sent + stm32BlockSize
+			if end > len(data) {
+				end = len(data)
+			}
+			blocks = append(blocks, memorySegment{address: address + uint32(sent), data: data[sent:end]})
+		}
+	}
+	return blocks
+}
+
+// setLine will set the RTS or DTR line.  The line is
+// asserted unless it starts with a ! for an inverted line.
+func setLine(spio *serialPortIO, line string, isAsserted bool) error {
+	if strings.HasPrefix(line, "!") {
+		line = line[1:]
+		isAsserted = !isAsserted
+	}
+	switch strings.ToLower(line) {
+	case "rts":
+		return spio.serialPort.SetRTS(isAsserted)
+	case "dtr":
+		return spio.serialPort.SetDTR(isAsserted)
+	case "none", "":
+		return nil
+	}
+	return errors.New("Unknown line " + line + ", use rts, dtr or none")
+}
+
+// setParity will set the parity of the serial port.
+// The bootloader uses 8 data bits and even parity.
+func setParity(spio *serialPortIO, parity serial.Parity) error {
+	return spio.serialPort.SetMode(&serial.Mode{
+		BaudRate: spio.portConf.Baud,
+		DataBits: 8,
+		Parity:   parity,
+		StopBits: serial.OneStopBit,
+		Vmin:     0,
+		Vtimeout: 10,
+	})
+}
+
+// enterBootloader will hold BOOT0 high and reset the device.
+func enterBootloader(spio *serialPortIO, req FlashRequest) error {
+	if err := setLine(spio, req.Boot, true); err != nil {
+		return err
+	}
+	if err := setLine(spio, req.Reset, true); err != nil {
+		return err
+	}
+	time.Sleep(stm32ResetPulse)
+	if err := setLine(spio, req.Reset, false); err != nil {
+		return err
+	}
+	time.Sleep(stm32BootDelay)
+	return nil
+}
+
+// runFlash will flash the image in a session on the serial
+// port and send the progress to all the clients.  It
+// returns the last event.
+func runFlash(req FlashRequest, img *firmwareImage) FlashEvent {
+	beginWork()
+	defer endWork()
+
+	event := FlashEvent{Cmd: "Flash", ID: req.ID, Port: req.Port, Size: img.size()}
+
+	err := flash(req, img, &event)
+
+	event.Event = "done"
+	if errors.Is(err, errCancelled) {
+		event.Event = "cancelled"
+		event.Error = err.Error()
+	} else if err != nil {
+		event.Event = "failed"
+		event.Error = err.Error()
+	}
+	if err != nil {
+		log.Println("Flash " + event.ID + " " + event.Event + ". " + err.Error())
+	}
+
+	event.Ts = time.Now()
+	broadcastFlash(event)
+	return event
+}
+
+// flash will enter the bootloader, erase the flash memory,
+// write the image and read it back, then start the application.
+func flash(req FlashRequest, img *firmwareImage, event *FlashEvent) error {
+	if req.Boot == "" {
+		req.Boot = "rts"
+	}
+	if req.Reset == "" {
+		req.Reset = "dtr"
+	}
+	erase := strings.ToLower(req.Erase)
+	if erase != "" && erase != "all" && erase != "none" {
+		return errors.New("Unknown erase " + req.Erase + ", use all or none")
+	}
+
+	// Add the flash to the transfers so it can be cancelled
+	ft, err := addTransfer(TransferRequest{ID: req.ID, Port: req.Port, Protocol: "stm32"})
+	if err != nil {
+		return err
+	}
+	defer ft.remove()
+	event.ID = ft.req.ID
+
+	spio, isFound := findPortByName(req.Port)
+	if !isFound {
+		return errors.New("Could not find the serial port " + req.Port)
+	}
+
+	ps, err := spio.openSession("flash "+ft.req.ID, transferBusyWait)
+	if err != nil {
+		return err
+	}
+	defer ps.close()
+	ps.cancel = ft.stop
+
+	// Put the port back to no parity and let the device
+	// start normally when done
+	if err := setParity(spio, serial.EvenParity); err != nil {
+		return fmt.Errorf("Could not set even parity. %w", err)
+	}
+	defer func() {
+		if err := setParity(spio, serial.NoParity); err != nil {
+			log.Println("Could not set the parity back on " + req.Port + ". " + err.Error())
+		}
+		setLine(spio, req.Boot, false)
+	}()
+
+	progress := func(name string, done int, force bool, last *time.Time) {
+		event.Done = done
+		if force || time.Since(*last) >= transferProgressInterval {
+			*last = time.Now()
+			event.Event = name
+			event.Ts = *last
+			broadcastFlash(*event)
+		}
+	}
+
+	event.Event = "start"
+	event.Ts = time.Now()
+	broadcastFlash(*event)
+
+	if err := enterBootloader(spio, req); err != nil {
+		return err
+	}
+
+	sl := &stm32Loader{ps: ps}
+	if err := sl.sync(); err != nil {
+		return err
+	}
+	if err := sl.get(); err != nil {
+		return err
+	}
+	pid, err := sl.getID()
+	if err != nil {
+		return err
+	}
+	event.Chip = fmt.Sprintf("0x%04x", pid)
+	event.Bootloader = strconv.Itoa(int(sl.version>>4)) + "." + strconv.Itoa(int(sl.version&0x0F))
+
+	var last time.Time
+	progress("connected", 0, true, &last)
+
+	if erase != "none" {
+		progress("erase", 0, true, &last)
+		if err := sl.eraseAll(); err != nil {
+			return fmt.Errorf("Erase failed. %w", err)
+		}
+	}
+
+	blocks := stm32Blocks(img)
+	progress("write", 0, true, &last)
+	done := 0
+	for _, blk := range blocks {
+		if err := sl.writeMemory(blk.address, blk.data); err != nil {
+			return fmt.Errorf("Write at 0x%x failed. %w", blk.address, err)
+		}
+		done += len(blk.data)
+		progress("write", done, false, &last)
+	}
+
+	if !req.NoVerify {
+		progress("verify", 0, true, &last)
+		done = 0
+		for _, blk := range blocks {
+			data, err := sl.readMemory(blk.address, len(blk.data))
+			if err != nil {
+				return fmt.Errorf("Read at 0x%x failed. %w", blk.address, err)
+			}
+			if !bytes.Equal(data, blk.data) {
+				return errors.New("Verify failed at 0x" + strconv.FormatUint(uint64(blk.address), 16))
+			}
+			done += len(blk.data)
+			progress("verify", done, false, &last)
+		}
+	}
+
+	if !req.NoGo {
+		// The bootloader reads the stack pointer and the reset vector
+		// from the address, so it must be the vector table, not the
+		// start address of a hex image, which is the Reset_Handler.
+		address := req.GoAddress
+		if address == 0 {
+			address = img.segments[0].address
+		}
+		progress("go", event.Size, true, &last)
+		if err := sl.goTo(address); err != nil {
+			return fmt.Errorf("Go failed. %w", err)
+		}
+	}
+	return nil
+}
+
+// broadcastFlash will send the flash event to all the clients.
+func broadcastFlash(event FlashEvent) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	echo.wsBroadcast <- b
+}
+
+// parseFirmware will parse the Intel HEX or binary image.
+func parseFirmware(p []byte, req FlashRequest) (*firmwareImage, error) {
+	format := strings.ToLower(req.Format)
+	if format == "" {
+		format = "bin"
+		if len(bytes.TrimSpace(p)) > 0 && bytes.TrimSpace(p)[0] == ':' {
+			format = "hex"
+		}
+	}
+
+	switch format {
+	case "hex":
+		return parseIntelHex(p)
+	case "bin":
+		if len(p) == 0 {
+			return nil, errors.New("Image is empty")
+		}
+		address := req.Address
+		if address == 0 {
+			address = stm32FlashAddress
+		}
+		return &firmwareImage{segments: []memorySegment{{address: address, data: p}}}, nil
+	}
+	return nil, errors.New("Unknown image format " + req.Format + ", use hex or bin")
+}
+
+// flashHandler flashes the image uploaded in a POST request to the
+// STM32 on the serial port.  The image is the body, or a file in a
+// multipart form.  It responds when the flash ends.  The flash
+// can be cancelled with the transfer cancel command.
+// POST /flash?port=COM5&format=hex&id=1
+// POST /flash?port=COM5&format=bin&address=0x08004000&erase=none&verify=false&go=false&boot=!rts&reset=dtr
+// POST /flash?port=COM5&format=hex&go=0x08004000
+func flashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	q := r.URL.Query()
+	req := FlashRequest{
+		ID:       q.Get("id"),
+		Port:     q.Get("port"),
+		Format:   q.Get("format"),
+		Erase:    q.Get("erase"),
+		NoVerify: q.Get("verify") == "false",
+		NoGo:     q.Get("go") == "false",
+		Boot:     q.Get("boot"),
+		Reset:    q.Get("reset"),
+	}
+	if s := q.Get("address"); s != "" {
+		address, err := strconv.ParseUint(s, 0, 32)
+		if err != nil {
+			http.Error(w, "Bad address "+s, 400)
+			return
+		}
+		req.Address = uint32(address)
+	}
+	if s := q.Get("go"); s != "" && s != "false" && s != "true" {
+		address, err := strconv.ParseUint(s, 0, 32)
+		if err != nil {
+			http.Error(w, "Bad go address "+s, 400)
+			return
+		}
+		req.GoAddress = uint32(address)
+	}
+
+	var data []byte
+	var err error
+	r.Body = http.MaxBytesReader(w, r.Body, maxTransferSize+1024*1024)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err = r.ParseMultipartForm(1024 * 1024); err != nil {
+			http.Error(w, "Bad upload. "+err.Error(), 400)
+			return
+		}
+		for _, fhs := range r.MultipartForm.File {
+			if len(fhs) > 0 {
+				data, err = readUpload(fhs[0].Open)
+				break
+			}
+		}
+	} else {
+		data, err = ioutil.ReadAll(r.Body)
+	}
+	if err != nil {
+		http.Error(w, "Bad upload. "+err.Error(), 400)
+		return
+	}
+
+	img, err := parseFirmware(data, req)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	writeJSON(w, runFlash(req, img))
+}
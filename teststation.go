@@ -0,0 +1,461 @@
+///
+/// Production test station.  Runs a test sequence on
+/// the boards on many serial ports at the same time
+/// and saves the results as JUnit XML and JSON.
+///
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileNameChars matches the characters not
+// allowed in the name of a file saved by the server.
+var fileNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// TestSequence is the list of tests run on each board.
+type TestSequence struct {
+	Name   string
+	Serial []ScriptStep // Steps run first to query the serial number into the serial variable.  Optional.
+	Tests  []TestCase
+}
+
+// TestCase is a test in the sequence.  The steps are run
+// like a script and the test fails if the script fails.
+type TestCase struct {
+	Name  string
+	Steps []ScriptStep
+}
+
+// TestStationRequest is a request from a client to
+// run a test sequence on the serial ports.
+type TestStationRequest struct {
+	ID       string            // Given by the client and sent in the events.  Also used to stop the tests.  test-N if not given.
+	Ports    []string          // Serial ports to test in parallel, i.e. COM5
+	Name     string            // Name of a sequence in the test directory
+	Sequence *TestSequence     // Sequence to run instead of a named one
+	Vars     map[string]string // Variables set before each sequence runs
+}
+
+// TestCaseResult is the result of a test.
+type TestCaseResult struct {
+	Name         string
+	Pass         bool
+	Error        string // Why the test failed
+	Measurements []TestMeasurement
+	Start        time.Time
+	Duration     float64 // Seconds
+}
+
+// TestEvent is the progress of the tests on
+// a serial port, sent to all the clients.
+type TestEvent struct {
+	Cmd    string // Test
+	ID     string // ID of the request
+	Port   string
+	Serial string          // Serial number of the board
+	Event  string          // start or case
+	Case   *TestCaseResult // Result of the test that finished
+	Ts     time.Time
+}
+
+// TestReport is the result of the sequence on a serial port.
+// It is sent to all the clients and saved in the report directory.
+type TestReport struct {
+	Cmd      string // TestReport
+	ID       string // ID of the request
+	Sequence string
+	Port     string
+	Serial   string // Serial number of the board
+	Pass     bool
+	Error    string // Why the sequence could not run
+	Cases    []TestCaseResult
+	Files    []string // Report files saved
+	Start    time.Time
+	End      time.Time
+}
+
+// junitTestSuite is the JUnit XML report of a board.
+type junitTestSuite struct {
+	XMLName    xml.Name        `xml:"testsuite"`
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Errors     int             `xml:"errors,attr"`
+	Time       string          `xml:"time,attr"`
+	Timestamp  string          `xml:"timestamp,attr"`
+	Hostname   string          `xml:"hostname,attr"`
+	Properties []junitProperty `xml:"properties>property"`
+	Cases      []junitTestCase `xml:"testcase"`
+}
+
+// junitProperty is a property of the JUnit test suite.
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+// junitTestCase is a test in the JUnit report.
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+// junitFailure is the reason a JUnit test failed.
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+var (
+	// Test runs by ID.  Closing the channel stops the tests.
+	testRuns   = map[string]chan struct{}{}
+	testRunsMu sync.Mutex
+
+	// Used to give an ID to a test run without one
+	testCount int
+)
+
+// validate will check the steps of all the tests.
+func (seq *TestSequence) validate() error {
+	if len(seq.Tests) == 0 {
+		return errors.New("No tests in the sequence")
+	}
+	if _, err := (&Script{Steps: seq.Serial}).validate(); err != nil {
+		return errors.New("Serial number steps. " + err.Error())
+	}
+	for _, tc := range seq.Tests {
+		if _, err := (&Script{Steps: tc.Steps}).validate(); err != nil {
+			return errors.New("Test " + tc.Name + ". " + err.Error())
+		}
+	}
+	return nil
+}
+
+// runTestStation will run the sequence on each serial port
+// at the same time.  The progress and the reports are sent
+// to all the clients.
+func runTestStation(req TestStationRequest) error {
+	beginWork()
+	defer endWork()
+
+	seq := req.Sequence
+	if seq == nil {
+		if *testDir == "" {
+			return errors.New("Unknown test sequence " + req.Name)
+		}
+		seq = &TestSequence{}
+		if err := loadJSONFile(*testDir, req.Name, seq); err != nil {
+			return err
+		}
+		if seq.Name == "" {
+			seq.Name = req.Name
+		}
+	}
+	if err := seq.validate(); err != nil {
+		return err
+	}
+	if len(req.Ports) == 0 {
+		return errors.New("No serial ports to test")
+	}
+
+	stop := make(chan struct{})
+	testRunsMu.Lock()
+	if req.ID == "" {
+		testCount++
+		req.ID = "test-" + strconv.Itoa(testCount)
+	}
+	if _, isFound := testRuns[req.ID]; isFound {
+		testRunsMu.Unlock()
+		return errors.New("Test " + req.ID + " is already running")
+	}
+	testRuns[req.ID] = stop
+	testRunsMu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, port := range req.Ports {
+		wg.Add(1)
+		go func(port string) {
+			defer wg.Done()
+			report := runTestPort(req, seq, port, stop)
+			report.saveFiles()
+			broadcastTest(report)
+		}(port)
+	}
+	wg.Wait()
+
+	testRunsMu.Lock()
+	if testRuns[req.ID] == stop {
+		delete(testRuns, req.ID)
+	}
+	testRunsMu.Unlock()
+	return nil
+}
+
+// runTestPort will run the sequence on the board on the
+// serial port in one session and return the report.
+func runTestPort(req TestStationRequest, seq *TestSequence, port string, stop chan struct{}) *TestReport {
+	report := &TestReport{
+		Cmd:      "TestReport",
+		ID:       req.ID,
+		Sequence: seq.Name,
+		Port:     port,
+		Start:    time.Now(),
+	}
+	defer func() {
+		report.End = time.Now()
+	}()
+
+	spio, isFound := findPortByName(port)
+	if !isFound {
+		report.Error = "Could not find the serial port " + port
+		return report
+	}
+
+	ps, err := spio.openSession("test "+req.ID, scriptBusyWait)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	defer ps.close()
+	ps.cancel = stop
+
+	vars := map[string]string{}
+	for k, v := range req.Vars {
+		vars[k] = v
+	}
+
+	// Query the serial number, or use the one from the USB device
+	if len(seq.Serial) > 0 {
+		if err := newTestRun(port, "serial", seq.Serial, vars, stop).steps(ps); err != nil {
+			report.Error = "Could not get the serial number. " + err.Error()
+			return report
+		}
+	}
+	if vars["serial"] == "" {
+		vars["serial"] = portSerialNumber(port)
+	}
+	report.Serial = vars["serial"]
+
+	broadcastTest(TestEvent{Cmd: "Test", ID: req.ID, Port: port, Serial: report.Serial, Event: "start", Ts: time.Now()})
+
+	report.Pass = true
+	for _, tc := range seq.Tests {
+		run := newTestRun(port, tc.Name, tc.Steps, vars, stop)
+		result := TestCaseResult{Name: tc.Name, Pass: true, Start: time.Now()}
+
+		err := run.steps(ps)
+		result.Measurements = run.measurements
+		result.Duration = time.Since(result.Start).Seconds()
+		if err != nil {
+			result.Pass = false
+			result.Error = err.Error()
+			report.Pass = false
+		}
+		report.Cases = append(report.Cases, result)
+
+		broadcastTest(TestEvent{Cmd: "Test", ID: req.ID, Port: port, Serial: report.Serial, Event: "case", Case: &result, Ts: time.Now()})
+
+		if err == errCancelled {
+			report.Error = err.Error()
+			break
+		}
+	}
+
+	return report
+}
+
+// newTestRun will make the steps of a test ready to run as
+// a script in the session of the test station.
+// The variables are shared by all the tests on the board.
+func newTestRun(port string, name string, steps []ScriptStep, vars map[string]string, stop chan struct{}) *scriptRun {
+	s := &Script{Name: name, Steps: steps}
+	labels, _ := s.validate()
+	return &scriptRun{
+		id:     name,
+		script: s,
+		port:   port,
+		vars:   vars,
+		labels: labels,
+		stop:   stop,
+		events: func(ScriptEvent) {},
+	}
+}
+
+// saveFiles will save the report as JUnit XML and JSON
+// in the report directory.
+func (report *TestReport) saveFiles() {
+	if *reportDir == "" {
+		return
+	}
+	if err := os.MkdirAll(*reportDir, 0755); err != nil {
+		log.Println("Could not make the report directory. " + err.Error())
+		return
+	}
+
+	who := report.Serial
+	if who == "" {
+		who = report.Port
+	}
+	base := filepath.Join(*reportDir, fileNameChars.ReplaceAllString(report.Sequence+"_"+who+"_"+report.Start.Format("20060102T150405"), "_"))
+
+	b, err := xml.MarshalIndent(report.junit(), "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(base+".xml", append([]byte(xml.Header), b...), 0644)
+	}
+	if err != nil {
+		log.Println("Could not save the JUnit report. " + err.Error())
+	} else {
+		report.Files = append(report.Files, base+".xml")
+	}
+
+	// Save the JSON with the file names in it
+	report.Files = append(report.Files, base+".json")
+	b, err = json.MarshalIndent(report, "", "\t")
+	if err == nil {
+		err = ioutil.WriteFile(base+".json", b, 0644)
+	}
+	if err != nil {
+		log.Println("Could not save the JSON report. " + err.Error())
+		report.Files = report.Files[:len(report.Files)-1]
+	}
+}
+
+// junit will make the JUnit XML test suite of the report.
+// A sequence that could not run is reported as an error.
+func (report *TestReport) junit() junitTestSuite {
+	hostname, _ := os.Hostname()
+	suite := junitTestSuite{
+		Name:      report.Sequence,
+		Tests:     len(report.Cases),
+		Time:      strconv.FormatFloat(report.End.Sub(report.Start).Seconds(), 'f', 3, 64),
+		Timestamp: report.Start.Format("2006-01-02T15:04:05"),
+		Hostname:  hostname,
+		Properties: []junitProperty{
+			{Name: "port", Value: report.Port},
+			{Name: "serial", Value: report.Serial},
+		},
+	}
+
+	if report.Error != "" && len(report.Cases) == 0 {
+		suite.Errors = 1
+		suite.Tests = 1
+		suite.Cases = append(suite.Cases, junitTestCase{
+			Name:      "setup",
+			Classname: report.Sequence,
+			Time:      "0",
+			Failure:   &junitFailure{Message: report.Error, Text: report.Error},
+		})
+	}
+
+	for _, result := range report.Cases {
+		tc := junitTestCase{
+			Name:      result.Name,
+			Classname: report.Sequence,
+			Time:      strconv.FormatFloat(result.Duration, 'f', 3, 64),
+		}
+
+		var out []string
+		for _, m := range result.Measurements {
+			status := "PASS"
+			if !m.Pass {
+				status = "FAIL"
+			}
+			out = append(out, m.Name+" = "+strconv.FormatFloat(m.Value, 'g', -1, 64)+m.Units+" "+formatLimits(m.Min, m.Max)+" "+status)
+		}
+		tc.SystemOut = strings.Join(out, "\n")
+
+		if !result.Pass {
+			suite.Failures++
+			tc.Failure = &junitFailure{Message: result.Error, Text: result.Error}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+
+	return suite
+}
+
+// broadcastTest will send the test event or report to all the clients.
+func broadcastTest(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	echo.wsBroadcast <- b
+}
+
+// stopTestStation will stop the tests with the ID.
+func stopTestStation(id string) bool {
+	testRunsMu.Lock()
+	defer testRunsMu.Unlock()
+
+	stop, isFound := testRuns[id]
+	if !isFound {
+		return false
+	}
+	delete(testRuns, id)
+	close(stop)
+	return true
+}
+
+// stopAllTestStations will stop all the tests.
+func stopAllTestStations() {
+	testRunsMu.Lock()
+	defer testRunsMu.Unlock()
+	for id, stop := range testRuns {
+		delete(testRuns, id)
+		close(stop)
+	}
+}
+
+// testCmd will run or stop a test sequence on the serial ports.
+// Cmd: TEST RUN {"ID":"1","Ports":["COM5","COM6"],"Name":"board"}
+// Cmd: TEST STOP 1
+func testCmd(c *websocketConn, cmd string) {
+	cmds := strings.SplitN(strings.TrimSpace(cmd), " ", 3)
+	if len(cmds) != 3 {
+		log.Println("Could not parse test command: " + cmd)
+		return
+	}
+
+	switch strings.ToLower(cmds[1]) {
+	case "run":
+		var req TestStationRequest
+		if err := json.Unmarshal([]byte(cmds[2]), &req); err != nil {
+			replyTo(c, TestReport{Cmd: "TestReport", Error: "Bad test request. " + err.Error()})
+			return
+		}
+
+		// Do not block the echo hub while the tests run
+		go func() {
+			if err := runTestStation(req); err != nil {
+				log.Println("Test " + req.ID + " failed. " + err.Error())
+				replyTo(c, TestReport{Cmd: "TestReport", ID: req.ID, Sequence: req.Name, Error: err.Error()})
+			}
+		}()
+
+	case "stop":
+		if !stopTestStation(strings.TrimSpace(cmds[2])) {
+			log.Println("Could not find the test " + cmds[2] + " to stop.")
+		}
+
+	default:
+		log.Println("Unknown test command: " + cmd)
+	}
+}
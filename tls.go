@@ -0,0 +1,199 @@
+///
+/// TLS and mutual-TLS support for the HTTP
+/// and websocket server.
+///
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the certificate files are checked for changes.
+	certReloadPeriod = 10 * time.Second
+)
+
+// certReloader holds the server certificate and the
+// client CA bundle.  It will watch the files and reload
+// them when they change on disk, so certificates can be
+// rotated without restarting the server.
+type certReloader struct {
+	certFile string      // Server certificate file (PEM)
+	keyFile  string      // Server private key file (PEM)
+	caFile   string      // Client CA bundle file (PEM).  Empty if client certificates are not verified.
+	base     *tls.Config // Server TLS configuration.  Its protocols are copied to each connection.
+
+	mu      sync.RWMutex      // Protects the loaded certificate and CA pool
+	cert    *tls.Certificate  // Current server certificate
+	caPool  *x509.CertPool    // Current client CA pool
+	modTime map[string]string // Last seen modification time and size of each file
+}
+
+// newCertReloader will create the certificate reloader and
+// load the certificate files for the first time.
+func newCertReloader(certFile string, keyFile string, caFile string) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		modTime:  make(map[string]string),
+	}
+
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+// load will read the certificate, key and CA files.
+// The current certificates are only replaced if all
+// the files could be read.
+func (cr *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+	if len(cr.caFile) > 0 {
+		pem, err := ioutil.ReadFile(cr.caFile)
+		if err != nil {
+			return err
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("No certificates found in CA file " + cr.caFile)
+		}
+	}
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.caPool = pool
+	cr.mu.Unlock()
+
+	return nil
+}
+
+// changed will check if any of the files were modified
+// since the last time it was called.
+func (cr *certReloader) changed() bool {
+	isChanged := false
+	for _, file := range []string{cr.certFile, cr.keyFile, cr.caFile} {
+		if len(file) == 0 {
+			continue
+		}
+
+		fi, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+
+		stamp := fi.ModTime().String() + "/" + strconv.FormatInt(fi.Size(), 10)
+		if cr.modTime[file] != stamp {
+			cr.modTime[file] = stamp
+			isChanged = true
+		}
+	}
+	return isChanged
+}
+
+// watch will poll the certificate files and reload
+// them when they change.  A failed reload keeps the
+// previous certificates so the server keeps running.
+func (cr *certReloader) watch() {
+	// Record the initial state of the files
+	cr.changed()
+
+	for range time.Tick(certReloadPeriod) {
+		if !cr.changed() {
+			continue
+		}
+
+		log.Println("TLS certificate files changed, reloading")
+		if err := cr.load(); err != nil {
+			log.Println("Error reloading the TLS certificates. " + err.Error())
+		}
+	}
+}
+
+// getCertificate returns the current server certificate.
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// getConfigForClient returns the TLS configuration for
+// a new connection.  This will use the current client
+// CA pool to verify the client certificate.
+func (cr *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+
+	// Keep the protocols of the server, or HTTP/2 is not offered
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.getCertificate,
+		NextProtos:     cr.base.NextProtos,
+	}
+
+	if cr.caPool != nil {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = cr.caPool
+	}
+
+	return config, nil
+}
+
+// newTLSConfig will create the TLS configuration for the
+// HTTP server.  If a client CA file is given, the clients
+// must present a certificate signed by the CA.
+func newTLSConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	if len(keyFile) == 0 {
+		return nil, errors.New("A TLS key file must be given with the TLS certificate")
+	}
+
+	cr, err := newCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reload the certificates when they are rotated
+	go cr.watch()
+
+	cr.base = &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetCertificate:     cr.getCertificate,
+		GetConfigForClient: cr.getConfigForClient,
+		NextProtos:         []string{"h2", "http/1.1"},
+	}
+	return cr.base, nil
+}
+
+// clientCertName will get the client identity from
+// the verified client certificate.  This is the subject
+// common name, or the full subject if no common name is set.
+// It returns an empty string if no certificate was given.
+func clientCertName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+
+	cert := r.TLS.PeerCertificates[0]
+	if len(cert.Subject.CommonName) > 0 {
+		return cert.Subject.CommonName
+	}
+	return cert.Subject.String()
+}
@@ -0,0 +1,189 @@
+///
+/// Request and response transactions on an open serial port.
+///
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// Default time to wait for the response.
+	defaultTransactionTimeout = 2000 * time.Millisecond
+
+	// Time to wait for another session on the port to finish.
+	transactionBusyWait = 5 * time.Second
+)
+
+// TransactionRequest is a request from a client to send data
+// to a serial port and wait for the response.  The response
+// ends at the first of Match, Until or Idle to be found.
+type TransactionRequest struct {
+	ID      string // Given by the client and returned in the response
+	Port    string // Serial port to use, i.e. COM5
+	Data    string // Data to send as is, with any line ending
+	Enc     string // base64 if Data is base64 encoded
+	Match   string // Regular expression that ends the response, eg. OK|ERR
+	Until   string // Bytes that end the response, eg. \r\n
+	Idle    int    // Time without data that ends the response in milliseconds.  0 to not use.
+	Timeout int    // Time to wait for the response in milliseconds.  0 for the default.
+}
+
+// TransactionResponse is the response to a transaction request.
+type TransactionResponse struct {
+	Cmd     string // Transaction
+	ID      string // ID given in the request
+	Port    string
+	Data    string // Data read up to and including the match
+	Enc     string // base64 if Data is not UTF-8 and is base64 encoded
+	Matched string // What ended the response.  match, until or idle.
+	Error   string // Error if the request failed.  Data has what was read before the error.
+	Ts      time.Time
+}
+
+// runTransaction will run the transaction on the serial port.
+func runTransaction(req TransactionRequest) TransactionResponse {
+	resp := TransactionResponse{
+		Cmd:  "Transaction",
+		ID:   req.ID,
+		Port: req.Port,
+	}
+
+	data, err := req.run(&resp)
+	if err != nil {
+		log.Println("Transaction failed. " + err.Error())
+		resp.Error = err.Error()
+	}
+
+	if utf8.Valid(data) {
+		resp.Data = string(data)
+	} else {
+		resp.Data = base64.StdEncoding.EncodeToString(data)
+		resp.Enc = "base64"
+	}
+	resp.Ts = time.Now()
+	return resp
+}
+
+// run will send the data and read the response.  It returns
+// the data read, even if there is an error.
+func (req *TransactionRequest) run(resp *TransactionResponse) ([]byte, error) {
+	if req.Match == "" && req.Until == "" && req.Idle <= 0 {
+		return nil, errors.New("Match, Until or Idle must be given")
+	}
+
+	var re *regexp.Regexp
+	if req.Match != "" {
+		var err error
+		re, err = regexp.Compile(req.Match)
+		if err != nil {
+			return nil, errors.New("Bad match pattern. " + err.Error())
+		}
+	}
+
+	data := []byte(req.Data)
+	if strings.EqualFold(req.Enc, "base64") {
+		var err error
+		data, err = base64.StdEncoding.DecodeString(req.Data)
+		if err != nil {
+			return nil, errors.New("Bad base64 data. " + err.Error())
+		}
+	}
+
+	spio, isFound := findPortByName(req.Port)
+	if !isFound {
+		return nil, errors.New("Could not find the serial port " + req.Port)
+	}
+
+	timeout := defaultTransactionTimeout
+	if req.Timeout > 0 {
+		timeout = time.Duration(req.Timeout) * time.Millisecond
+	}
+
+	ps, err := spio.openSession("transaction", transactionBusyWait)
+	if err != nil {
+		return nil, err
+	}
+	defer ps.close()
+
+	// Drop anything read before the request was sent
+	ps.discard()
+	if len(data) > 0 {
+		if err := ps.write(data); err != nil {
+			return nil, err
+		}
+	}
+
+	until := []byte(req.Until)
+	p, err := ps.readUntil(func(p []byte) int {
+		if re != nil {
+			if loc := re.FindIndex(p); loc != nil {
+				resp.Matched = "match"
+				return loc[1]
+			}
+		}
+		if len(until) > 0 {
+			if i := bytes.Index(p, until); i >= 0 {
+				resp.Matched = "until"
+				return i + len(until)
+			}
+		}
+		return -1
+	}, timeout, time.Duration(req.Idle)*time.Millisecond)
+
+	if err == errIdle {
+		resp.Matched = "idle"
+		err = nil
+	}
+	return p, err
+}
+
+// transactionCmd will run the transaction given as JSON and send
+// the response to the client that sent the command.
+// Cmd: TRANSACTION {"Port":"COM5","Data":"AT\r","Match":"OK|ERR","Timeout":2000}
+func transactionCmd(c *websocketConn, cmd string) {
+	var req TransactionRequest
+
+	// Get the JSON after the command
+	cmds := strings.SplitN(strings.TrimSpace(cmd), " ", 2)
+	if len(cmds) != 2 {
+		replyTo(c, TransactionResponse{Cmd: "Transaction", Error: "Could not parse transaction command: " + cmd})
+		return
+	}
+	if err := json.Unmarshal([]byte(cmds[1]), &req); err != nil {
+		replyTo(c, TransactionResponse{Cmd: "Transaction", Error: "Bad transaction request. " + err.Error()})
+		return
+	}
+
+	// Do not block the echo hub while waiting for the response
+	go func() {
+		replyTo(c, runTransaction(req))
+	}()
+}
+
+// transactionHandler runs the transaction given as
+// JSON in the body of a POST request.
+func transactionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	var req TransactionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad transaction request. "+err.Error(), 400)
+		return
+	}
+
+	writeJSON(w, runTransaction(req))
+}
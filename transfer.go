@@ -0,0 +1,505 @@
+///
+/// File transfers to the devices on the serial ports.
+/// Files are uploaded over HTTP or in chunks over the
+/// websocket and sent with XMODEM or YMODEM.
+///
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Largest file that can be transferred.
+	maxTransferSize = 64 * 1024 * 1024
+
+	// Time between the progress events of a transfer.
+	transferProgressInterval = 250 * time.Millisecond
+
+	// Time to wait for another session on the port to finish.
+	transferBusyWait = 5 * time.Second
+
+	// Time to wait for the next chunk of a websocket upload
+	// before the upload is dropped.
+	transferIdleTimeout = 60 * time.Second
+)
+
+// Transfer protocols.
+const (
+	protocolXMODEM   = "xmodem"
+	protocolXMODEM1K = "xmodem-1k"
+	protocolYMODEM   = "ymodem"
+)
+
+// TransferRequest is a request from a client to send files to a serial port.
+type TransferRequest struct {
+	ID       string // Given by the client and sent in the events.  Also used to cancel the transfer.
+	Port     string // Serial port to send the files to, i.e. COM5
+	Protocol string // xmodem, xmodem-1k or ymodem
+	Name     string // Name of the file sent with YMODEM
+	Size     int    // Size of the file sent in chunks over the websocket
+}
+
+// TransferEvent is the progress and result of a
+// transfer, sent to all the clients.
+type TransferEvent struct {
+	Cmd      string // Transfer
+	ID       string // ID of the transfer
+	Port     string
+	Protocol string
+	Files    []string // Names of the files sent
+	Event    string   // ready, start, progress, done, failed or cancelled
+	Sent     int      // Bytes sent
+	Size     int      // Bytes to send
+	Retries  int      // Blocks sent again
+	Error    string   // Why the transfer failed
+	Ts       time.Time
+}
+
+// transferFile is a file to send.
+type transferFile struct {
+	name string
+	data []byte
+}
+
+// fileTransfer is a transfer waiting for its file,
+// or sending it.
+type fileTransfer struct {
+	req       TransferRequest
+	upload    bytes.Buffer   // Chunks received over the websocket
+	owner     *websocketConn // Client sending the chunks.  Nil if uploaded over HTTP.
+	idle      *time.Timer    // Drops the upload if no chunk is received in time.  Nil if uploaded over HTTP.
+	stop      chan struct{}  // Closed to cancel the transfer
+	isSending bool           // Set when the file is being sent, so no more chunks are added.  Protected by the transfers lock.
+}
+
+var (
+	// Transfers by ID
+	transfers   = map[string]*fileTransfer{}
+	transfersMu sync.Mutex
+
+	// Used to give an ID to a transfer without one
+	transferCount int
+)
+
+// newTransfer will add the transfer so its chunks can be
+// added and it can be cancelled.
+func newTransfer(req TransferRequest) (*fileTransfer, error) {
+	switch strings.ToLower(req.Protocol) {
+	case protocolXMODEM, protocolXMODEM1K, protocolYMODEM:
+	default:
+		return nil, errors.New("Unknown transfer protocol " + req.Protocol)
+	}
+	if req.Size > maxTransferSize {
+		return nil, errors.New("File is larger than " + strconv.Itoa(maxTransferSize) + " bytes")
+	}
+	if _, err := ymodemHeader(req.Name, maxTransferSize); err != nil {
+		return nil, err
+	}
+
+	return addTransfer(req)
+}
+
+// addTransfer will add the transfer by its ID.  An ID
+// is given to the transfer if it does not have one.
+func addTransfer(req TransferRequest) (*fileTransfer, error) {
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+
+	if req.ID == "" {
+		transferCount++
+		req.ID = "transfer-" + strconv.Itoa(transferCount)
+	}
+	if _, isFound := transfers[req.ID]; isFound {
+		return nil, errors.New("Transfer " + req.ID + " already exists")
+	}
+
+	ft := &fileTransfer{req: req, stop: make(chan struct{})}
+	transfers[req.ID] = ft
+	return ft, nil
+}
+
+// getUpload will get the transfer with the ID if the client
+// is sending its chunks and it is not being sent yet.
+func getUpload(id string, c *websocketConn) (*fileTransfer, bool) {
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+	ft, isFound := transfers[id]
+	if !isFound || ft.owner != c || ft.isSending {
+		return nil, false
+	}
+	return ft, true
+}
+
+// beginSending will stop adding chunks to the transfer so the
+// file can be sent.  It returns false if the transfer was
+// cancelled or is already being sent.
+func (ft *fileTransfer) beginSending() bool {
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+	if transfers[ft.req.ID] != ft || ft.isSending {
+		return false
+	}
+	ft.isSending = true
+	if ft.idle != nil {
+		ft.idle.Stop()
+	}
+	return true
+}
+
+// dropUpload will cancel the websocket upload if no chunk
+// was received before the idle timeout.
+func (ft *fileTransfer) dropUpload() {
+	transfersMu.Lock()
+	isDropped := transfers[ft.req.ID] == ft && !ft.isSending
+	if isDropped {
+		delete(transfers, ft.req.ID)
+		close(ft.stop)
+	}
+	transfersMu.Unlock()
+
+	if isDropped {
+		log.Println("Transfer " + ft.req.ID + " dropped, no chunk received in " + transferIdleTimeout.String())
+		broadcastTransfer(TransferEvent{Cmd: "Transfer", ID: ft.req.ID, Port: ft.req.Port, Protocol: ft.req.Protocol, Event: "cancelled", Error: "No chunk received in " + transferIdleTimeout.String(), Ts: time.Now()})
+	}
+}
+
+// dropUploads will cancel the websocket uploads of the client
+// that are not being sent yet, so the chunks are not kept when
+// the client leaves.
+func dropUploads(c *websocketConn) {
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+	for id, ft := range transfers {
+		if ft.owner == c && !ft.isSending {
+			delete(transfers, id)
+			ft.idle.Stop()
+			close(ft.stop)
+			log.Println("Transfer " + id + " dropped, " + c.identity() + " left")
+		}
+	}
+}
+
+// remove will remove the transfer when it ends.
+func (ft *fileTransfer) remove() {
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+	if transfers[ft.req.ID] == ft {
+		delete(transfers, ft.req.ID)
+	}
+}
+
+// cancelTransfer will cancel the transfer with the ID.
+func cancelTransfer(id string) bool {
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+
+	ft, isFound := transfers[id]
+	if !isFound {
+		return false
+	}
+	delete(transfers, id)
+	close(ft.stop)
+	return true
+}
+
+// cancelAllTransfers will cancel the transfers, receives and flashes.
+func cancelAllTransfers() {
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+	for id, ft := range transfers {
+		delete(transfers, id)
+		close(ft.stop)
+	}
+}
+
+// run will send the files to the serial port and send the
+// progress to all the clients.  It returns the last event.
+func (ft *fileTransfer) run(files []transferFile) TransferEvent {
+	beginWork()
+	defer endWork()
+	defer ft.remove()
+
+	event := TransferEvent{
+		Cmd:      "Transfer",
+		ID:       ft.req.ID,
+		Port:     ft.req.Port,
+		Protocol: strings.ToLower(ft.req.Protocol),
+		Files:    []string{},
+	}
+	for _, f := range files {
+		event.Files = append(event.Files, f.name)
+		event.Size += len(f.data)
+	}
+
+	err := ft.send(files, &event)
+
+	event.Event = "done"
+	if err == errCancelled || err == errTransferCancelled {
+		event.Event = "cancelled"
+		event.Error = err.Error()
+	} else if err != nil {
+		event.Event = "failed"
+		event.Error = err.Error()
+	}
+	if err != nil {
+		log.Println("Transfer " + ft.req.ID + " " + event.Event + ". " + err.Error())
+	}
+
+	event.Ts = time.Now()
+	broadcastTransfer(event)
+	return event
+}
+
+// send will send the files in a session on the serial port.
+func (ft *fileTransfer) send(files []transferFile, event *TransferEvent) error {
+	if len(files) == 0 {
+		return errors.New("No file to send")
+	}
+
+	spio, isFound := findPortByName(ft.req.Port)
+	if !isFound {
+		return errors.New("Could not find the serial port " + ft.req.Port)
+	}
+
+	ps, err := spio.openSession("transfer "+ft.req.ID, transferBusyWait)
+	if err != nil {
+		return err
+	}
+	defer ps.close()
+	ps.cancel = ft.stop
+
+	event.Event = "start"
+	event.Ts = time.Now()
+	broadcastTransfer(*event)
+
+	// Send the progress at most every interval
+	var last time.Time
+	xs := &xmodemSender{ps: ps}
+	xs.progress = func(sent int, retries int) {
+		event.Sent = sent
+		event.Retries = retries
+		if time.Since(last) >= transferProgressInterval {
+			last = time.Now()
+			event.Event = "progress"
+			event.Ts = last
+			broadcastTransfer(*event)
+		}
+	}
+
+	switch strings.ToLower(ft.req.Protocol) {
+	case protocolXMODEM:
+		err = xs.sendXMODEM(files[0].data)
+	case protocolXMODEM1K:
+		xs.is1K = true
+		err = xs.sendXMODEM(files[0].data)
+	case protocolYMODEM:
+		err = xs.sendYMODEM(files)
+	}
+
+	if err != nil {
+		xs.cancel()
+	}
+	return err
+}
+
+// broadcastTransfer will send the transfer event to all the clients.
+func broadcastTransfer(event TransferEvent) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	echo.wsBroadcast <- b
+}
+
+// transferCmd will start, add to, send or cancel a file
+// transfer over the websocket.  The file is sent in base64
+// chunks that fit in a websocket message.
+// Cmd: TRANSFER BEGIN {"ID":"1","Port":"COM5","Protocol":"ymodem","Name":"fw.bin","Size":2048}
+// Cmd: TRANSFER CHUNK 1 [base64]
+// Cmd: TRANSFER END 1
+// Cmd: TRANSFER CANCEL 1
+func transferCmd(c *websocketConn, cmd string) {
+	cmds := strings.SplitN(strings.TrimSpace(cmd), " ", 3)
+	if len(cmds) != 3 {
+		log.Println("Could not parse transfer command: " + cmd)
+		return
+	}
+
+	fail := func(id string, err string) {
+		replyTo(c, TransferEvent{Cmd: "Transfer", ID: id, Event: "failed", Error: err, Ts: time.Now()})
+	}
+
+	switch strings.ToLower(cmds[1]) {
+	case "begin":
+		var req TransferRequest
+		if err := json.Unmarshal([]byte(cmds[2]), &req); err != nil {
+			fail("", "Bad transfer request. "+err.Error())
+			return
+		}
+		ft, err := newTransfer(req)
+		if err != nil {
+			fail(req.ID, err.Error())
+			return
+		}
+
+		// The chunks are only taken from this client, and are
+		// dropped when it leaves or stops sending them
+		transfersMu.Lock()
+		ft.owner = c
+		ft.idle = time.AfterFunc(transferIdleTimeout, ft.dropUpload)
+		transfersMu.Unlock()
+		replyTo(c, TransferEvent{Cmd: "Transfer", ID: ft.req.ID, Port: req.Port, Protocol: req.Protocol, Event: "ready", Size: req.Size, Ts: time.Now()})
+
+	case "chunk":
+		args := strings.SplitN(cmds[2], " ", 2)
+		ft, isFound := getUpload(args[0], c)
+		if !isFound || len(args) != 2 {
+			fail(args[0], "Could not add the chunk to the transfer")
+			return
+		}
+		chunk, err := base64.StdEncoding.DecodeString(strings.TrimSpace(args[1]))
+		if err != nil || ft.upload.Len()+len(chunk) > maxTransferSize {
+			cancelTransfer(args[0])
+			fail(args[0], "Bad chunk, the transfer is cancelled")
+			return
+		}
+		ft.upload.Write(chunk)
+		ft.idle.Reset(transferIdleTimeout)
+
+	case "end":
+		id := strings.TrimSpace(cmds[2])
+		ft, isFound := getUpload(id, c)
+		if !isFound {
+			fail(id, "Could not find the transfer")
+			return
+		}
+		if ft.req.Size > 0 && ft.upload.Len() != ft.req.Size {
+			cancelTransfer(id)
+			fail(id, "Received "+strconv.Itoa(ft.upload.Len())+" bytes instead of "+strconv.Itoa(ft.req.Size))
+			return
+		}
+		if !ft.beginSending() {
+			fail(id, "Could not find the transfer")
+			return
+		}
+
+		// Do not block the echo hub while the file is sent
+		files := []transferFile{{name: ft.req.Name, data: ft.upload.Bytes()}}
+		go ft.run(files)
+
+	case "cancel":
+		if !cancelTransfer(strings.TrimSpace(cmds[2])) {
+			log.Println("Could not find the transfer " + cmds[2] + " to cancel.")
+		}
+
+	default:
+		log.Println("Unknown transfer command: " + cmd)
+	}
+}
+
+// transferHandler sends the files uploaded in a POST request.
+// The files are given as multipart form files, or as the body
+// with the name in the query.  YMODEM sends all the files in
+// the form, XMODEM only the first.  It responds when the
+// transfer ends.
+// POST /transfer?port=COM5&protocol=ymodem&name=fw.bin&id=1
+func transferHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	q := r.URL.Query()
+	req := TransferRequest{
+		ID:       q.Get("id"),
+		Port:     q.Get("port"),
+		Protocol: q.Get("protocol"),
+		Name:     q.Get("name"),
+	}
+
+	var files []transferFile
+	r.Body = http.MaxBytesReader(w, r.Body, maxTransferSize+1024*1024)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(1024 * 1024); err != nil {
+			http.Error(w, "Bad upload. "+err.Error(), 400)
+			return
+		}
+
+		// Send the files in the order of the form field names
+		fields := make([]string, 0, len(r.MultipartForm.File))
+		for field := range r.MultipartForm.File {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+
+		for _, field := range fields {
+			for _, fh := range r.MultipartForm.File[field] {
+				data, err := readUpload(fh.Open)
+				if err != nil {
+					http.Error(w, "Bad upload. "+err.Error(), 400)
+					return
+				}
+				name := filepath.Base(fh.Filename)
+				if _, err := ymodemHeader(name, len(data)); err != nil {
+					http.Error(w, "Bad upload. "+err.Error(), 400)
+					return
+				}
+				files = append(files, transferFile{name: name, data: data})
+			}
+		}
+	} else {
+		data, err := ioutil.ReadAll(r.Body)
+		if err == nil && len(data) > maxTransferSize {
+			err = errors.New("File is larger than " + strconv.Itoa(maxTransferSize) + " bytes")
+		}
+		if err != nil {
+			http.Error(w, "Bad upload. "+err.Error(), 400)
+			return
+		}
+		files = append(files, transferFile{name: req.Name, data: data})
+	}
+
+	ft, err := newTransfer(req)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	ft.beginSending()
+
+	writeJSON(w, ft.run(files))
+}
+
+// readUpload will read the uploaded file.  A file larger
+// than the max transfer size is refused, not truncated.
+func readUpload(open func() (multipart.File, error)) ([]byte, error) {
+	f, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxTransferSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxTransferSize {
+		return nil, errors.New("File is larger than " + strconv.Itoa(maxTransferSize) + " bytes")
+	}
+	return data, nil
+}
@@ -9,6 +9,9 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -23,15 +26,14 @@ const (
 
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (readWaitTime * 9) / 10
-
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
 )
 
 // upgrader sets the buffer sizes for the websocket.
+// The origin is checked against the allowed origins.
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	CheckOrigin:     checkOrigin,
 }
 
 // websocketConn struct keeps the Websocket connection.
@@ -43,6 +45,133 @@ type websocketConn struct {
 
 	// Buffered channel of outbound messages.
 	send chan []byte
+
+	// Client identity.  This is set from the TLS client
+	// certificate or by the client with the hello command.
+	// It is read from other goroutines, so it is only used
+	// through getName and setName.
+	name string
+
+	// Protects the name.
+	nameMu sync.Mutex
+
+	// Set if the name came from a verified client certificate.
+	// The client cannot change the name with hello.
+	isVerified bool
+
+	// Remote address of the client.
+	remoteAddr string
+
+	// User agent given by the client.
+	userAgent string
+
+	// Time the client connected.
+	connectTime time.Time
+
+	// Backpressure policy used when the send buffer is full.
+	policy string
+
+	// Messages dropped since the client connected.
+	dropped uint64
+
+	// Messages dropped the client has not been told about.
+	droppedPending uint64
+
+	// Last frame coalesced for the client and its messages.
+	// Only used by the echo hub.
+	coalescedFrame []byte
+	coalesced      [][]byte
+
+	// Reason sent in the close frame when the server shuts down.
+	// Set by the echo hub before the send channel is closed.
+	closeReason string
+
+	// Closed when the writer stops.
+	writerDone chan struct{}
+}
+
+// wsCommand is a command received from a websocket.
+// It keeps the connection that sent the command so
+// the response can be sent back to the client.
+type wsCommand struct {
+	c *websocketConn // Websocket that sent the command
+	d []byte         // Command
+}
+
+// ClientInfo describes a websocket client
+// so it can be listed in the presence list.
+type ClientInfo struct {
+	Name        string
+	RemoteAddr  string
+	UserAgent   string
+	ConnectTime time.Time
+	Policy      string
+	Dropped     uint64
+}
+
+// ClientList is the presence list of the
+// connected websocket clients.
+type ClientList struct {
+	Clients []ClientInfo
+}
+
+// ClientEvent is broadcast when a client
+// joins, leaves or changes its name.
+type ClientEvent struct {
+	Cmd    string // Join, Leave or Hello
+	Client ClientInfo
+}
+
+// info will get the client information for the presence list.
+func (wsConn *websocketConn) info() ClientInfo {
+	return ClientInfo{
+		Name:        wsConn.getName(),
+		RemoteAddr:  wsConn.remoteAddr,
+		UserAgent:   wsConn.userAgent,
+		ConnectTime: wsConn.connectTime,
+		Policy:      wsConn.policy,
+		Dropped:     atomic.LoadUint64(&wsConn.dropped),
+	}
+}
+
+// getName will get the name of the client.
+func (wsConn *websocketConn) getName() string {
+	wsConn.nameMu.Lock()
+	defer wsConn.nameMu.Unlock()
+	return wsConn.name
+}
+
+// identity will get the name to show for the client.
+// If the client has not given a name, the remote address is used.
+func (wsConn *websocketConn) identity() string {
+	if name := wsConn.getName(); len(name) > 0 {
+		return name
+	}
+	return wsConn.remoteAddr
+}
+
+// setName will set the client name from the hello command.
+// Cmd: HELLO [name]
+// It returns false if the name could not be set.
+func (wsConn *websocketConn) setName(cmd string) bool {
+	// The name from the client certificate cannot be changed
+	if wsConn.isVerified {
+		log.Println("Client name is set by the certificate: " + wsConn.getName())
+		return false
+	}
+
+	// Split the command in to the 2 parameters
+	cmds := strings.SplitN(strings.TrimSpace(cmd), " ", 2)
+	if len(cmds) != 2 {
+		log.Println("Could not parse hello command: " + cmd)
+		return false
+	}
+
+	name := strings.TrimSpace(cmds[1])
+	wsConn.nameMu.Lock()
+	wsConn.name = name
+	wsConn.nameMu.Unlock()
+	return len(name) > 0
 }
 
 // reader is a Websocket reader
@@ -54,7 +183,9 @@ func (wsConn *websocketConn) reader() {
 	}()
 
 	// Init the websocket reader
-	wsConn.ws.SetReadLimit(maxMessageSize)
+	// Scripts, test runs and transfer chunks are sent in one message,
+	// so the limit is set by the -max-message-size flag
+	wsConn.ws.SetReadLimit(*maxMessageSize)
 	//wsConn.ws.SetReadDeadline(time.Now().Add(readWaitTime))
 	wsConn.ws.SetPongHandler(func(string) error { wsConn.ws.SetReadDeadline(time.Now().Add(readWaitTime)); return nil })
 
@@ -72,7 +203,7 @@ func (wsConn *websocketConn) reader() {
 			break
 		}
 		log.Println("Websocket message: " + string(message))
-		echo.serialBroadcast <- message
+		echo.serialBroadcast <- wsCommand{c: wsConn, d: message}
 	}
 
 }
@@ -88,6 +219,7 @@ func (wsConn *websocketConn) writer() {
 	defer func() {
 		log.Print("Close the websocket connection from writer")
 		wsConn.ws.Close()
+		close(wsConn.writerDone)
 	}()
 
 	for {
@@ -96,13 +228,25 @@ func (wsConn *websocketConn) writer() {
 		case message, ok := <-wsConn.send:
 			if !ok {
 				log.Println("Message for ws is not OK. ")
-				wsConn.write(websocket.CloseMessage, []byte{})
+				closeMsg := []byte{}
+				if len(wsConn.closeReason) > 0 {
+					closeMsg = websocket.FormatCloseMessage(websocket.CloseGoingAway, wsConn.closeReason)
+				}
+				wsConn.write(websocket.CloseMessage, closeMsg)
 				return
 			}
 			if err := wsConn.write(websocket.TextMessage, message); err != nil {
 				log.Println("Error writing. " + err.Error())
 				return
 			}
+
+			// Let the client know if messages were dropped
+			if dropped := wsConn.droppedMessage(); dropped != nil {
+				if err := wsConn.write(websocket.TextMessage, dropped); err != nil {
+					log.Println("Error writing. " + err.Error())
+					return
+				}
+			}
 		}
 	}
 }
@@ -130,7 +274,19 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Make a async channel to create the websocket connection
 	// This will block until the buffer is full
-	c := &websocketConn{send: make(chan []byte, 256*10), ws: ws}
+	c := &websocketConn{
+		send:        make(chan []byte, 256*10),
+		ws:          ws,
+		name:        clientCertName(r),
+		remoteAddr:  r.RemoteAddr,
+		userAgent:   r.UserAgent(),
+		connectTime: time.Now(),
+		policy:      *slowClientPolicy,
+		writerDone:  make(chan struct{}),
+	}
+	c.isVerified = len(c.name) > 0
+
+	log.Println("New websocket client " + c.identity())
 
 	// Register the connection with echo
 	echo.register <- c
@@ -0,0 +1,283 @@
+///
+/// XMODEM, XMODEM-1K and YMODEM senders.
+///
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// XMODEM control characters.
+const (
+	xmodemSOH = 0x01 // Start of a 128 byte block
+	xmodemSTX = 0x02 // Start of a 1024 byte block
+	xmodemEOT = 0x04 // End of the file
+	xmodemACK = 0x06 // Block received
+	xmodemNAK = 0x15 // Block not received, or start with a checksum
+	xmodemCAN = 0x18 // Cancel the transfer
+	xmodemCRC = 'C'  // Start with a CRC
+	xmodemSUB = 0x1A // Pads the last block
+)
+
+const (
+	// Time to wait for the receiver to start.
+	xmodemStartTimeout = 60 * time.Second
+
+	// Time to wait for the receiver to answer a block.
+	xmodemAckTimeout = 10 * time.Second
+
+	// Times a block is sent before the transfer fails.
+	xmodemMaxRetries = 10
+)
+
+// errTransferCancelled is returned when the receiver cancels the transfer.
+var errTransferCancelled = errors.New("Transfer cancelled by the receiver")
+
+// xmodemSender sends files with XMODEM or YMODEM
+// in a session on a serial port.
+type xmodemSender struct {
+	ps       *portSession
+	isCRC    bool                        // Receiver asked for a CRC instead of a checksum
+	is1K     bool                        // Send 1024 byte blocks
+	progress func(sent int, retries int) // Called after each block is sent
+	retries  int                         // Blocks sent again
+}
+
+// crc16XMODEM will calculate the CRC-16 used by XMODEM.
+func crc16XMODEM(p []byte) uint16 {
+	var crc uint16
+	for _, b := range p {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// waitStart will wait for the receiver to ask for the file.
+// A C asks for a CRC and a NAK for a checksum.
+func (xs *xmodemSender) waitStart(allowChecksum bool) error {
+	deadline := time.Now().Add(xmodemStartTimeout)
+	for time.Now().Before(deadline) {
+		b, err := xs.ps.read(1, time.Until(deadline))
+		if err != nil {
+			return err
+		}
+
+		switch b[0] {
+		case xmodemCRC:
+			xs.isCRC = true
+			return nil
+		case xmodemNAK:
+			if allowChecksum {
+				xs.isCRC = false
+				return nil
+			}
+		case xmodemCAN:
+			return errTransferCancelled
+		}
+	}
+	return errTimeout
+}
+
+// block will build the block with the number and data.
+// The data is padded to the block size.
+func (xs *xmodemSender) block(num byte, data []byte, size int, pad byte) []byte {
+	header := byte(xmodemSOH)
+	if size == 1024 {
+		header = xmodemSTX
+	}
+
+	blk := make([]byte, 0, size+5)
+	blk = append(blk, header, num, ^num)
+	blk = append(blk, data...)
+	for len(blk) < size+3 {
+		blk = append(blk, pad)
+	}
+
+	payload := blk[3:]
+	if xs.isCRC {
+		crc := crc16XMODEM(payload)
+		blk = append(blk, byte(crc>>8), byte(crc))
+	} else {
+		var sum byte
+		for _, b := range payload {
+			sum += b
+		}
+		blk = append(blk, sum)
+	}
+	return blk
+}
+
+// send will send the block until the receiver answers with an ACK.
+func (xs *xmodemSender) send(blk []byte) error {
+	for try := 0; try < xmodemMaxRetries; try++ {
+		if try > 0 {
+			xs.retries++
+		}
+
+		// Drop any noise left from the last block
+		xs.ps.discard()
+		if err := xs.ps.write(blk); err != nil {
+			return err
+		}
+
+		b, err := xs.ps.read(1, xmodemAckTimeout)
+		if err == errTimeout {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		switch b[0] {
+		case xmodemACK:
+			return nil
+		case xmodemCAN:
+			return errTransferCancelled
+		}
+	}
+	return errors.New("Block " + strconv.Itoa(int(blk[1])) + " was not received after " + strconv.Itoa(xmodemMaxRetries) + " tries")
+}
+
+// sendData will send the data in blocks, then the EOT.
+// The block numbers start at 1.
+func (xs *xmodemSender) sendData(data []byte) error {
+	size := 128
+	if xs.is1K && xs.isCRC {
+		size = 1024
+	}
+
+	num := byte(1)
+	for sent := 0; sent < len(data); num++ {
+		end := sent + size
+		if end > len(data) {
+			end = len(data)
+		}
+
+		// Use a short block for the end of the file
+		blkSize := size
+		if size == 1024 && end-sent <= 128 {
+			blkSize = 128
+		}
+
+		if err := xs.send(xs.block(num, data[sent:end], blkSize, xmodemSUB)); err != nil {
+			return err
+		}
+		sent = end
+		xs.progress(sent, xs.retries)
+	}
+
+	return xs.endOfFile()
+}
+
+// endOfFile will send EOT until the receiver answers with an ACK.
+// Some receivers NAK the first EOT to be sure it is not noise.
+func (xs *xmodemSender) endOfFile() error {
+	for try := 0; try < xmodemMaxRetries; try++ {
+		if err := xs.ps.write([]byte{xmodemEOT}); err != nil {
+			return err
+		}
+
+		b, err := xs.ps.read(1, xmodemAckTimeout)
+		if err == errTimeout {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		switch b[0] {
+		case xmodemACK:
+			return nil
+		case xmodemCAN:
+			return errTransferCancelled
+		}
+	}
+	return errors.New("End of file was not received")
+}
+
+// cancel will tell the receiver the transfer is cancelled.
+func (xs *xmodemSender) cancel() {
+	xs.ps.write([]byte{xmodemCAN, xmodemCAN, xmodemCAN})
+}
+
+// sendXMODEM will send the file with XMODEM.  The receiver
+// picks a checksum or CRC.  With is1K, 1024 byte blocks are
+// sent if the receiver asks for a CRC.
+func (xs *xmodemSender) sendXMODEM(data []byte) error {
+	if err := xs.waitStart(true); err != nil {
+		return err
+	}
+	return xs.sendData(data)
+}
+
+// ymodemHeader will build the data of block 0 with the name and
+// size of the file.  An empty name is sent as file.bin, since an
+// empty name ends the batch.  The header must fit in a 1024 byte block.
+func ymodemHeader(name string, size int) ([]byte, error) {
+	if name == "" {
+		name = "file.bin"
+	}
+	header := append([]byte(name), 0)
+	header = append(header, []byte(strconv.Itoa(size))...)
+	if len(header) > 1024 {
+		return nil, errors.New("File name " + strconv.Itoa(len(name)) + " bytes long does not fit in the YMODEM header")
+	}
+	return header, nil
+}
+
+// sendYMODEM will send the files as a YMODEM batch.
+// Each file starts with block 0 giving its name and
+// size, and an empty block 0 ends the batch.
+func (xs *xmodemSender) sendYMODEM(files []transferFile) error {
+	xs.is1K = true
+
+	total := 0
+	for _, f := range files {
+		if err := xs.waitStart(false); err != nil {
+			return err
+		}
+
+		// An empty name ends the batch
+		header, err := ymodemHeader(f.name, len(f.data))
+		if err != nil {
+			return err
+		}
+		size := 128
+		if len(header) > 128 {
+			size = 1024
+		}
+		if err := xs.send(xs.block(0, header, size, 0)); err != nil {
+			return err
+		}
+
+		// The receiver asks for the data with another C
+		if err := xs.waitStart(false); err != nil {
+			return err
+		}
+
+		progress := xs.progress
+		xs.progress = func(sent int, retries int) { progress(total+sent, retries) }
+		err = xs.sendData(f.data)
+		xs.progress = progress
+		if err != nil {
+			return err
+		}
+		total += len(f.data)
+	}
+
+	// End the batch
+	if err := xs.waitStart(false); err != nil {
+		return err
+	}
+	return xs.send(xs.block(0, nil, 128, 0))
+}
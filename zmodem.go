@@ -0,0 +1,472 @@
+///
+/// ZMODEM receiver.
+///
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ZMODEM framing characters.
+const (
+	zmodemPAD   = '*'  // Starts a header
+	zmodemDLE   = 0x18 // Escapes the next character
+	zmodemBIN   = 'A'  // Binary header with a CRC-16
+	zmodemHEX   = 'B'  // Hex header with a CRC-16
+	zmodemBIN32 = 'C'  // Binary header with a CRC-32
+	zmodemXON   = 0x11
+	zmodemXOFF  = 0x13
+)
+
+// ZMODEM frame types.
+const (
+	zmodemRQINIT  = 0
+	zmodemRINIT   = 1
+	zmodemSINIT   = 2
+	zmodemACK     = 3
+	zmodemFILE    = 4
+	zmodemSKIP    = 5
+	zmodemNAK     = 6
+	zmodemABORT   = 7
+	zmodemFIN     = 8
+	zmodemRPOS    = 9
+	zmodemDATA    = 10
+	zmodemEOF     = 11
+	zmodemFERR    = 12
+	zmodemCAN     = 16
+	zmodemCOMMAND = 18
+)
+
+// Ends of a data subpacket, after a ZDLE.
+const (
+	zmodemCRCE = 'h' // End of the frame, no response
+	zmodemCRCG = 'i' // More data follows, no response
+	zmodemCRCQ = 'j' // More data follows, ZACK expected
+	zmodemCRCW = 'k' // End of the frame, ZACK expected
+	zmodemRUB0 = 'l' // Escaped 0x7F
+	zmodemRUB1 = 'm' // Escaped 0xFF
+)
+
+const (
+	// Receiver can send and receive at the same time, can receive
+	// during disk IO and can use a CRC-32.  ZF0 of ZRINIT.
+	zmodemReceiverFlags = 0x01 | 0x02 | 0x20
+
+	// Largest data subpacket accepted.
+	zmodemMaxSubpacket = 8 * 1024
+
+	// Headers sent before the receive fails.
+	zmodemMaxRetries = 10
+)
+
+// zmodemCancel is sent to cancel the transfer.
+const zmodemCancel = "\x18\x18\x18\x18\x18\x18\x18\x18\x08\x08\x08\x08\x08\x08\x08\x08"
+
+// zmodemHeader is a ZMODEM frame header.
+type zmodemHeader struct {
+	frameType byte
+	data      [4]byte // Position, low byte first, or flags ZF3 to ZF0
+	is32      bool    // Sent with a CRC-32, so the data subpackets also use one
+}
+
+// pos will get the file position in the header.
+func (h zmodemHeader) pos() int64 {
+	return int64(h.data[0]) | int64(h.data[1])<<8 | int64(h.data[2])<<16 | int64(h.data[3])<<24
+}
+
+// zmodemReceiver receives the files from a
+// ZMODEM sender into the downloads directory.
+type zmodemReceiver struct {
+	fr  *fileReceiver
+	buf []byte // Data read from the port not used yet
+}
+
+// readByte will read the next byte from the serial port.
+func (zr *zmodemReceiver) readByte(timeout time.Duration) (byte, error) {
+	if len(zr.buf) == 0 {
+		p, err := zr.fr.ps.readUntil(func(p []byte) int {
+			if len(p) > 0 {
+				return len(p)
+			}
+			return -1
+		}, timeout, 0)
+		if err != nil {
+			return 0, err
+		}
+		zr.buf = p
+	}
+
+	b := zr.buf[0]
+	zr.buf = zr.buf[1:]
+	return b, nil
+}
+
+// readEscaped will read a byte that can be escaped with ZDLE.
+// XON and XOFF are skipped.  At the end of a subpacket it
+// returns the end character with isEnd set.
+func (zr *zmodemReceiver) readEscaped(timeout time.Duration) (byte, bool, error) {
+	for {
+		b, err := zr.readByte(timeout)
+		if err != nil {
+			return 0, false, err
+		}
+
+		switch b {
+		case zmodemXON, zmodemXOFF, zmodemXON | 0x80, zmodemXOFF | 0x80:
+			continue
+		case zmodemDLE:
+		default:
+			return b, false, nil
+		}
+
+		b, err = zr.readByte(timeout)
+		if err != nil {
+			return 0, false, err
+		}
+
+		switch b {
+		case zmodemCRCE, zmodemCRCG, zmodemCRCQ, zmodemCRCW:
+			return b, true, nil
+		case zmodemRUB0:
+			return 0x7F, false, nil
+		case zmodemRUB1:
+			return 0xFF, false, nil
+		case zmodemDLE:
+			// Only a cancel has two ZDLE in a row
+			return 0, false, errTransferCancelled
+		}
+		if b&0x60 != 0x40 {
+			return 0, false, errBadBlock
+		}
+		return b ^ 0x40, false, nil
+	}
+}
+
+// readHeader will find and read the next header.
+// Anything before the header is skipped.
+func (zr *zmodemReceiver) readHeader(timeout time.Duration) (zmodemHeader, error) {
+	var h zmodemHeader
+
+	deadline := time.Now().Add(timeout)
+	for {
+		if time.Now().After(deadline) {
+			return h, errTimeout
+		}
+
+		// Find the pads and the ZDLE
+		b, err := zr.readByte(time.Until(deadline))
+		if err != nil {
+			return h, err
+		}
+		if b != zmodemPAD {
+			continue
+		}
+		for b == zmodemPAD {
+			if b, err = zr.readByte(receiveBlockTimeout); err != nil {
+				return h, err
+			}
+		}
+		if b != zmodemDLE {
+			continue
+		}
+
+		kind, err := zr.readByte(receiveBlockTimeout)
+		if err != nil {
+			return h, err
+		}
+
+		var raw []byte
+		switch kind {
+		case zmodemHEX:
+			raw, err = zr.readHex(7)
+		case zmodemBIN:
+			raw, err = zr.readRaw(7)
+		case zmodemBIN32:
+			raw, err = zr.readRaw(9)
+			h.is32 = true
+		default:
+			continue
+		}
+		if err != nil {
+			return h, err
+		}
+
+		if h.is32 {
+			crc := uint32(raw[5]) | uint32(raw[6])<<8 | uint32(raw[7])<<16 | uint32(raw[8])<<24
+			if crc32.ChecksumIEEE(raw[:5]) != crc {
+				return h, errBadBlock
+			}
+		} else if crc16XMODEM(raw[:5]) != uint16(raw[5])<<8|uint16(raw[6]) {
+			return h, errBadBlock
+		}
+
+		h.frameType = raw[0]
+		copy(h.data[:], raw[1:5])
+		return h, nil
+	}
+}
+
+// readHex will read n bytes sent as hex digits.
+func (zr *zmodemReceiver) readHex(n int) ([]byte, error) {
+	digits := make([]byte, n*2)
+	for i := range digits {
+		b, err := zr.readByte(receiveBlockTimeout)
+		if err != nil {
+			return nil, err
+		}
+		digits[i] = b & 0x7F
+	}
+
+	raw := make([]byte, n)
+	if _, err := hex.Decode(raw, digits); err != nil {
+		return nil, errBadBlock
+	}
+	return raw, nil
+}
+
+// readRaw will read n bytes that can be escaped.
+func (zr *zmodemReceiver) readRaw(n int) ([]byte, error) {
+	raw := make([]byte, n)
+	for i := range raw {
+		b, isEnd, err := zr.readEscaped(receiveBlockTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if isEnd {
+			return nil, errBadBlock
+		}
+		raw[i] = b
+	}
+	return raw, nil
+}
+
+// readSubpacket will read a data subpacket and check its CRC.
+// It returns the data and the end character.
+func (zr *zmodemReceiver) readSubpacket(is32 bool) ([]byte, byte, error) {
+	var data []byte
+	for {
+		b, isEnd, err := zr.readEscaped(receiveBlockTimeout)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !isEnd {
+			data = append(data, b)
+			if len(data) > zmodemMaxSubpacket {
+				return nil, 0, errBadBlock
+			}
+			continue
+		}
+
+		// The CRC includes the end character
+		n := 2
+		if is32 {
+			n = 4
+		}
+		crc, err := zr.readRaw(n)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		checked := append(data, b)
+		if is32 {
+			if crc32.ChecksumIEEE(checked) != uint32(crc[0])|uint32(crc[1])<<8|uint32(crc[2])<<16|uint32(crc[3])<<24 {
+				return nil, 0, errBadBlock
+			}
+		} else if crc16XMODEM(checked) != uint16(crc[0])<<8|uint16(crc[1]) {
+			return nil, 0, errBadBlock
+		}
+		return data, b, nil
+	}
+}
+
+// sendHeader will send a hex header.
+func (zr *zmodemReceiver) sendHeader(frameType byte, data [4]byte) error {
+	raw := append([]byte{frameType}, data[:]...)
+	crc := crc16XMODEM(raw)
+	raw = append(raw, byte(crc>>8), byte(crc))
+
+	frame := []byte{zmodemPAD, zmodemPAD, zmodemDLE, zmodemHEX}
+	frame = append(frame, []byte(hex.EncodeToString(raw))...)
+	frame = append(frame, '\r', '\n'|0x80)
+	if frameType != zmodemFIN && frameType != zmodemACK {
+		frame = append(frame, zmodemXON)
+	}
+	return zr.fr.ps.write(frame)
+}
+
+// sendPos will send a header with the file position.
+func (zr *zmodemReceiver) sendPos(frameType byte, pos int64) error {
+	return zr.sendHeader(frameType, [4]byte{byte(pos), byte(pos >> 8), byte(pos >> 16), byte(pos >> 24)})
+}
+
+// sendRINIT will tell the sender the receiver is ready.
+func (zr *zmodemReceiver) sendRINIT() error {
+	return zr.sendHeader(zmodemRINIT, [4]byte{0, 0, 0, zmodemReceiverFlags})
+}
+
+// receive will receive the files until the sender ends the session.
+func (zr *zmodemReceiver) receive(startTimeout time.Duration) error {
+	if err := zr.sendRINIT(); err != nil {
+		return err
+	}
+
+	// Ask again for the frame expected when a header is lost
+	resend := zr.sendRINIT
+	timeout := startTimeout
+	retries := 0
+
+	for {
+		h, err := zr.readHeader(timeout)
+		if err == errTimeout || err == errBadBlock {
+			retries++
+			if retries > zmodemMaxRetries {
+				return errors.New("Too many bad or missing headers")
+			}
+			if err := resend(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		timeout = receiveBlockTimeout
+
+		switch h.frameType {
+		case zmodemRQINIT:
+			if err := zr.sendRINIT(); err != nil {
+				return err
+			}
+
+		case zmodemSINIT:
+			// The attention string is not used
+			if _, _, err := zr.readSubpacket(h.is32); err != nil && err != errBadBlock {
+				return err
+			}
+			if err := zr.sendPos(zmodemACK, 0); err != nil {
+				return err
+			}
+
+		case zmodemFILE:
+			info, _, err := zr.readSubpacket(h.is32)
+			if err == errBadBlock {
+				if err := zr.sendPos(zmodemNAK, 0); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			// The name, then the size, time and mode
+			fields := strings.SplitN(string(info), "\x00", 3)
+			size := int64(-1)
+			if len(fields) > 1 {
+				if f := strings.Fields(fields[1]); len(f) > 0 {
+					if n, err := strconv.ParseInt(f[0], 10, 64); err == nil {
+						size = n
+					}
+				}
+			}
+			zr.fr.abort()
+			if err := zr.fr.create(fields[0], size); err != nil {
+				return err
+			}
+
+			resend = func() error { return zr.sendPos(zmodemRPOS, zr.fr.written) }
+			if err := resend(); err != nil {
+				return err
+			}
+
+		case zmodemDATA:
+			if zr.fr.file == nil {
+				return errors.New("Data received before the file name")
+			}
+			if h.pos() != zr.fr.written {
+				// Data was lost, ask for it again
+				if err := resend(); err != nil {
+					return err
+				}
+				continue
+			}
+
+			err := zr.receiveData(h.is32)
+			if err == errBadBlock || err == errTimeout {
+				retries++
+				if retries > zmodemMaxRetries {
+					return errors.New("Too many bad data packets")
+				}
+				if err := resend(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			retries = 0
+
+		case zmodemEOF:
+			if zr.fr.file == nil || h.pos() != zr.fr.written {
+				continue
+			}
+			if err := zr.fr.finish(); err != nil {
+				return err
+			}
+			resend = zr.sendRINIT
+			if err := zr.sendRINIT(); err != nil {
+				return err
+			}
+
+		case zmodemFIN:
+			zr.sendPos(zmodemFIN, 0)
+
+			// The sender ends with OO, wait for it so
+			// it is not broadcast after the session
+			zr.fr.ps.readUntil(func(p []byte) int {
+				if i := strings.Index(string(p), "OO"); i >= 0 {
+					return i + 2
+				}
+				return -1
+			}, time.Second, 0)
+			return nil
+
+		case zmodemCAN, zmodemABORT, zmodemFERR:
+			return errTransferCancelled
+
+		case zmodemCOMMAND:
+			return errors.New("ZMODEM commands are not allowed")
+		}
+	}
+}
+
+// receiveData will receive the data subpackets of a ZDATA frame.
+func (zr *zmodemReceiver) receiveData(is32 bool) error {
+	for {
+		data, end, err := zr.readSubpacket(is32)
+		if err != nil {
+			return err
+		}
+		if err := zr.fr.write(data); err != nil {
+			return err
+		}
+
+		switch end {
+		case zmodemCRCW:
+			return zr.sendPos(zmodemACK, zr.fr.written)
+		case zmodemCRCQ:
+			if err := zr.sendPos(zmodemACK, zr.fr.written); err != nil {
+				return err
+			}
+		case zmodemCRCE:
+			return nil
+		}
+	}
+}